@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,18 +23,19 @@ import (
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
-	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
 )
 
 var (
 	confFile string
+	tsdbPath string
 	h        bool
 	v        bool
 )
 
 func initArgs() {
 	flag.StringVar(&confFile, "config", "./prom-stream-downsample.yaml", "config path")
+	flag.StringVar(&tsdbPath, "tsdb.path", "", "离线降采样的 TSDB 数据目录或单个 block 目录, 设置后对其时间范围执行一次降采样后退出")
 	flag.BoolVar(&v, "v", false, "版本信息")
 	flag.BoolVar(&h, "h", false, "帮助信息")
 	flag.Parse()
@@ -72,6 +76,15 @@ func main() {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 
+	if len(tsdbPath) > 0 {
+		err := runOffline(ctx, cancel)
+		cancel()
+		if err != nil {
+			logrus.WithField("error", err).Fatalln("offline downsample failed")
+		}
+		return
+	}
+
 	reloadCh := make(chan chan error)
 	reloaders := []reloader{
 		{
@@ -83,40 +96,59 @@ func main() {
 	global := config.Get().GlobalConfig
 
 	if global.EnabledDownSample {
-		writeCh := make(chan []prompb.TimeSeries, 1024)
-		p8s, err := prometheus.NewPrometheus(
-			global.Prometheus.RemoteReadGroup,
-			global.Prometheus.RemoteWriteUrl,
-			global.EnabledStream,
-			writeCh,
-		)
+		var readAddr string
+		if len(global.Prometheus.RemoteReadGroup) > 0 {
+			readAddr = strings.TrimSuffix(global.Prometheus.RemoteReadGroup[0], "/api/v1/read")
+		}
+		metadata, err := newMetadataCache(global.Metadata, readAddr)
+		if err != nil {
+			cancel()
+			logrus.WithField("error", err).Fatalln("init metadata failed")
+		}
+		if metadata != nil {
+			go metadata.Run(ctx)
+		}
+
+		writeCh := make(chan pb.WriteBatch, 1024)
+		writer, err := newWriter(global, writeCh, metadata, false)
+		if err != nil {
+			cancel()
+			logrus.WithField("error", err).Fatalln("init writer failed")
+		}
+
+		p8s, err := prometheus.NewPrometheus(global.Prometheus.RemoteReadGroup, global.Prometheus.Stream)
 		if err != nil {
 			cancel()
 			logrus.WithField("error", err).Fatalln("init prometheus failed")
 		}
 
-		go p8s.StartRemoteWrite(ctx)
+		writeDone := make(chan struct{})
+		go func() {
+			writer.Start(ctx)
+			close(writeDone)
+		}()
+
+		sources, err := newSources(global.Sources)
+		if err != nil {
+			cancel()
+			logrus.WithField("error", err).Fatalln("init sources failed")
+		}
+		sources[pb.DefaultSourceName] = p8s
 
 		ds := downsample.NewDownSampleMgr(
 			ctx,
 			writeCh,
-			p8s,
-			func() pb.Intervals {
-				var res pb.Intervals
-				for _, r := range config.Get().GlobalConfig.Resolutions.Rs {
-					res = append(res, pb.Interval{
-						IntervalName:  r.StringInterval,
-						IntervalValue: r.SampleInterval,
-					})
-				}
-				sort.Sort(res)
-				return res
-			}())
+			sources,
+			intervals(),
+		)
 		ds.Start()
 
 		defer func() {
+			// 等待降采样协程退出后才能关闭 writeCh
 			ds.Stop()
 			close(writeCh)
+			// 等待所有写入目标关闭, 保证缓存中的数据被写出
+			<-writeDone
 		}()
 	}
 
@@ -133,7 +165,7 @@ func main() {
 			func() pb.MetricProxySet {
 				mps := make(pb.MetricProxySet, len(pxyCfg.ProxyMetrics))
 				for _, pm := range config.Get().ProxyConfig.ProxyMetrics {
-					mp := pb.MetricProxy{Agg: pm.Aggregation}
+					mp := pb.MetricProxy{Agg: pm.Aggregation, Aggs: pm.Aggregations}
 
 					if reg, err := regexp.Compile(pm.MetricNameRe); err == nil {
 						mp.MetricRe = reg
@@ -148,7 +180,7 @@ func main() {
 			cancel()
 			logrus.WithField("error", err).Fatalln("init proxy failed")
 		}
-		pxy.StartProxy()
+		pxy.StartProxy(ctx)
 
 		reloaders = append(reloaders, reloader{
 			name:     "proxy",
@@ -186,6 +218,232 @@ func main() {
 	logrus.Warnln("quit...")
 }
 
+func intervals() pb.Intervals {
+	var res pb.Intervals
+	for _, r := range config.Get().GlobalConfig.Resolutions.Rs {
+		res = append(res, pb.Interval{
+			IntervalName:  r.StringInterval,
+			IntervalValue: r.SampleInterval,
+		})
+	}
+	sort.Sort(res)
+	return res
+}
+
+// runOffline 以本地 TSDB 为数据源, 对其覆盖的时间范围执行一次降采样, 结果通过正常的写入路径写出
+func runOffline(ctx context.Context, cancel context.CancelFunc) error {
+	source, err := prometheus.NewTSDBSource(tsdbPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	global := config.Get().GlobalConfig
+	// 离线模式下只使用显式配置的 metadata.url
+	metadata, err := newMetadataCache(global.Metadata, "")
+	if err != nil {
+		return err
+	}
+
+	writeCh := make(chan pb.WriteBatch, 1024)
+	// 离线模式下写入目标队列满时阻塞等待, 不能丢数据
+	writer, err := newWriter(global, writeCh, metadata, true)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-term:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		writer.Start(ctx)
+		close(done)
+	}()
+
+	// 所有 job 都从 TSDB 中读取数据
+	sources := map[string]prometheus.Source{pb.DefaultSourceName: source}
+	for _, dsc := range config.Get().DownSampleConfig {
+		sources[dsc.Source] = source
+	}
+
+	mint, maxt := source.TimeRange()
+	logrus.WithFields(logrus.Fields{
+		"path": tsdbPath,
+		"mint": mint,
+		"maxt": maxt,
+	}).Warnln("offline downsample start")
+
+	ds := downsample.NewDownSampleMgr(ctx, writeCh, sources, intervals())
+	ds.RunOffline(mint, maxt)
+
+	// 等待剩余数据全部写出
+	close(writeCh)
+	<-done
+
+	logrus.Warnln("offline downsample done")
+	return ctx.Err()
+}
+
+// newWriter 未配置 remote_write 时使用 sink / prometheus.remote_write_url 作为唯一的写入目标
+func newWriter(
+	global config.GlobalConfig,
+	writeCh chan pb.WriteBatch,
+	metadata *prometheus.MetadataCache,
+	blocking bool,
+) (*prometheus.Writer, error) {
+	rws := global.RemoteWrite
+	if len(rws) == 0 {
+		sink := global.Sink
+		if len(sink.URL) == 0 {
+			sink.URL = global.Prometheus.RemoteWriteUrl
+		}
+		rws = []config.RemoteWrite{{
+			Name:        pb.DefaultTargetName,
+			Sink:        sink,
+			QueueConfig: global.Prometheus.QueueConfig,
+		}}
+	}
+
+	targets := make([]*prometheus.WriteTarget, 0, len(rws))
+	names := make(map[string]struct{}, len(rws))
+	for _, rw := range rws {
+		if _, ok := names[rw.Name]; ok {
+			return nil, fmt.Errorf("duplicate remote_write name %s", rw.Name)
+		}
+		names[rw.Name] = struct{}{}
+
+		sink, err := newSink(rw.Sink, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("remote_write %s: %w", rw.Name, err)
+		}
+
+		wal, err := newWAL(global.WAL, rw.Name)
+		if err != nil {
+			return nil, fmt.Errorf("remote_write %s: %w", rw.Name, err)
+		}
+
+		targets = append(targets, prometheus.NewWriteTarget(
+			rw.Name,
+			sink,
+			wal,
+			queueConfig(rw.QueueConfig),
+			prometheus.TargetFilter{
+				Jobs:         rw.Match.Jobs,
+				Resolutions:  rw.Match.Resolutions,
+				Aggregations: rw.Match.Aggregations,
+			},
+		))
+	}
+	return prometheus.NewWriter(writeCh, targets, blocking), nil
+}
+
+func newSink(sc config.Sink, metadata *prometheus.MetadataCache) (prometheus.Sink, error) {
+	auth := prometheus.Auth{
+		BearerToken: sc.BearerToken,
+		Headers:     sc.Headers,
+	}
+	if sc.BasicAuth != nil {
+		auth.Username = sc.BasicAuth.Username
+		auth.Password = sc.BasicAuth.Password
+	}
+
+	switch sc.Type {
+	case pb.SinkTypeTSDBBlock:
+		var tiers []string
+		for _, interval := range intervals() {
+			tiers = append(tiers, interval.IntervalName)
+		}
+		return prometheus.NewBlockWriterSink(sc.BlockDir, time.Duration(sc.BlockDuration), tiers, time.Duration(sc.BlockIdleTimeout))
+	case pb.SinkTypeOTLP:
+		return prometheus.NewOTLPSink(sc.URL, auth), nil
+	case pb.SinkTypeVictoriaMetrics:
+		return prometheus.NewVMImportSink(sc.URL, auth), nil
+	case pb.SinkTypeFile:
+		return prometheus.NewFileSink(
+			sc.Path,
+			sc.Format,
+			int64(sc.RotateSizeMB)<<20,
+			time.Duration(sc.RotateInterval),
+			sc.Compression,
+		)
+	default:
+		return prometheus.NewRemoteWriteSink(sc.URL, auth, sc.ProtobufMessage, metadata), nil
+	}
+}
+
+// newMetadataCache 未配置 metadata.url 时使用 defaultAddr, 都为空时不拉取原始元数据, 只根据聚合函数推导类型
+func newMetadataCache(mc config.Metadata, defaultAddr string) (*prometheus.MetadataCache, error) {
+	addr := mc.URL
+	if len(addr) == 0 {
+		addr = defaultAddr
+	}
+	if len(addr) == 0 {
+		return nil, nil
+	}
+
+	interval := mc.RefreshInterval
+	if interval == 0 {
+		interval = config.DefaultMetadataRefreshInterval
+	}
+	return prometheus.NewMetadataCache(addr, time.Duration(interval))
+}
+
+// newWAL 未配置 wal.dir 时不使用 wal, 写出失败的数据会被丢弃
+// 每个写入目标使用 wal.dir 下以写入目标名称命名的子目录
+func newWAL(wc config.WAL, name string) (*prometheus.WALQueue, error) {
+	if len(wc.Dir) == 0 {
+		return nil, nil
+	}
+	return prometheus.OpenWALQueue(
+		filepath.Join(wc.Dir, name),
+		int64(wc.SegmentSizeMB)<<20,
+		int64(wc.MaxSizeMB)<<20,
+		time.Duration(wc.SyncInterval),
+	)
+}
+
+func queueConfig(qc config.QueueConfig) prometheus.QueueConfig {
+	return prometheus.QueueConfig{
+		Capacity:          qc.Capacity,
+		MinShards:         qc.MinShards,
+		MaxShards:         qc.MaxShards,
+		MaxSamplesPerSend: qc.MaxSamplesPerSend,
+		MaxBytesPerSend:   qc.MaxBytesPerSend,
+		BatchSendDeadline: time.Duration(qc.BatchSendDeadline),
+		MinBackoff:        time.Duration(qc.MinBackoff),
+		MaxBackoff:        time.Duration(qc.MaxBackoff),
+	}
+}
+
+func newSources(cfgs []config.Source) (map[string]prometheus.Source, error) {
+	sources := make(map[string]prometheus.Source, len(cfgs)+1)
+	for _, sc := range cfgs {
+		var (
+			source prometheus.Source
+			err    error
+		)
+		switch sc.Type {
+		case pb.SourceTypeQueryRange:
+			source, err = prometheus.NewQueryRangeSource(sc.URLs[0])
+		default:
+			source, err = prometheus.NewPrometheus(sc.URLs, sc.Stream)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", sc.Name, err)
+		}
+		sources[sc.Name] = source
+	}
+	return sources, nil
+}
+
 func reloadConfig(reloaders []reloader) error {
 	logrus.Warnln("reloaders reload start")
 
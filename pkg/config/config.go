@@ -2,12 +2,16 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"prom-stream-downsample/pkg/pb"
 
+	"github.com/prometheus/common/model"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
@@ -73,12 +77,57 @@ func load(bytes []byte) (*PromStreamDownSampleConfig, error) {
 type Metric struct {
 	MetricNameRe string `yaml:"metric_name_re"`
 	Aggregation  string `yaml:"aggregation"`
+	// 该指标额外存在的降采样聚合, proxy 按查询函数选择对应的聚合, 如 max_over_time 使用 max
+	Aggregations []string `yaml:"aggregations"`
 }
 
 type ProxyConfig struct {
 	ListenAddr   string      `yaml:"listen_addr"`
 	DataSources  DataSources `yaml:"data_sources"`
 	ProxyMetrics []Metric    `yaml:"proxy_metrics"`
+	// 原始数据源的保留时长, 配置后降采样的 range query 在该边界拆分:
+	// 边界之后的部分查询原始数据, 之前的部分查询降采样数据, 合并后返回; 0 表示不拆分
+	RawRetention model.Duration `yaml:"raw_retention"`
+	// 降采样指标索引, 只有降采样指标存在且覆盖查询范围时才替换
+	SeriesIndex SeriesIndex `yaml:"series_index"`
+	// range query 结果缓存, 查询按 split_interval 拆分后并行执行, 已完整的部分缓存在内存中
+	ResultsCache ResultsCache `yaml:"results_cache"`
+	// 响应中的降采样指标名还原为原始指标名, 图例和告警 label 不随查询时间范围变化
+	RestoreMetricName bool `yaml:"restore_metric_name"`
+	// 还原指标名时添加 resolution/agg label, 标识使用的降采样精度和聚合
+	DownsampleLabels bool `yaml:"downsample_labels"`
+}
+
+// SeriesIndex 是 proxy 中降采样指标索引的配置
+type SeriesIndex struct {
+	// 降采样指标名的刷新周期
+	RefreshInterval model.Duration `yaml:"refresh_interval"`
+	// 查找降采样数据覆盖起始时间的最大回溯范围
+	MaxLookback model.Duration `yaml:"max_lookback"`
+}
+
+// ResultsCache 是 proxy 中 range query 结果缓存的配置
+type ResultsCache struct {
+	Enabled bool `yaml:"enabled"`
+	// 查询拆分的时间间隔, 拆分边界对齐到该间隔的整数倍
+	SplitInterval model.Duration `yaml:"split_interval"`
+	// 缓存的最大大小, 单位 MB
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// 结束时间在最近该时长内的结果数据可能不完整, 不缓存
+	MaxFreshness model.Duration `yaml:"max_freshness"`
+}
+
+// DefaultResultsCache 未配置 results_cache 中的字段时使用
+var DefaultResultsCache = ResultsCache{
+	SplitInterval: model.Duration(24 * time.Hour),
+	MaxSizeMB:     256,
+	MaxFreshness:  model.Duration(10 * time.Minute),
+}
+
+// DefaultSeriesIndex 未配置 series_index 时使用
+var DefaultSeriesIndex = SeriesIndex{
+	RefreshInterval: model.Duration(5 * time.Minute),
+	MaxLookback:     model.Duration(90 * 24 * time.Hour),
 }
 
 type DataSources struct {
@@ -93,18 +142,320 @@ type PromStreamDownSampleConfig struct {
 }
 
 type GlobalConfig struct {
+	// Deprecated: 是否流式传输改为按地址探测, 请使用 prometheus.stream; 未配置 prometheus.stream 时 true 等价于 stream: on
 	EnabledStream      bool           `yaml:"enabled_stream"`
 	EnabledProxy       bool           `yaml:"enabled_proxy"`
 	EnabledDownSample  bool           `yaml:"enabled_downsample"`
 	EnabledMetricReuse bool           `yaml:"enabled_metric_reuse"`
 	Prometheus         Prometheus     `yaml:"prometheus"`
+	Sources            []Source       `yaml:"sources"`
+	Sink               Sink           `yaml:"sink"`
+	RemoteWrite        []RemoteWrite  `yaml:"remote_write"`
+	WAL                WAL            `yaml:"wal"`
+	Backpressure       Backpressure   `yaml:"backpressure"`
+	Metadata           Metadata       `yaml:"metadata"`
 	Resolutions        pb.Resolutions `yaml:"resolutions"`
 }
 
+func (g *GlobalConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	gc := &GlobalConfig{}
+	type plain GlobalConfig
+
+	if err := unmarshal((*plain)(gc)); err != nil {
+		return err
+	}
+
+	// 兼容已废弃的 enabled_stream: 未配置 prometheus.stream 时等价于 stream: on
+	switch {
+	case gc.EnabledStream && len(gc.Prometheus.Stream) == 0:
+		gc.Prometheus.Stream = pb.StreamModeOn
+		logrus.Warnln("global_config.enabled_stream is deprecated, use global_config.prometheus.stream: on instead")
+	case gc.EnabledStream:
+		logrus.WithField("stream", gc.Prometheus.Stream).Warnln("global_config.enabled_stream is deprecated and ignored, prometheus.stream is set")
+	case len(gc.Prometheus.Stream) == 0:
+		gc.Prometheus.Stream = pb.StreamModeAuto
+	}
+
+	*g = *gc
+	return nil
+}
+
+// Sink 是 downsample 结果的写出端, 默认通过 prometheus.remote_write_url 写出
+type Sink struct {
+	// remote_write / tsdb_block / otlp / file / victoriametrics
+	Type string `yaml:"type"`
+	// remote_write / otlp 类型的写入地址和认证信息, otlp 为 OTLP/HTTP 地址, 如 http://collector:4318/v1/metrics
+	URL         string            `yaml:"url"`
+	BasicAuth   *BasicAuth        `yaml:"basic_auth"`
+	BearerToken string            `yaml:"bearer_token"`
+	Headers     map[string]string `yaml:"headers"`
+	// remote write 协议版本: prometheus.WriteRequest (1.0, 默认) / io.prometheus.write.v2.Request (2.0)
+	ProtobufMessage string `yaml:"protobuf_message"`
+	// tsdb_block 类型下 block 的输出目录和 block 时间跨度, 超过 block_idle_timeout 没有写入的 block 直接落盘 (默认为 block_duration)
+	BlockDir         string         `yaml:"block_dir"`
+	BlockDuration    model.Duration `yaml:"block_duration"`
+	BlockIdleTimeout model.Duration `yaml:"block_idle_timeout"`
+	// file 类型的输出目录、格式 (openmetrics / ndjson) 和滚动策略
+	Path           string         `yaml:"path"`
+	Format         string         `yaml:"format"`
+	RotateSizeMB   int            `yaml:"rotate_size_mb"`
+	RotateInterval model.Duration `yaml:"rotate_interval"`
+	// 压缩方式, 目前只支持 gzip, 为空不压缩
+	Compression string `yaml:"compression"`
+}
+
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (s *Sink) UnmarshalYAML(unmarshal func(any) error) error {
+	sc := &Sink{}
+	type plain Sink
+
+	if err := unmarshal((*plain)(sc)); err != nil {
+		return err
+	}
+
+	if err := sc.validate(); err != nil {
+		return err
+	}
+
+	*s = *sc
+	return nil
+}
+
+func (s *Sink) validate() error {
+	switch s.Type {
+	case "", pb.SinkTypeRemoteWrite:
+		s.Type = pb.SinkTypeRemoteWrite
+		switch s.ProtobufMessage {
+		case "":
+			s.ProtobufMessage = pb.RemoteWriteProtoMsgV1
+		case pb.RemoteWriteProtoMsgV1, pb.RemoteWriteProtoMsgV2:
+		default:
+			return fmt.Errorf("invalid protobuf_message %q, must be one of %s/%s",
+				s.ProtobufMessage, pb.RemoteWriteProtoMsgV1, pb.RemoteWriteProtoMsgV2)
+		}
+	case pb.SinkTypeOTLP:
+		if len(s.URL) == 0 {
+			return errors.New("sink url can not be empty for otlp")
+		}
+	case pb.SinkTypeVictoriaMetrics:
+		if len(s.URL) == 0 {
+			return errors.New("sink url can not be empty for victoriametrics")
+		}
+	case pb.SinkTypeFile:
+		if len(s.Path) == 0 {
+			return errors.New("sink path can not be empty for file")
+		}
+		switch s.Format {
+		case "":
+			s.Format = pb.FileFormatOpenMetrics
+		case pb.FileFormatOpenMetrics, pb.FileFormatNDJSON:
+		default:
+			return fmt.Errorf("invalid file format %q, must be one of openmetrics/ndjson", s.Format)
+		}
+		if s.RotateSizeMB <= 0 {
+			s.RotateSizeMB = 256
+		}
+		if s.RotateInterval == 0 {
+			s.RotateInterval = model.Duration(time.Hour)
+		}
+	case pb.SinkTypeTSDBBlock:
+		if len(s.BlockDir) == 0 {
+			return errors.New("sink block_dir can not be empty")
+		}
+		if s.BlockDuration == 0 {
+			s.BlockDuration = model.Duration(2 * time.Hour)
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q", s.Type)
+	}
+
+	if len(s.Compression) > 0 && s.Compression != pb.CompressionGzip {
+		return fmt.Errorf("invalid compression %q, only gzip is supported", s.Compression)
+	}
+	return nil
+}
+
+// RemoteWrite 是一个写入目标, 每个写入目标有独立的队列和 wal, 通过 match 选择接收哪些降采样结果
+// 未配置 remote_write 时使用 sink / prometheus.remote_write_url 作为唯一的写入目标
+type RemoteWrite struct {
+	Name        string      `yaml:"name"`
+	Sink        Sink        `yaml:",inline"`
+	QueueConfig QueueConfig `yaml:"queue_config"`
+	Match       WriteMatch  `yaml:"match"`
+}
+
+// WriteMatch 字段为空表示不按该维度过滤
+type WriteMatch struct {
+	Jobs         []string `yaml:"jobs"`
+	Resolutions  []string `yaml:"resolutions"`
+	Aggregations []string `yaml:"aggregations"`
+}
+
+func (r *RemoteWrite) UnmarshalYAML(unmarshal func(any) error) error {
+	rc := &RemoteWrite{}
+	type plain RemoteWrite
+
+	if err := unmarshal((*plain)(rc)); err != nil {
+		return err
+	}
+
+	if len(rc.Name) == 0 {
+		return errors.New("remote_write name can not be empty")
+	}
+
+	if err := rc.Sink.validate(); err != nil {
+		return fmt.Errorf("remote_write %s: %w", rc.Name, err)
+	}
+	if rc.Sink.Type == pb.SinkTypeRemoteWrite && len(rc.Sink.URL) == 0 {
+		return fmt.Errorf("remote_write %s url can not be empty", rc.Name)
+	}
+
+	*r = *rc
+	return nil
+}
+
+// WAL 是 downsample 与 sink 之间的磁盘队列, 写入目标故障或进程重启时数据不会丢失
+type WAL struct {
+	// 为空时不开启 wal
+	Dir           string `yaml:"dir"`
+	SegmentSizeMB int    `yaml:"segment_size_mb"`
+	// 队列总大小上限, 超出后丢弃最旧的 segment; 0 表示不限制
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// 写入中的 segment 执行 fsync 的间隔
+	SyncInterval model.Duration `yaml:"sync_interval"`
+}
+
+func (w *WAL) UnmarshalYAML(unmarshal func(any) error) error {
+	wc := &WAL{}
+	type plain WAL
+
+	if err := unmarshal((*plain)(wc)); err != nil {
+		return err
+	}
+
+	if wc.SegmentSizeMB <= 0 {
+		wc.SegmentSizeMB = 64
+	}
+
+	if wc.SyncInterval <= 0 {
+		wc.SyncInterval = model.Duration(time.Second)
+	}
+
+	if wc.MaxSizeMB < 0 {
+		return errors.New("wal max_size_mb can not be negative")
+	}
+
+	*w = *wc
+	return nil
+}
+
+// Backpressure 是写入端跟不上时 downsample 结果的处理策略
+type Backpressure struct {
+	// block: 阻塞等待 timeout 后丢弃; drop: 立即丢弃; pause: 暂停读取一直等待
+	Policy  string         `yaml:"policy"`
+	Timeout model.Duration `yaml:"timeout"`
+}
+
+// DefaultBackpressure 未配置 backpressure 时使用
+var DefaultBackpressure = Backpressure{
+	Policy:  pb.BackpressureBlock,
+	Timeout: model.Duration(30 * time.Second),
+}
+
+func (b *Backpressure) UnmarshalYAML(unmarshal func(any) error) error {
+	bc := &Backpressure{}
+	type plain Backpressure
+
+	if err := unmarshal((*plain)(bc)); err != nil {
+		return err
+	}
+
+	switch bc.Policy {
+	case "", pb.BackpressureBlock:
+		bc.Policy = pb.BackpressureBlock
+		if bc.Timeout == 0 {
+			bc.Timeout = DefaultBackpressure.Timeout
+		}
+	case pb.BackpressureDrop, pb.BackpressurePause:
+	default:
+		return fmt.Errorf("invalid backpressure policy %q, must be one of block/drop/pause", bc.Policy)
+	}
+
+	*b = *bc
+	return nil
+}
+
+// Metadata 是原始指标元数据 (/api/v1/metadata) 的来源, 用于推导降采样指标的 TYPE/HELP/UNIT
+type Metadata struct {
+	// prometheus 查询地址, 为空时使用 prometheus.remote_read_group 第一个地址所在的 prometheus
+	URL             string         `yaml:"url"`
+	RefreshInterval model.Duration `yaml:"refresh_interval"`
+}
+
+// DefaultMetadataRefreshInterval 未配置 metadata.refresh_interval 时使用
+const DefaultMetadataRefreshInterval = model.Duration(10 * time.Minute)
+
+// Source 是额外的原始数据读取端, job 通过 source 指定名称使用
+// 未指定 source 的 job 默认使用 prometheus.remote_read_group
+type Source struct {
+	Name string `yaml:"name"`
+	// remote_read / query_range
+	Type string `yaml:"type"`
+	// remote_read 类型为 remote read 地址列表; query_range 类型为 prometheus http api 地址, 只能配置一个
+	URLs   []string `yaml:"urls"`
+	Stream string   `yaml:"stream"`
+}
+
+func (s *Source) UnmarshalYAML(unmarshal func(any) error) error {
+	sc := &Source{}
+	type plain Source
+
+	if err := unmarshal((*plain)(sc)); err != nil {
+		return err
+	}
+
+	if len(sc.Name) == 0 || sc.Name == pb.DefaultSourceName {
+		return fmt.Errorf("source name can not be empty or %q", pb.DefaultSourceName)
+	}
+
+	if len(sc.URLs) == 0 {
+		return fmt.Errorf("source %s urls can not be empty", sc.Name)
+	}
+
+	switch sc.Type {
+	case "", pb.SourceTypeRemoteRead:
+		sc.Type = pb.SourceTypeRemoteRead
+	case pb.SourceTypeQueryRange:
+		if len(sc.URLs) != 1 {
+			return fmt.Errorf("source %s of type query_range must have exactly one url", sc.Name)
+		}
+	default:
+		return fmt.Errorf("source %s has unknown type %q", sc.Name, sc.Type)
+	}
+
+	switch sc.Stream {
+	case "":
+		sc.Stream = pb.StreamModeAuto
+	case pb.StreamModeAuto, pb.StreamModeOn, pb.StreamModeOff:
+	default:
+		return fmt.Errorf("invalid stream mode %q, must be one of auto/on/off", sc.Stream)
+	}
+
+	*s = *sc
+	return nil
+}
+
 type DownSampleConfig struct {
 	JobName      string    `yaml:"job_name"`
+	Source       string    `yaml:"source"`
 	Matchers     []Matcher `yaml:"matchers"`
 	Aggregations []string  `yaml:"aggregations"`
+	// 是否将聚合下推到 source 的服务端执行, 不支持下推的聚合函数仍然读取原始数据
+	Pushdown bool `yaml:"pushdown"`
 }
 
 type Matcher struct {
@@ -165,6 +516,10 @@ func (d *DownSampleConfig) UnmarshalYAML(unmarshal func(any) error) error {
 		dsc.Aggregations = []string{"avg"}
 	}
 
+	if len(dsc.Source) == 0 {
+		dsc.Source = pb.DefaultSourceName
+	}
+
 	*d = *dsc
 	return nil
 }
@@ -172,4 +527,69 @@ func (d *DownSampleConfig) UnmarshalYAML(unmarshal func(any) error) error {
 type Prometheus struct {
 	RemoteReadGroup []string `yaml:"remote_read_group"`
 	RemoteWriteUrl  string   `yaml:"remote_write_url"`
+	// auto: 按地址探测是否支持流式传输; on: 强制流式; off: 强制 sample
+	Stream      string      `yaml:"stream"`
+	QueueConfig QueueConfig `yaml:"queue_config"`
+}
+
+// QueueConfig 是远程写队列的配置, 含义与 prometheus remote_write.queue_config 一致
+type QueueConfig struct {
+	// 每个 shard 队列中缓存的序列数
+	Capacity  int `yaml:"capacity"`
+	MinShards int `yaml:"min_shards"`
+	MaxShards int `yaml:"max_shards"`
+	// 单次写出的样本数和字节数 (未压缩) 上限, 任意一个达到上限即写出
+	MaxSamplesPerSend int `yaml:"max_samples_per_send"`
+	MaxBytesPerSend   int `yaml:"max_bytes_per_send"`
+	// shard 中的数据最长等待多久写出
+	BatchSendDeadline model.Duration `yaml:"batch_send_deadline"`
+	// 可恢复错误 (网络错误/5xx/429) 重试的初始退避时间, 每次重试翻倍直到 max_backoff
+	MinBackoff model.Duration `yaml:"min_backoff"`
+	MaxBackoff model.Duration `yaml:"max_backoff"`
+}
+
+func (q *QueueConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	qc := &QueueConfig{}
+	type plain QueueConfig
+
+	if err := unmarshal((*plain)(qc)); err != nil {
+		return err
+	}
+
+	if qc.Capacity < 0 || qc.MinShards < 0 || qc.MaxShards < 0 || qc.MaxSamplesPerSend < 0 || qc.MaxBytesPerSend < 0 {
+		return errors.New("queue_config values can not be negative")
+	}
+	if qc.MaxShards > 0 && qc.MaxShards < qc.MinShards {
+		return errors.New("queue_config max_shards can not be less than min_shards")
+	}
+
+	// 未配置的值保持为 0, 由 queue manager 使用默认值
+	if qc.MinBackoff < 0 || qc.MaxBackoff < 0 {
+		return errors.New("queue_config backoff can not be negative")
+	}
+	if qc.MaxBackoff > 0 && qc.MaxBackoff < qc.MinBackoff {
+		return errors.New("queue_config max_backoff can not be less than min_backoff")
+	}
+
+	*q = *qc
+	return nil
+}
+
+func (p *Prometheus) UnmarshalYAML(unmarshal func(any) error) error {
+	pc := &Prometheus{}
+	type plain Prometheus
+
+	if err := unmarshal((*plain)(pc)); err != nil {
+		return err
+	}
+
+	// 未配置时保持为空, 由 GlobalConfig 结合 enabled_stream 决定
+	switch pc.Stream {
+	case "", pb.StreamModeAuto, pb.StreamModeOn, pb.StreamModeOff:
+	default:
+		return fmt.Errorf("invalid stream mode %q, must be one of auto/on/off", pc.Stream)
+	}
+
+	*p = *pc
+	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"prom-stream-downsample/pkg/config"
@@ -19,9 +20,11 @@ import (
 type DownSampleMgr struct {
 	DownSamples []*DownSample
 
-	writeCh chan []prompb.TimeSeries
+	writeCh chan pb.WriteBatch
 	ctx     context.Context
 	quit    chan struct{}
+	// 所有 resolution 的降采样协程, Stop 等待它们退出后才可以关闭 writeCh
+	wg sync.WaitGroup
 }
 
 func configMatcher2pbMatcher(ms []config.Matcher) []pb.Matcher {
@@ -36,12 +39,17 @@ func configMatcher2pbMatcher(ms []config.Matcher) []pb.Matcher {
 	return matchers
 }
 
-func NewDownSampleMgr(ctx context.Context, ch chan []prompb.TimeSeries, p8s *prometheus.Prometheus, resolutions pb.Intervals) *DownSampleMgr {
+func NewDownSampleMgr(ctx context.Context, ch chan pb.WriteBatch, sources map[string]prometheus.Source, resolutions pb.Intervals) *DownSampleMgr {
 	// 声明一个channel,用于控制downsample的退出
 	quit := make(chan struct{})
 
 	mgr := &DownSampleMgr{ctx: ctx, writeCh: ch, quit: quit}
 	dss := config.Get().DownSampleConfig
+
+	backpressure := config.Get().GlobalConfig.Backpressure
+	if len(backpressure.Policy) == 0 {
+		backpressure = config.DefaultBackpressure
+	}
 	for _, ds := range dss {
 		var aggs []agg.Agg
 		for _, a := range ds.Aggregations {
@@ -68,15 +76,28 @@ func NewDownSampleMgr(ctx context.Context, ch chan []prompb.TimeSeries, p8s *pro
 			continue
 		}
 
+		source, ok := sources[ds.Source]
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"job":    ds.JobName,
+				"source": ds.Source,
+			}).Errorln("source not found, job will be ignored")
+			continue
+		}
+
 		mgr.DownSamples = append(mgr.DownSamples, &DownSample{
-			matchers:    configMatcher2pbMatcher(ds.Matchers),
-			Aggs:        aggs,
-			prometheus:  p8s,
-			writeCh:     ch,
-			resolutions: resolutions,
-			buffer:      pb.TimeSeriesPool.Get().([]prompb.TimeSeries),
-			quit:        quit,
-			metricReuse: config.Get().GlobalConfig.EnabledMetricReuse,
+			jobName:      ds.JobName,
+			matchers:     configMatcher2pbMatcher(ds.Matchers),
+			Aggs:         aggs,
+			source:       source,
+			writeCh:      ch,
+			resolutions:  resolutions,
+			buffer:       pb.TimeSeriesPool.Get().([]prompb.TimeSeries),
+			quit:         quit,
+			wg:           &mgr.wg,
+			metricReuse:  config.Get().GlobalConfig.EnabledMetricReuse,
+			pushdown:     ds.Pushdown,
+			backpressure: backpressure,
 		})
 	}
 
@@ -89,22 +110,58 @@ func (dsm *DownSampleMgr) Start() {
 	}
 }
 
+// Stop 通知所有降采样协程退出并等待, 返回后不会再有数据写入 writeCh, 调用方可以关闭 writeCh
+// 降采样协程在 ctx 结束后才会退出, 需要在 ctx 结束后调用
 func (dsm *DownSampleMgr) Stop() {
 	close(dsm.quit)
+	dsm.wg.Wait()
+}
+
+// RunOffline 对 [mint, maxt) 时间范围内的数据做一次性的离线降采样, 全部窗口处理完成后返回
+// 每个 resolution 的窗口按照 interval 对齐;
+// 离线模式下降采样结果不会写回 source, 所以不能使用指标重用, 每一级都从原始数据降采样
+func (dsm *DownSampleMgr) RunOffline(mint, maxt time.Time) {
+	for _, ds := range dsm.DownSamples {
+		ds.metricReuse = false
+		ds.offline = true
+
+		for idx, interval := range ds.resolutions {
+			il := time.Duration(interval.IntervalValue)
+			for end := mint.Truncate(il).Add(il); end.Add(-il).Before(maxt); end = end.Add(il) {
+				select {
+				case <-dsm.ctx.Done():
+					return
+				default:
+				}
+
+				ds.downsample(idx, end)
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"matchers":   ds.matchers,
+				"resolution": interval.IntervalName,
+			}).Warnln("offline downsample resolution done")
+		}
+	}
 }
 
 type DownSample struct {
+	jobName  string
 	matchers []pb.Matcher
 
-	prometheus *prometheus.Prometheus
-	writeCh    chan []prompb.TimeSeries
-	quit       chan struct{}
-	buffer     []prompb.TimeSeries
+	source  prometheus.Source
+	writeCh chan pb.WriteBatch
+	quit    chan struct{}
+	wg      *sync.WaitGroup
+	buffer  []prompb.TimeSeries
 
 	resolutions pb.Intervals
 	Aggs        []agg.Agg
 
-	metricReuse bool
+	metricReuse  bool
+	pushdown     bool
+	offline      bool
+	backpressure config.Backpressure
 }
 
 func (ds *DownSample) Start(ctx context.Context) {
@@ -112,20 +169,82 @@ func (ds *DownSample) Start(ctx context.Context) {
 	for intervalIdx := range ds.resolutions {
 		il := time.Duration(ds.resolutions[intervalIdx].IntervalValue)
 
-		go util.Wait(ctx, il, func(idx int) func() {
-			return func() { ds.downsample(idx) }
-		}(intervalIdx))
+		ds.wg.Add(1)
+		go func(idx int) {
+			defer ds.wg.Done()
+			util.Wait(ctx, il, func() { ds.downsample(idx, time.Now()) })
+		}(intervalIdx)
 	}
 }
 
+// submit 将 buffer 中的数据交给写入端, writeCh 已满时按照 backpressure 策略处理
 func (ds *DownSample) submit() {
+	if len(ds.buffer) == 0 {
+		return
+	}
+
+	series := float64(len(ds.buffer))
+	policy := ds.backpressure.Policy
+	if ds.offline {
+		// 离线模式下没有下一个周期可以补偿, 不能丢弃数据, 暂停读取等待写入
+		policy = pb.BackpressurePause
+	}
+
+	// 退出时不再写入, 写入端可能已经停止
 	select {
 	case <-ds.quit:
+		ds.drop("shutdown")
 		return
-	case ds.writeCh <- ds.buffer:
+	default:
+	}
+
+	select {
+	case ds.writeCh <- pb.WriteBatch{Job: ds.jobName, Series: ds.buffer}:
 		ds.buffer = pb.TimeSeriesPool.Get().([]prompb.TimeSeries)
+		submittedSeriesTotal.WithLabelValues(ds.jobName).Add(series)
+		return
 	default:
 	}
+
+	// writeCh 已满, 说明写入端跟不上
+	var timeout <-chan time.Time
+	switch policy {
+	case pb.BackpressureDrop:
+		ds.drop("full")
+		return
+	case pb.BackpressureBlock:
+		timer := time.NewTimer(time.Duration(ds.backpressure.Timeout))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	begin := time.Now()
+	defer func() {
+		blockedSecondsTotal.WithLabelValues(ds.jobName).Add(time.Since(begin).Seconds())
+	}()
+
+	select {
+	case <-ds.quit:
+		ds.drop("shutdown")
+	case <-timeout:
+		ds.drop("timeout")
+	case ds.writeCh <- pb.WriteBatch{Job: ds.jobName, Series: ds.buffer}:
+		ds.buffer = pb.TimeSeriesPool.Get().([]prompb.TimeSeries)
+		submittedSeriesTotal.WithLabelValues(ds.jobName).Add(series)
+	}
+}
+
+// drop 丢弃 buffer 中的数据并计数, 本周期的降采样结果不完整
+// reason: full/timeout 为写入端跟不上, shutdown 为退出时未写出
+func (ds *DownSample) drop(reason string) {
+	droppedSeriesTotal.WithLabelValues(ds.jobName, reason).Add(float64(len(ds.buffer)))
+	logrus.WithFields(logrus.Fields{
+		"job":    ds.jobName,
+		"series": len(ds.buffer),
+		"reason": reason,
+	}).Errorln("drop downsample series")
+
+	ds.buffer = ds.buffer[:0]
 }
 
 func (ds *DownSample) append(ts prompb.TimeSeries) {
@@ -135,7 +254,8 @@ func (ds *DownSample) append(ts prompb.TimeSeries) {
 	}
 }
 
-func (ds *DownSample) downsample(idx int) {
+// downsample 对以 end 结尾的一个 resolution 窗口做降采样
+func (ds *DownSample) downsample(idx int, end time.Time) {
 	// 具体的downsample逻辑
 	// 1. 根据downsample的配置，从prometheus中获取数据
 	select {
@@ -145,7 +265,7 @@ func (ds *DownSample) downsample(idx int) {
 	}
 
 	interval := ds.resolutions[idx]
-	//now := time.Now().UnixMilli()
+	start := end.Add(-time.Duration(interval.IntervalValue))
 	span := &pb.DurationSpan{}
 
 	/*
@@ -178,15 +298,27 @@ func (ds *DownSample) downsample(idx int) {
 			Value: ".+:downsample_.+",
 		})
 
-		it, err := ds.prometheus.RemoteRead(
+		aggs := ds.Aggs
+		if ds.pushdown {
+			// 能下推的聚合函数直接读取服务端的聚合结果, 剩余的聚合函数仍然需要读取原始数据在本地聚合
+			aggs = ds.pushdownAggregate(span, start, end, interval, matchers)
+			if len(aggs) == 0 {
+				ds.submit()
+				return
+			}
+		}
+
+		it, err := ds.source.Read(
 			span,
-			time.Duration(interval.IntervalValue),
+			start,
+			end,
 			matchers...,
 		)
 		if err != nil {
 			logrus.WithError(err).Error("remote read error")
 			return
 		}
+		defer it.Close()
 
 		for it.Next() {
 			select {
@@ -200,7 +332,7 @@ func (ds *DownSample) downsample(idx int) {
 			ts := calculateTime(d)
 			// 2. 根据downsample的 aggregations 配置，对数据进行聚合
 			//var series []prompb.TimeSeries
-			for _, aggF := range ds.Aggs {
+			for _, aggF := range aggs {
 				if aggF.Name() == "lttb" {
 					ds.append(prompb.TimeSeries{
 						Labels:  d.ToTimeSeriesPbLabel("", interval.IntervalName, aggF.Name()),
@@ -294,9 +426,10 @@ func (ds *DownSample) downsample(idx int) {
 
 			// append 将上述处理的 expandMatcher 添加到 matchers 中
 			matchers = append(matchers, expandMatcher)
-			it, err := ds.prometheus.RemoteRead(
+			it, err := ds.source.Read(
 				span,
-				time.Duration(interval.IntervalValue),
+				start,
+				end,
 				matchers...,
 			)
 			if err != nil {
@@ -323,6 +456,7 @@ func (ds *DownSample) downsample(idx int) {
 					})
 				}
 			}
+			it.Close()
 		}
 	}
 
@@ -330,6 +464,64 @@ func (ds *DownSample) downsample(idx int) {
 	ds.submit()
 }
 
+// pushdownAggregate 对 source 支持下推的聚合函数直接读取服务端聚合结果, 返回需要在本地聚合的函数
+// 下推失败时回退到读取原始数据
+func (ds *DownSample) pushdownAggregate(
+	span *pb.DurationSpan,
+	start time.Time,
+	end time.Time,
+	interval pb.Interval,
+	matchers []pb.Matcher,
+) []agg.Agg {
+	pd, ok := ds.source.(prometheus.Pushdown)
+	if !ok {
+		return ds.Aggs
+	}
+
+	var local []agg.Agg
+	for _, aggF := range ds.Aggs {
+		supported, final := pd.PushdownAgg(aggF.Name())
+		if !supported {
+			local = append(local, aggF)
+			continue
+		}
+
+		it, err := pd.ReadPushdown(span, start, end, aggF.Name(), matchers...)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"agg":   aggF.Name(),
+				"error": err,
+			}).Warnln("pushdown read failed, fallback to raw read")
+			local = append(local, aggF)
+			continue
+		}
+
+		for it.Next() {
+			d := it.At()
+			if len(d.Points) == 0 {
+				continue
+			}
+
+			// 服务端返回的时间为窗口结束时间, 没有原始点的分布, 使用窗口的中位
+			sample := prompb.Sample{
+				Value:     d.Points[len(d.Points)-1].Value,
+				Timestamp: windowTime(start, end),
+			}
+			if !final {
+				// 服务端未必遵守下推, 对返回的数据再做一次同样的聚合
+				sample.Value = aggF.Aggregate(d.Points).(float64)
+			}
+
+			ds.append(prompb.TimeSeries{
+				Labels:  d.ToTimeSeriesPbLabel("", interval.IntervalName, aggF.Name()),
+				Samples: []prompb.Sample{sample},
+			})
+		}
+		it.Close()
+	}
+	return local
+}
+
 func calculateTime(series pb.TimeSeries) int64 {
 	points := series.Points
 	middle := len(points) / 2
@@ -340,6 +532,11 @@ func calculateTime(series pb.TimeSeries) int64 {
 	return points[middle].Timestamp
 }
 
+// windowTime 返回下推聚合的降采样点的时间: 窗口的中位, 下推时服务端不返回原始点, 无法使用原始点的中位
+func windowTime(start, end time.Time) int64 {
+	return start.UnixMilli() + end.Sub(start).Milliseconds()/2
+}
+
 func (ds *DownSample) appendDot(
 	sampleCnt float64,
 	timestamp int64,
@@ -358,7 +555,7 @@ func (ds *DownSample) appendDot(
 	ds.append(prompb.TimeSeries{
 		Labels: []prompb.Label{
 			{Name: pb.MetricLabelName, Value: "psd_remote_read_matcher_samples_count"},
-			{Name: "remote_type", Value: ds.prometheus.RemoteReadType()},
+			{Name: "remote_type", Value: ds.source.Type()},
 			{Name: "matcher", Value: m},
 		},
 		Samples: []prompb.Sample{{
@@ -369,7 +566,7 @@ func (ds *DownSample) appendDot(
 	ds.append(prompb.TimeSeries{
 		Labels: []prompb.Label{
 			{Name: pb.MetricLabelName, Value: "psd_remote_read_query_time_seconds"},
-			{Name: "remote_type", Value: ds.prometheus.RemoteReadType()},
+			{Name: "remote_type", Value: ds.source.Type()},
 			{Name: "matcher", Value: m},
 			{Name: "query_range", Value: intervalName},
 		},
@@ -0,0 +1,79 @@
+package downsample
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	"prom-stream-downsample/pkg/config"
+	"prom-stream-downsample/pkg/pb"
+)
+
+func TestSubmitBackpressure(t *testing.T) {
+	for _, tc := range []struct {
+		policy  string
+		timeout time.Duration
+		// writeCh 满时是否丢弃
+		drop bool
+	}{
+		{policy: pb.BackpressureDrop, drop: true},
+		{policy: pb.BackpressureBlock, timeout: 10 * time.Millisecond, drop: true},
+		{policy: pb.BackpressurePause},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			ch := make(chan pb.WriteBatch, 1)
+			ch <- pb.WriteBatch{}
+
+			ds := &DownSample{
+				jobName: tc.policy,
+				writeCh: ch,
+				quit:    make(chan struct{}),
+				buffer:  []prompb.TimeSeries{{}},
+				backpressure: config.Backpressure{
+					Policy:  tc.policy,
+					Timeout: model.Duration(tc.timeout),
+				},
+			}
+
+			if !tc.drop {
+				// 写入端恢复后 pause 的数据应该被写入
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					<-ch
+				}()
+			}
+			ds.submit()
+
+			if len(ds.buffer) != 0 {
+				t.Fatalf("buffer not reset, got %d series", len(ds.buffer))
+			}
+			// 丢弃时 writeCh 中仍然是最初占位的空 batch
+			submitted := (<-ch).Series != nil
+			if submitted == tc.drop {
+				t.Fatalf("submitted = %v, want %v", submitted, !tc.drop)
+			}
+		})
+	}
+}
+
+func TestSubmitAfterQuit(t *testing.T) {
+	// 退出后 writeCh 可能已经关闭, submit 不能再写入
+	ch := make(chan pb.WriteBatch, 1)
+	close(ch)
+	quit := make(chan struct{})
+	close(quit)
+
+	ds := &DownSample{
+		jobName:      "quit",
+		writeCh:      ch,
+		quit:         quit,
+		buffer:       []prompb.TimeSeries{{}},
+		backpressure: config.Backpressure{Policy: pb.BackpressurePause},
+	}
+	ds.submit()
+	if len(ds.buffer) != 0 {
+		t.Fatalf("buffer not reset, got %d series", len(ds.buffer))
+	}
+}
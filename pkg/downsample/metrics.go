@@ -0,0 +1,29 @@
+package downsample
+
+import (
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// 提交降采样结果相关的自监控指标, 出现 dropped 说明对应 job 的降采样结果不完整
+var (
+	submittedSeriesTotal = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "psd_downsample_submitted_series_total",
+		Help: "The total number of downsampled series submitted to the write path",
+	}, []string{"job"})
+	droppedSeriesTotal = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "psd_downsample_dropped_series_total",
+		Help: "The total number of downsampled series dropped because the write path was full",
+	}, []string{"job", "reason"})
+	blockedSecondsTotal = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "psd_downsample_submit_blocked_seconds_total",
+		Help: "The total time spent waiting for the write path to accept downsampled series",
+	}, []string{"job"})
+)
+
+func init() {
+	promclient.MustRegister(
+		submittedSeriesTotal,
+		droppedSeriesTotal,
+		blockedSecondsTotal,
+	)
+}
@@ -21,6 +21,47 @@ const (
 	LabelMatcher_NEQ = "!="
 	LabelMatcher_RE  = "=~"
 	LabelMatcher_NRE = "!~"
+
+	StreamModeAuto = "auto" // 按地址探测是否支持流式传输
+	StreamModeOn   = "on"   // 强制流式传输
+	StreamModeOff  = "off"  // 强制 sample 传输
+
+	RemoteReadTypeMixed = "mixed"
+
+	DefaultSourceName    = "default"
+	SourceTypeRemoteRead = "remote_read"
+	SourceTypeQueryRange = "query_range"
+	SourceTypeTSDB       = "tsdb"
+
+	DefaultTargetName       = "default"
+	SinkTypeRemoteWrite     = "remote_write"
+	SinkTypeTSDBBlock       = "tsdb_block"
+	SinkTypeOTLP            = "otlp"
+	SinkTypeFile            = "file"
+	SinkTypeVictoriaMetrics = "victoriametrics"
+
+	FileFormatOpenMetrics = "openmetrics"
+	FileFormatNDJSON      = "ndjson"
+
+	CompressionGzip = "gzip"
+
+	RemoteWriteProtoMsgV1 = "prometheus.WriteRequest"        // remote write 1.0
+	RemoteWriteProtoMsgV2 = "io.prometheus.write.v2.Request" // remote write 2.0
+
+	BackpressureBlock = "block" // 阻塞等待, 超时后丢弃
+	BackpressureDrop  = "drop"  // 立即丢弃
+	BackpressurePause = "pause" // 暂停读取, 一直等待直到写入
+
+	// proxy 中控制单个查询降采样方式的请求头/参数, 以及选择器中的伪 label matcher, 转发前去除
+	DownsampleHeader    = "X-Downsample"
+	DownsampleOff       = "off"
+	ResolutionLabelName = "__resolution__"
+	AggLabelName        = "__agg__"
+	ResolutionRaw       = "raw" // __resolution__="raw" 表示该选择器查询原始数据
+
+	// proxy 还原响应中的降采样指标名时添加的 label
+	ResolutionLabel = "resolution"
+	AggLabel        = "agg"
 )
 
 var (
@@ -64,7 +105,37 @@ type Intervals []Interval
 type MetricProxy struct {
 	Metric   string
 	MetricRe *regexp.Regexp
-	Agg      string
+	// 没有对应函数的选择器使用的降采样聚合
+	Agg string
+	// 额外可用的降采样聚合, 用于按查询函数选择
+	Aggs []string
+}
+
+// Has 判断该指标是否存在 agg 的降采样结果
+func (m MetricProxy) Has(agg string) bool {
+	if len(agg) > 0 && agg == m.Agg {
+		return true
+	}
+	for _, a := range m.Aggs {
+		if a == agg {
+			return true
+		}
+	}
+	return false
+}
+
+// AllAggs 返回该指标所有可用的降采样聚合, 默认聚合在前
+func (m MetricProxy) AllAggs() []string {
+	aggs := make([]string, 0, len(m.Aggs)+1)
+	if len(m.Agg) > 0 {
+		aggs = append(aggs, m.Agg)
+	}
+	for _, a := range m.Aggs {
+		if a != m.Agg {
+			aggs = append(aggs, a)
+		}
+	}
+	return aggs
 }
 
 type MetricProxySet map[*regexp.Regexp]MetricProxy
@@ -82,6 +153,27 @@ func (m MetricProxySet) Contains(s string) (MetricProxy, string, bool) {
 	return MetricProxy{}, s, false
 }
 
+// WriteBatch 是一次提交的降采样结果, Job 用于写出时按 job 路由到不同的写入目标
+type WriteBatch struct {
+	Job    string
+	Series []prompb.TimeSeries
+}
+
+// ParseDownSampleMetric 从降采样指标名中解析原始指标名、resolution 和聚合函数
+// 比如 up:downsample_5m_avg -> up, 5m, avg
+func ParseDownSampleMetric(name string) (metric, interval, agg string, ok bool) {
+	idx := strings.LastIndex(name, ":downsample_")
+	if idx < 0 {
+		return "", "", "", false
+	}
+
+	interval, agg, ok = strings.Cut(name[idx+len(":downsample_"):], "_")
+	if !ok || len(interval) == 0 || len(agg) == 0 {
+		return "", "", "", false
+	}
+	return name[:idx], interval, agg, true
+}
+
 type DurationSpan struct {
 	QueryDuration float64
 }
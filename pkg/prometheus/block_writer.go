@@ -0,0 +1,235 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// BlockWriterSink 将 downsample 结果按 block 时间范围聚合, 写成不可变的 TSDB block
+// 生成的 block 可以直接放入 prometheus 数据目录, 或上传到对象存储
+// 不同 resolution 的数据产生的进度不同 (粗 resolution 的窗口更长), 每个配置的 resolution 分别记录最新数据的时间,
+// 所有 resolution 都已经超过 block 结束时间后才落盘, 避免同一时间范围产生多个重叠的 block;
+// 某个 resolution 没有数据 (job 被删除、稀疏指标) 时, 超过 idleTimeout 没有写入的 block 同样落盘, 避免内存无限增长
+type BlockWriterSink struct {
+	dir           string
+	blockDuration int64
+	idleTimeout   time.Duration
+
+	lock    sync.Mutex
+	writers map[int64]*tsdb.BlockWriter // key 为 block 的起始时间
+	updated map[int64]time.Time         // block 最近一次写入的时间
+	maxt    map[string]int64            // key 为 resolution
+	// 早于 flushed 的 block 可能已经落盘, 之后到达的样本写入新的 block, 可能与已经落盘的 block 重叠
+	flushed int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewBlockWriterSink tiers 为配置的所有 resolution, idleTimeout 为 0 时使用 blockDuration
+func NewBlockWriterSink(dir string, blockDuration time.Duration, tiers []string, idleTimeout time.Duration) (*BlockWriterSink, error) {
+	if blockDuration <= 0 {
+		blockDuration = time.Duration(tsdb.DefaultBlockDuration) * time.Millisecond
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = blockDuration
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	b := &BlockWriterSink{
+		dir:           dir,
+		blockDuration: blockDuration.Milliseconds(),
+		idleTimeout:   idleTimeout,
+		writers:       make(map[int64]*tsdb.BlockWriter),
+		updated:       make(map[int64]time.Time),
+		maxt:          make(map[string]int64, len(tiers)),
+		flushed:       math.MinInt64,
+		done:          make(chan struct{}),
+	}
+	// 还没有数据的 resolution 视为进度为最小值, 不会提前落盘
+	for _, tier := range tiers {
+		b.maxt[tier] = math.MinInt64
+	}
+
+	b.wg.Add(1)
+	go b.idleLoop()
+	return b, nil
+}
+
+// idleLoop 定期落盘空闲的 block, 没有新数据写入时 Send 不会被调用
+func (b *BlockWriterSink) idleLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(min(b.idleTimeout, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case now := <-ticker.C:
+			b.lock.Lock()
+			err := b.flush(b.ready(now))
+			b.lock.Unlock()
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"dir":   b.dir,
+					"error": err,
+				}).Errorln("block writer flush idle blocks failed")
+			}
+		}
+	}
+}
+
+// ready 返回可以落盘的 block: 所有 resolution 的最新数据都已经超过 block 结束时间一个 block 周期, 或者超过 idleTimeout 没有写入
+func (b *BlockWriterSink) ready(now time.Time) func(start int64) bool {
+	maxt := int64(math.MaxInt64)
+	for _, t := range b.maxt {
+		if t < maxt {
+			maxt = t
+		}
+	}
+	return func(start int64) bool {
+		return start+2*b.blockDuration <= maxt || now.Sub(b.updated[start]) >= b.idleTimeout
+	}
+}
+
+func (b *BlockWriterSink) Name() string {
+	return "tsdb_block"
+}
+
+func (b *BlockWriterSink) Send(batch []prompb.TimeSeries) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var (
+		appenders = make(map[int64]storage.Appender)
+		now       = time.Now()
+		failed    int
+		late      int
+	)
+	for _, ts := range batch {
+		lbs := make([]string, 0, len(ts.Labels)*2)
+		for _, l := range ts.Labels {
+			lbs = append(lbs, l.Name, l.Value)
+		}
+		lset := labels.FromStrings(lbs...)
+		_, tier, _, _ := pb.ParseDownSampleMetric(lset.Get(pb.MetricLabelName))
+
+		for _, s := range ts.Samples {
+			start := s.Timestamp - s.Timestamp%b.blockDuration
+			app, ok := appenders[start]
+			if !ok {
+				if _, open := b.writers[start]; !open && start < b.flushed {
+					late++
+				}
+				w, err := b.writer(start)
+				if err != nil {
+					return err
+				}
+				app = w.Appender(context.Background())
+				appenders[start] = app
+				b.updated[start] = now
+			}
+
+			if _, err := app.Append(0, lset, s.Timestamp, s.Value); err != nil {
+				failed++
+				continue
+			}
+
+			if maxt, ok := b.maxt[tier]; !ok || s.Timestamp > maxt {
+				b.maxt[tier] = s.Timestamp
+			}
+		}
+	}
+
+	for _, app := range appenders {
+		if err := app.Commit(); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		logrus.WithField("samples", failed).Warnln("block writer append samples failed, out of order or duplicate")
+	}
+	if late > 0 {
+		logrus.WithFields(logrus.Fields{
+			"blocks":  late,
+			"flushed": time.UnixMilli(b.flushed),
+		}).Warnln("block writer reopen blocks older than flushed blocks, new blocks may overlap")
+	}
+
+	// 不会再有数据写入的 block 落盘并释放内存
+	return b.flush(b.ready(now))
+}
+
+func (b *BlockWriterSink) Close() error {
+	close(b.done)
+	b.wg.Wait()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.flush(func(int64) bool { return true })
+}
+
+func (b *BlockWriterSink) writer(start int64) (*tsdb.BlockWriter, error) {
+	if w, ok := b.writers[start]; ok {
+		return w, nil
+	}
+
+	w, err := tsdb.NewBlockWriter(log.NewNopLogger(), b.dir, b.blockDuration)
+	if err != nil {
+		return nil, err
+	}
+	b.writers[start] = w
+	return w, nil
+}
+
+func (b *BlockWriterSink) flush(need func(start int64) bool) error {
+	var starts []int64
+	for start := range b.writers {
+		if need(start) {
+			starts = append(starts, start)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	for _, start := range starts {
+		w := b.writers[start]
+		delete(b.writers, start)
+		delete(b.updated, start)
+		if end := start + b.blockDuration; end > b.flushed {
+			b.flushed = end
+		}
+
+		id, err := w.Flush(context.Background())
+		w.Close()
+		if err != nil {
+			return fmt.Errorf("flush block start at %d: %w", start, err)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"dir":   b.dir,
+			"block": id.String(),
+			"start": time.UnixMilli(start),
+		}).Warnln("block writer flush block success")
+	}
+	return nil
+}
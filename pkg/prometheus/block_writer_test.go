@@ -0,0 +1,148 @@
+package prometheus
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+func TestBlockWriterSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewBlockWriterSink(dir, time.Hour, []string{"5m"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lbs := []prompb.Label{
+		{Name: pb.MetricLabelName, Value: "up:downsample_5m_avg"},
+		{Name: "job", Value: "prometheus"},
+	}
+	// 样本跨越 3 个 1h 的 block
+	for _, ts := range []int64{0, 30 * 60 * 1000, 90 * 60 * 1000, 150 * 60 * 1000} {
+		if err := sink.Send([]prompb.TimeSeries{{
+			Labels:  lbs,
+			Samples: []prompb.Sample{{Timestamp: ts, Value: float64(ts)}},
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 第一个 block 已经不会再有数据写入, 应该在 Close 前落盘
+	if len(sink.writers) != 2 {
+		t.Fatalf("got %d open blocks, want 2", len(sink.writers))
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewTSDBSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if len(source.blocks) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(source.blocks))
+	}
+
+	mint, maxt := source.TimeRange()
+	it, err := source.Read(&pb.DurationSpan{}, mint, maxt, pb.Matcher{
+		Name:  pb.MetricLabelName,
+		Type:  pb.LabelMatcher_EQ,
+		Value: "up:downsample_5m_avg",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() {
+		t.Fatal("expected one series")
+	}
+	if points := it.At().Points; len(points) != 4 {
+		t.Fatalf("unexpected points %v", points)
+	}
+}
+
+func TestBlockWriterSinkTiers(t *testing.T) {
+	sink, err := NewBlockWriterSink(t.TempDir(), time.Hour, []string{"5m", "1h"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	series := func(name string, ts int64) []prompb.TimeSeries {
+		return []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: pb.MetricLabelName, Value: name}},
+			Samples: []prompb.Sample{{Timestamp: ts, Value: 1}},
+		}}
+	}
+	const hour = int64(time.Hour / time.Millisecond)
+
+	// 1h resolution 的数据落后于 5m resolution, 第一个 block 不能落盘
+	for _, batch := range [][]prompb.TimeSeries{
+		series("up:downsample_1h_avg", 0),
+		series("up:downsample_5m_avg", 0),
+		series("up:downsample_5m_avg", 3*hour),
+	} {
+		if err := sink.Send(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := sink.writers[0]; !ok {
+		t.Fatal("block flushed before every resolution passed its end")
+	}
+
+	if err := sink.Send(series("up:downsample_1h_avg", 2*hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sink.writers[0]; ok {
+		t.Fatal("expected first block flushed")
+	}
+
+	// 已经落盘的时间范围内的样本写入新的 block, 不会丢弃
+	before, err := os.ReadDir(sink.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(series("up:downsample_1h_avg", hour/2)); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadDir(sink.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 {
+		t.Fatalf("got %d blocks after late sample, want %d", len(after), len(before)+1)
+	}
+}
+
+func TestBlockWriterSinkIdle(t *testing.T) {
+	sink, err := NewBlockWriterSink(t.TempDir(), time.Hour, []string{"5m", "1d"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// 配置的 1d resolution 一直没有数据, block 不会因为 5m 的进度落盘
+	if err := sink.Send([]prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: pb.MetricLabelName, Value: "up:downsample_5m_avg"}},
+		Samples: []prompb.Sample{{Timestamp: 0, Value: 1}, {Timestamp: 3 * int64(time.Hour/time.Millisecond), Value: 1}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if len(sink.writers) != 2 {
+		t.Fatalf("got %d open blocks, want 2", len(sink.writers))
+	}
+
+	// 超过 idle timeout 没有写入的 block 落盘
+	if err := sink.flush(sink.ready(time.Now().Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.writers) != 0 {
+		t.Fatalf("got %d open blocks after idle timeout, want 0", len(sink.writers))
+	}
+}
@@ -0,0 +1,363 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+	"prom-stream-downsample/pkg/util"
+)
+
+const (
+	sampledContentType  = "application/x-protobuf"
+	streamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+	// 低于该版本的 prometheus 不支持 STREAMED_XOR_CHUNKS
+	minStreamVersion = "2.13.0"
+
+	probeMetricName = "psd_remote_read_probe"
+)
+
+// readEndpoint 表示一个 remote read 地址, 每个地址单独协商响应类型
+// 这样 thanos/victoriametrics/mimir 等后端与原生 prometheus 可以混用
+type readEndpoint struct {
+	url          string
+	responseType prompb.ReadRequest_ResponseType
+
+	client *http.Client
+}
+
+func newReadEndpoint(rawURL string, mode string) (*readEndpoint, error) {
+	if _, err := url.Parse(rawURL); err != nil {
+		return nil, err
+	}
+
+	ep := &readEndpoint{
+		url:          rawURL,
+		responseType: prompb.ReadRequest_SAMPLES,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+
+	switch mode {
+	case pb.StreamModeOn:
+		ep.responseType = prompb.ReadRequest_STREAMED_XOR_CHUNKS
+	case pb.StreamModeOff:
+	default:
+		// auto 模式下实际发起一次流式读探测, 不支持则回退到 sample
+		ep.responseType = ep.negotiate()
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"url":  ep.url,
+		"mode": mode,
+		"type": ep.remoteReadType(),
+	}).Warnln("remote read endpoint negotiated")
+	return ep, nil
+}
+
+func (e *readEndpoint) streamed() bool {
+	return e.responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS
+}
+
+func (e *readEndpoint) remoteReadType() string {
+	return pb.RemoteReadType[e.streamed()]
+}
+
+func (e *readEndpoint) negotiate() prompb.ReadRequest_ResponseType {
+	// buildinfo 只是辅助判断, 非 prometheus 后端可能没有该接口, 失败时不能影响启动
+	if u, err := url.Parse(e.url); err == nil {
+		info, err := NewPrometheusMetaInfo(u.Scheme + "://" + u.Host + "/")
+		if err == nil && util.ValidVersion(info.Version) && util.CompareVersion(info.Version, minStreamVersion) < 0 {
+			return prompb.ReadRequest_SAMPLES
+		}
+	}
+
+	streamed, err := e.probe()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"url":   e.url,
+			"error": err,
+		}).Warnln("remote read stream probe failed, fallback to sample")
+		return prompb.ReadRequest_SAMPLES
+	}
+
+	if streamed {
+		return prompb.ReadRequest_STREAMED_XOR_CHUNKS
+	}
+	return prompb.ReadRequest_SAMPLES
+}
+
+// probe 发起一次只接受流式响应的 remote read, 根据响应的 Content-Type 判断是否支持流式传输
+// 不支持流式的后端会忽略 AcceptedResponseTypes 直接返回 sample 响应
+func (e *readEndpoint) probe() (bool, error) {
+	end := time.Now()
+	query := &prompb.Query{
+		StartTimestampMs: end.Add(-time.Minute).UnixMilli(),
+		EndTimestampMs:   end.UnixMilli(),
+		Matchers: []*prompb.LabelMatcher{{
+			Type:  prompb.LabelMatcher_EQ,
+			Name:  pb.MetricLabelName,
+			Value: probeMetricName,
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	resp, err := e.do(ctx, query, []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS})
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), streamedContentType), nil
+}
+
+func (e *readEndpoint) do(
+	ctx context.Context,
+	query *prompb.Query,
+	accepted []prompb.ReadRequest_ResponseType,
+) (*http.Response, error) {
+	req := &prompb.ReadRequest{
+		Queries:               []*prompb.Query{query},
+		AcceptedResponseTypes: accepted,
+	}
+
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("User-Agent", "prom-stream-downsample")
+	httpReq.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("remote read %s status %d: %s", e.url, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// read 按协商结果发起 remote read, 统一返回按 labels 排序的 ChunkSeriesSet 以便多个地址的结果合并
+// streamed 响应按需读取, 在读取完成或出错时关闭响应; 提前放弃读取时由 ctx 结束释放连接
+func (e *readEndpoint) read(ctx context.Context, query *prompb.Query) (storage.ChunkSeriesSet, error) {
+	accepted := []prompb.ReadRequest_ResponseType{prompb.ReadRequest_SAMPLES}
+	if e.streamed() {
+		accepted = []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS, prompb.ReadRequest_SAMPLES}
+	}
+
+	resp, err := e.do(ctx, query, accepted)
+	if err != nil {
+		return nil, err
+	}
+
+	// 以实际响应的 Content-Type 为准, 协商后后端仍然可能返回 sample 响应
+	contentType := resp.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, streamedContentType) {
+		return newStreamedChunkSeriesSet(resp.Body), nil
+	}
+
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if strings.HasPrefix(contentType, sampledContentType) {
+		return readSampledResponse(resp.Body)
+	}
+	return nil, fmt.Errorf("unknown response type: %s", contentType)
+}
+
+func readSampledResponse(body io.Reader) (storage.ChunkSeriesSet, error) {
+	compressed, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	decomp, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	var data prompb.ReadResponse
+	if err = proto.Unmarshal(decomp, &data); err != nil {
+		return nil, err
+	}
+
+	if len(data.Results) == 0 {
+		return storage.EmptyChunkSeriesSet(), nil
+	}
+	return storage.NewSeriesSetToChunkSet(remote.FromQueryResult(true, data.Results[0])), nil
+}
+
+// streamedChunkSeriesSet 从 streamed 响应中按需读取 frame, 不在内存中缓存整个响应
+// prometheus 按 labels 排序返回每个 query 的序列, 同一条序列的 chunks 可能被拆分到相邻的多个 frame 中
+type streamedChunkSeriesSet struct {
+	body   io.ReadCloser
+	stream *remote.ChunkedReader
+
+	// 当前 frame 中还没有读取的序列
+	frame []prompb.ChunkedSeries
+	// 已经读取但属于下一条序列的 chunks
+	pending *prompb.ChunkedSeries
+
+	cur    storage.ChunkSeries
+	err    error
+	closed bool
+}
+
+func newStreamedChunkSeriesSet(body io.ReadCloser) *streamedChunkSeriesSet {
+	return &streamedChunkSeriesSet{
+		body:   body,
+		stream: remote.NewChunkedReader(body, remote.DefaultChunkedReadLimit, make([]byte, initialBufSize)),
+	}
+}
+
+func (s *streamedChunkSeriesSet) Next() bool {
+	if s.closed {
+		return false
+	}
+
+	first := s.pending
+	s.pending = nil
+	if first == nil {
+		first = s.nextChunkedSeries()
+		if first == nil {
+			s.Close()
+			return false
+		}
+	}
+
+	lbs := labelProtosToLabels(first.GetLabels())
+	var metas []chunks.Meta
+	if metas = s.appendChunks(metas, first); s.err != nil {
+		s.Close()
+		return false
+	}
+	for {
+		cs := s.nextChunkedSeries()
+		if cs == nil {
+			if s.err != nil {
+				s.Close()
+				return false
+			}
+			break
+		}
+		if labels.Compare(lbs, labelProtosToLabels(cs.GetLabels())) != 0 {
+			s.pending = cs
+			break
+		}
+		if metas = s.appendChunks(metas, cs); s.err != nil {
+			s.Close()
+			return false
+		}
+	}
+
+	s.cur = &storage.ChunkSeriesEntry{
+		Lset: lbs,
+		ChunkIteratorFn: func(chunks.Iterator) chunks.Iterator {
+			return storage.NewListChunkSeriesIterator(metas...)
+		},
+	}
+	return true
+}
+
+// nextChunkedSeries 返回下一个序列片段, 响应读取完成或出错时返回 nil
+func (s *streamedChunkSeriesSet) nextChunkedSeries() *prompb.ChunkedSeries {
+	for len(s.frame) == 0 {
+		frame := &prompb.ChunkedReadResponse{}
+		if err := s.stream.NextProto(frame); err != nil {
+			if err != io.EOF {
+				s.err = err
+			}
+			return nil
+		}
+		for _, cs := range frame.GetChunkedSeries() {
+			s.frame = append(s.frame, *cs)
+		}
+	}
+
+	cs := &s.frame[0]
+	s.frame = s.frame[1:]
+	return cs
+}
+
+func (s *streamedChunkSeriesSet) appendChunks(metas []chunks.Meta, cs *prompb.ChunkedSeries) []chunks.Meta {
+	for _, chk := range cs.GetChunks() {
+		if chk.Type != prompb.Chunk_XOR {
+			continue
+		}
+		c, err := chunkenc.FromData(chunkenc.EncXOR, chk.Data)
+		if err != nil {
+			s.err = err
+			return metas
+		}
+		metas = append(metas, chunks.Meta{
+			Chunk:   c,
+			MinTime: chk.MinTimeMs,
+			MaxTime: chk.MaxTimeMs,
+		})
+	}
+	return metas
+}
+
+func (s *streamedChunkSeriesSet) At() storage.ChunkSeries {
+	return s.cur
+}
+
+func (s *streamedChunkSeriesSet) Err() error {
+	return s.err
+}
+
+func (s *streamedChunkSeriesSet) Warnings() storage.Warnings {
+	return nil
+}
+
+// Close 丢弃剩余的响应并关闭, 可以重复调用
+func (s *streamedChunkSeriesSet) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.frame, s.pending = nil, nil
+	return s.body.Close()
+}
+
+func labelProtosToLabels(lbs []prompb.Label) labels.Labels {
+	b := labels.NewScratchBuilder(len(lbs))
+	for _, l := range lbs {
+		b.Add(l.Name, l.Value)
+	}
+	b.Sort()
+	return b.Labels()
+}
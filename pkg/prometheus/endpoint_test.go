@@ -0,0 +1,195 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+func newSampledServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/read" {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := proto.Marshal(&prompb.ReadResponse{Results: []*prompb.QueryResult{{
+			Timeseries: []*prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: pb.MetricLabelName, Value: "up"}},
+				Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}},
+			}},
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(snappy.Encode(nil, data))
+	}))
+}
+
+func newStreamedServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/read" {
+			http.NotFound(w, r)
+			return
+		}
+
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.Append(2000, 3)
+		app.Append(3000, 4)
+
+		w.Header().Set("Content-Type", streamedContentType)
+		cw := remote.NewChunkedWriter(w, w.(http.Flusher))
+		data, err := proto.Marshal(&prompb.ChunkedReadResponse{ChunkedSeries: []*prompb.ChunkedSeries{{
+			Labels: []prompb.Label{{Name: pb.MetricLabelName, Value: "up"}},
+			Chunks: []prompb.Chunk{{MinTimeMs: 2000, MaxTimeMs: 3000, Type: prompb.Chunk_XOR, Data: chk.Bytes()}},
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw.Write(data)
+	}))
+}
+
+func TestReadEndpointNegotiate(t *testing.T) {
+	sampled := newSampledServer(t)
+	defer sampled.Close()
+	streamed := newStreamedServer(t)
+	defer streamed.Close()
+
+	cases := []struct {
+		url  string
+		mode string
+		want string
+	}{
+		{sampled.URL + "/api/v1/read", pb.StreamModeAuto, "sample"},
+		{streamed.URL + "/api/v1/read", pb.StreamModeAuto, "stream"},
+		{streamed.URL + "/api/v1/read", pb.StreamModeOff, "sample"},
+		{sampled.URL + "/api/v1/read", pb.StreamModeOn, "stream"},
+		{"http://127.0.0.1:1/api/v1/read", pb.StreamModeAuto, "sample"},
+	}
+
+	for _, c := range cases {
+		ep, err := newReadEndpoint(c.url, c.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ep.remoteReadType(); got != c.want {
+			t.Errorf("%s mode %s: got %s, want %s", c.url, c.mode, got, c.want)
+		}
+	}
+}
+
+func TestMixedEndpointsRead(t *testing.T) {
+	sampled := newSampledServer(t)
+	defer sampled.Close()
+	streamed := newStreamedServer(t)
+	defer streamed.Close()
+
+	p, err := NewPrometheus(
+		[]string{sampled.URL + "/api/v1/read", streamed.URL + "/api/v1/read"},
+		pb.StreamModeAuto,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RemoteReadType() != pb.RemoteReadTypeMixed {
+		t.Fatalf("got remote read type %s", p.RemoteReadType())
+	}
+
+	it, err := p.Read(&pb.DurationSpan{}, time.UnixMilli(0), time.UnixMilli(3000), pb.Matcher{
+		Name:  pb.MetricLabelName,
+		Type:  pb.LabelMatcher_EQ,
+		Value: "up",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var series []pb.TimeSeries
+	for it.Next() {
+		series = append(series, it.At())
+	}
+	if len(series) != 1 {
+		t.Fatalf("got %d series, want 1", len(series))
+	}
+
+	// 两个地址的重叠点需要去重
+	want := []int64{1000, 2000, 3000}
+	if len(series[0].Points) != len(want) {
+		t.Fatalf("got points %v, want %v", series[0].Points, want)
+	}
+	for i := range want {
+		if series[0].Points[i].Timestamp != want[i] {
+			t.Fatalf("got points %v, want %v", series[0].Points, want)
+		}
+	}
+}
+
+func TestStreamedChunkSeriesSet(t *testing.T) {
+	xorChunk := func(ts int64) prompb.Chunk {
+		chk := chunkenc.NewXORChunk()
+		app, _ := chk.Appender()
+		app.Append(ts, float64(ts))
+		return prompb.Chunk{MinTimeMs: ts, MaxTimeMs: ts, Type: prompb.Chunk_XOR, Data: chk.Bytes()}
+	}
+	series := func(name string, ts int64) *prompb.ChunkedSeries {
+		return &prompb.ChunkedSeries{
+			Labels: []prompb.Label{{Name: pb.MetricLabelName, Value: name}},
+			Chunks: []prompb.Chunk{xorChunk(ts)},
+		}
+	}
+
+	// a 的 chunks 被拆分到两个 frame 中
+	var buf bytes.Buffer
+	cw := remote.NewChunkedWriter(&buf, nopFlusher{})
+	for _, frame := range [][]*prompb.ChunkedSeries{
+		{series("a", 1000)},
+		{series("a", 2000), series("b", 1000)},
+		{series("c", 1000)},
+	} {
+		data, err := proto.Marshal(&prompb.ChunkedReadResponse{ChunkedSeries: frame})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw.Write(data)
+	}
+
+	set := newStreamedChunkSeriesSet(io.NopCloser(&buf))
+	var got []string
+	for set.Next() {
+		s := set.At()
+		var n int
+		it := s.Iterator(nil)
+		for it.Next() {
+			n++
+		}
+		got = append(got, fmt.Sprintf("%s:%d", s.Labels().Get(pb.MetricLabelName), n))
+	}
+	if set.Err() != nil {
+		t.Fatal(set.Err())
+	}
+	if want := []string{"a:2", "b:1", "c:1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+type nopFlusher struct{}
+
+func (nopFlusher) Flush() {}
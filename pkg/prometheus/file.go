@@ -0,0 +1,479 @@
+package prometheus
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// spoolSuffix 是 openmetrics 文件滚动之前暂存样本的目录后缀
+const spoolSuffix = ".tmp"
+
+// spoolIndex 是暂存目录中按第一次出现的顺序记录指标名的文件, 每行一个, 第 i 行指标的样本暂存在名为 i 的文件中
+const spoolIndex = "index"
+
+// FileSink 将 downsample 结果写入本地文件, 用于审计或导入其它工具
+// 文件按照大小和时间滚动, 每个文件都是完整可解析的:
+//   - openmetrics: 带时间戳的 OpenMetrics 文本格式, 以 # EOF 结尾, 可以直接用 promtool tsdb create-blocks-from openmetrics 导入;
+//     同一个指标的样本在文件中必须连续且只有一个 TYPE, 而同一个指标会出现在多个 batch 中,
+//     因此样本先按指标追加到 .tmp 暂存目录中各自的文件, 滚动时按顺序拼接成最终文件;
+//     进程异常退出后遗留的暂存目录在下次启动时生成最终文件
+//   - ndjson: 每行一个样本 {"metric":{...},"timestamp":毫秒,"value":"1.5"}, value 与 prometheus http api 一致使用字符串
+type FileSink struct {
+	dir            string
+	format         string
+	rotateSize     int64
+	rotateInterval time.Duration
+	gzip           bool
+
+	lock   sync.Mutex
+	name   string
+	file   *os.File
+	gw     *gzip.Writer
+	w      *bufio.Writer
+	spool  *familySpool
+	size   int64
+	opened time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewFileSink(dir, format string, rotateSize int64, rotateInterval time.Duration, compression string) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := recoverSpools(dir); err != nil {
+		return nil, err
+	}
+
+	f := &FileSink{
+		dir:            dir,
+		format:         format,
+		rotateSize:     rotateSize,
+		rotateInterval: rotateInterval,
+		gzip:           compression == pb.CompressionGzip,
+		done:           make(chan struct{}),
+	}
+	if rotateInterval > 0 {
+		f.wg.Add(1)
+		go f.rotateLoop()
+	}
+	return f, nil
+}
+
+// recoverSpools 将进程异常退出时遗留的 openmetrics 暂存目录生成最终文件
+func recoverSpools(dir string) error {
+	spools, err := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	if err != nil {
+		return err
+	}
+	for _, spool := range spools {
+		if info, err := os.Stat(spool); err != nil || !info.IsDir() {
+			continue
+		}
+
+		name := strings.TrimSuffix(spool, spoolSuffix)
+		// 生成最终文件的过程中退出时, 最终文件不完整, 重新生成
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := finishOpenMetrics(spool, name, strings.HasSuffix(name, ".gz")); err != nil {
+			return fmt.Errorf("recover file sink spool %s: %w", spool, err)
+		}
+		logrus.WithField("file", name).Warnln("file sink recover spooled file")
+	}
+	return nil
+}
+
+// rotateLoop 定期检查文件是否需要按时间滚动, 没有新数据写入时 Send 不会被调用
+func (f *FileSink) rotateLoop() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(min(f.rotateInterval, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			f.lock.Lock()
+			var err error
+			if !f.opened.IsZero() && time.Since(f.opened) >= f.rotateInterval {
+				err = f.closeFile()
+			}
+			f.lock.Unlock()
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"file":  f.name,
+					"error": err,
+				}).Errorln("file sink rotate file failed")
+			}
+		}
+	}
+}
+
+func (f *FileSink) Name() string {
+	return pb.SinkTypeFile
+}
+
+func (f *FileSink) Send(batch []prompb.TimeSeries) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.opened.IsZero() && (f.size >= f.rotateSize || time.Since(f.opened) >= f.rotateInterval) {
+		if err := f.closeFile(); err != nil {
+			return err
+		}
+	}
+	if f.opened.IsZero() {
+		if err := f.openFile(); err != nil {
+			return err
+		}
+	}
+
+	if f.format != pb.FileFormatNDJSON {
+		// 每个 batch 直接追加到各个指标的暂存文件, 进程异常退出时最多丢失一个 batch
+		n, err := f.spool.append(batch)
+		f.size += n
+		return err
+	}
+
+	cw := &countWriter{w: f.w}
+	err := writeNDJSON(cw, batch)
+	f.size += cw.n
+	if err != nil {
+		return err
+	}
+
+	// 每个 batch 写完后刷到文件, 进程异常退出时最多丢失一个 batch
+	return f.w.Flush()
+}
+
+func (f *FileSink) Close() error {
+	close(f.done)
+	f.wg.Wait()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.opened.IsZero() {
+		return nil
+	}
+	return f.closeFile()
+}
+
+func (f *FileSink) openFile() error {
+	ext := ".prom"
+	if f.format == pb.FileFormatNDJSON {
+		ext = ".ndjson"
+	}
+	if f.gzip {
+		ext += ".gz"
+	}
+
+	opened := time.Now()
+	name := filepath.Join(f.dir, "downsample-"+opened.UTC().Format("20060102T150405.000")+ext)
+
+	// openmetrics 先按指标写入暂存目录, 滚动时再写成最终文件
+	if f.format != pb.FileFormatNDJSON {
+		spool, err := newFamilySpool(name + spoolSuffix)
+		if err != nil {
+			return err
+		}
+		f.spool = spool
+	} else {
+		file, err := createOutput(name, f.gzip)
+		if err != nil {
+			return err
+		}
+		f.file, f.gw, f.w = file.file, file.gw, file.w
+	}
+
+	f.name, f.opened, f.size = name, opened, 0
+	return nil
+}
+
+func (f *FileSink) closeFile() error {
+	defer func() {
+		f.file, f.gw, f.w, f.spool = nil, nil, nil, nil
+		f.opened = time.Time{}
+	}()
+
+	if f.format != pb.FileFormatNDJSON {
+		// 生成失败时保留暂存目录, 下次启动时重新生成
+		if err := f.spool.close(); err != nil {
+			return err
+		}
+		if err := finishOpenMetrics(f.spool.dir, f.name, f.gzip); err != nil {
+			return err
+		}
+	} else if err := (&outputFile{file: f.file, gw: f.gw, w: f.w}).close(); err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"file": f.name,
+		"size": f.size,
+	}).Warnln("file sink rotate file")
+	return nil
+}
+
+// familySpool 是 openmetrics 文件滚动之前的暂存目录, 每个指标的样本追加到各自的文件中
+type familySpool struct {
+	dir   string
+	index *os.File
+	ids   map[string]int
+}
+
+func newFamilySpool(dir string) (*familySpool, error) {
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(filepath.Join(dir, spoolIndex), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &familySpool{dir: dir, index: index, ids: make(map[string]int)}, nil
+}
+
+// append 将 batch 中的样本按指标追加到暂存文件, 返回写入的字节数
+func (s *familySpool) append(batch []prompb.TimeSeries) (int64, error) {
+	var (
+		lines = make(map[string]*strings.Builder)
+		names []string
+		n     int64
+	)
+	for _, ts := range batch {
+		name := metricName(ts.Labels)
+		sb, ok := lines[name]
+		if !ok {
+			sb = &strings.Builder{}
+			lines[name] = sb
+			names = append(names, name)
+		}
+		writeOpenMetrics(sb, ts)
+	}
+
+	for _, name := range names {
+		id, ok := s.ids[name]
+		if !ok {
+			// 先记录指标名再写样本, 恢复时没有样本文件的指标跳过
+			id = len(s.ids)
+			if _, err := s.index.WriteString(name + "\n"); err != nil {
+				return n, err
+			}
+			s.ids[name] = id
+		}
+
+		file, err := os.OpenFile(filepath.Join(s.dir, strconv.Itoa(id)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return n, err
+		}
+		written, err := file.WriteString(lines[name].String())
+		n += int64(written)
+		if err := errors.Join(err, file.Close()); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *familySpool) close() error {
+	return s.index.Close()
+}
+
+// finishOpenMetrics 将暂存目录中的样本按指标第一次出现的顺序拼接成最终文件, 每个指标输出一次 TYPE, 完成后删除暂存目录
+// 逐个指标流式拷贝, 不需要把整个文件读到内存中
+func finishOpenMetrics(spool, name string, compress bool) error {
+	index, err := os.ReadFile(filepath.Join(spool, spoolIndex))
+	if err != nil {
+		return err
+	}
+
+	out, err := createOutput(name, compress)
+	if err != nil {
+		return err
+	}
+	for id, family := range strings.Split(strings.TrimSuffix(string(index), "\n"), "\n") {
+		if len(family) == 0 {
+			continue
+		}
+		if err := copyFamily(out.w, filepath.Join(spool, strconv.Itoa(id)), family); err != nil {
+			out.close()
+			return err
+		}
+	}
+	out.w.WriteString("# EOF\n")
+	if err := out.close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(spool)
+}
+
+func copyFamily(w *bufio.Writer, path, family string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w.WriteString("# TYPE ")
+	w.WriteString(family)
+	w.WriteString(" gauge\n")
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// outputFile 是可选 gzip 压缩的输出文件
+type outputFile struct {
+	file *os.File
+	gw   *gzip.Writer
+	w    *bufio.Writer
+}
+
+func createOutput(name string, compress bool) (*outputFile, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &outputFile{file: file}
+	if compress {
+		out.gw = gzip.NewWriter(file)
+		out.w = bufio.NewWriter(out.gw)
+	} else {
+		out.w = bufio.NewWriter(file)
+	}
+	return out, nil
+}
+
+func (o *outputFile) close() error {
+	if err := o.w.Flush(); err != nil {
+		o.file.Close()
+		return err
+	}
+	if o.gw != nil {
+		if err := o.gw.Close(); err != nil {
+			o.file.Close()
+			return err
+		}
+	}
+	return o.file.Close()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeOpenMetrics 只输出一个序列的样本行, TYPE 和 # EOF 在文件滚动时由 finishOpenMetrics 输出
+func writeOpenMetrics(sb *strings.Builder, ts prompb.TimeSeries) {
+	name := metricName(ts.Labels)
+	for _, s := range ts.Samples {
+		sb.WriteString(name)
+		writeLabels(sb, ts.Labels)
+		sb.WriteByte(' ')
+		sb.WriteString(formatValue(s.Value))
+		sb.WriteByte(' ')
+		// OpenMetrics 的时间戳单位为秒
+		sb.WriteString(strconv.FormatFloat(float64(s.Timestamp)/1000, 'f', -1, 64))
+		sb.WriteByte('\n')
+	}
+}
+
+func writeLabels(sb *strings.Builder, lbs []prompb.Label) {
+	first := true
+	for _, l := range lbs {
+		if l.Name == pb.MetricLabelName {
+			continue
+		}
+		if first {
+			sb.WriteByte('{')
+			first = false
+		} else {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.Name)
+		sb.WriteString(`="`)
+		sb.WriteString(labelValueEscaper.Replace(l.Value))
+		sb.WriteByte('"')
+	}
+	if !first {
+		sb.WriteByte('}')
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricName(lbs []prompb.Label) string {
+	for _, l := range lbs {
+		if l.Name == pb.MetricLabelName {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+type ndjsonSample struct {
+	Metric    map[string]string `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     string            `json:"value"`
+}
+
+func writeNDJSON(w io.Writer, batch []prompb.TimeSeries) error {
+	enc := json.NewEncoder(w)
+	for _, ts := range batch {
+		metric := make(map[string]string, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[l.Name] = l.Value
+		}
+
+		for _, s := range ts.Samples {
+			if err := enc.Encode(ndjsonSample{
+				Metric:    metric,
+				Timestamp: s.Timestamp,
+				Value:     formatValue(s.Value),
+			}); err != nil {
+				return fmt.Errorf("encode ndjson: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package prometheus
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/prompb"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+func TestFileSinkOpenMetrics(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileSink(dir, pb.FileFormatOpenMetrics, 1<<20, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []int64{1000, 2500} {
+		batch := []prompb.TimeSeries{
+			testSeries("up:downsample_5m_avg", ts, 0.5, "instance", `pro"me\theus`),
+			testSeries("up:downsample_5m_count", ts, 10),
+		}
+		if err := sink.Send(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.prom"))
+	if len(files) != 1 {
+		t.Fatalf("got files %v, want 1", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个 batch 中的同一个指标在文件中只有一个 TYPE, 样本连续
+	if n := strings.Count(string(data), "# TYPE "); n != 2 {
+		t.Fatalf("got %d TYPE lines, want 2\n%s", n, data)
+	}
+	if want := "# TYPE up:downsample_5m_avg gauge\nup:downsample_5m_avg{"; !strings.HasPrefix(string(data), want) ||
+		strings.Index(string(data), "up:downsample_5m_count") < strings.LastIndex(string(data), "up:downsample_5m_avg{") {
+		t.Fatalf("samples of a family are not contiguous\n%s", data)
+	}
+	if spools, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix)); len(spools) != 0 {
+		t.Fatalf("spool files left %v", spools)
+	}
+
+	// 输出需要能被 prometheus 的 OpenMetrics 解析器完整解析
+	p := textparse.NewOpenMetricsParser(data)
+	var samples int
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("parse openmetrics: %v\n%s", err, data)
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+
+		var lbs labels.Labels
+		p.Metric(&lbs)
+		_, ts, _ := p.Series()
+		if ts == nil || (*ts != 1000 && *ts != 2500) {
+			t.Fatalf("unexpected timestamp %v", ts)
+		}
+		if lbs.Get(pb.MetricLabelName) == "up:downsample_5m_avg" && lbs.Get("instance") != `pro"me\theus` {
+			t.Fatalf("unexpected labels %s", lbs)
+		}
+		samples++
+	}
+	if samples != 4 {
+		t.Fatalf("got %d samples, want 4", samples)
+	}
+}
+
+func TestFileSinkRotateGzip(t *testing.T) {
+	dir := t.TempDir()
+	// 每个 batch 都超过滚动大小, 每次写入后都会滚动到新文件
+	sink, err := NewFileSink(dir, pb.FileFormatNDJSON, 1, time.Hour, pb.CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []int64{1000, 2000, 3000} {
+		batch := []prompb.TimeSeries{testSeries("up:downsample_5m_avg", ts, 0.5), testSeries("up:downsample_5m_count", ts, 10)}
+		if err := sink.Send(batch); err != nil {
+			t.Fatal(err)
+		}
+		// 文件名精确到毫秒, 避免同名
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ndjson.gz"))
+	if len(files) != 3 {
+		t.Fatalf("got files %v, want 3", files)
+	}
+
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []ndjsonSample
+	scanner := bufio.NewScanner(gr)
+	for scanner.Scan() {
+		var s ndjsonSample
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, s)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	if lines[0].Metric[pb.MetricLabelName] != "up:downsample_5m_avg" || lines[0].Timestamp != 1000 || lines[0].Value != "0.5" {
+		t.Fatalf("unexpected sample %+v", lines[0])
+	}
+}
+
+func TestFileSinkRecoverSpool(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileSink(dir, pb.FileFormatOpenMetrics, 1<<20, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := []prompb.TimeSeries{testSeries("up:downsample_5m_avg", 1000, 0.5), testSeries("up:downsample_5m_count", 1000, 10)}
+	if err := sink.Send(batch); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟进程异常退出: 不调用 Close, 暂存目录在下次启动时生成最终文件
+	close(sink.done)
+	sink.wg.Wait()
+
+	recovered, err := NewFileSink(dir, pb.FileFormatOpenMetrics, 1<<20, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.prom"))
+	if len(files) != 1 {
+		t.Fatalf("got files %v, want 1", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "# TYPE "); n != 2 || !strings.HasSuffix(string(data), "# EOF\n") {
+		t.Fatalf("unexpected recovered file\n%s", data)
+	}
+	if spools, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix)); len(spools) != 0 {
+		t.Fatalf("spool left %v", spools)
+	}
+}
+
+func TestFileSinkRotateInterval(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewFileSink(dir, pb.FileFormatNDJSON, 1<<20, 10*time.Millisecond, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Send(testInstances(1, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有新的写入时也按时间滚动
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sink.lock.Lock()
+		rotated := sink.opened.IsZero()
+		sink.lock.Unlock()
+		if rotated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("file not rotated by interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
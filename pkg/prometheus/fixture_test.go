@@ -0,0 +1,30 @@
+package prometheus
+
+import (
+	"strconv"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// testSeries 返回 job="node" 下只有一个样本的序列, lbs 是依次排列的额外标签名和值
+func testSeries(name string, ts int64, value float64, lbs ...string) prompb.TimeSeries {
+	series := prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: pb.MetricLabelName, Value: name}, {Name: "job", Value: "node"}},
+		Samples: []prompb.Sample{{Timestamp: ts, Value: value}},
+	}
+	for i := 0; i+1 < len(lbs); i += 2 {
+		series.Labels = append(series.Labels, prompb.Label{Name: lbs[i], Value: lbs[i+1]})
+	}
+	return series
+}
+
+// testInstances 返回 n 个 instance 不同的 up:downsample_5m_avg 序列, 样本都是 (ts, ts)
+func testInstances(n int, ts int64) []prompb.TimeSeries {
+	batch := make([]prompb.TimeSeries, 0, n)
+	for i := 0; i < n; i++ {
+		batch = append(batch, testSeries("up:downsample_5m_avg", ts, float64(ts), "instance", strconv.Itoa(i)))
+	}
+	return batch
+}
@@ -1,6 +1,8 @@
 package prometheus
 
 import (
+	"io"
+
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/prometheus/tsdb/chunks"
@@ -9,18 +11,39 @@ import (
 	"prom-stream-downsample/pkg/pb"
 )
 
+// Iterator 遍历读取到的序列, 使用完之后 (包括提前结束迭代) 需要调用 Close 释放连接
 type Iterator interface {
 	Next() bool
 	At() pb.TimeSeries
+	Close()
 }
 
 type StreamIterator struct {
 	css     storage.ChunkSeriesSet
 	samples int64
+	// 取消读取的 ctx, 释放连接
+	cancel func()
 }
 
 func (s *StreamIterator) Next() bool {
-	return s.css.Next()
+	if s.css.Next() {
+		return true
+	}
+	if err := s.css.Err(); err != nil {
+		logrus.Errorln("StreamIterator.Next error", err)
+	}
+	s.Close()
+	return false
+}
+
+// Close 关闭未读完的响应并取消读取, 可以重复调用
+func (s *StreamIterator) Close() {
+	if c, ok := s.css.(io.Closer); ok {
+		c.Close()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
 }
 
 func (s *StreamIterator) At() pb.TimeSeries {
@@ -73,6 +96,8 @@ func (s *SampleIterator) Next() bool {
 	return s.ss.Next()
 }
 
+func (s *SampleIterator) Close() {}
+
 func (s *SampleIterator) At() pb.TimeSeries {
 	series := s.ss.At()
 	lbs := series.Labels()
@@ -105,3 +130,24 @@ func (s *SampleIterator) At() pb.TimeSeries {
 
 	return timeseries
 }
+
+// SliceIterator 用于遍历已经全部读取到内存中的序列
+type SliceIterator struct {
+	series []pb.TimeSeries
+	idx    int
+}
+
+func newSliceIterator(series []pb.TimeSeries) *SliceIterator {
+	return &SliceIterator{series: series, idx: -1}
+}
+
+func (s *SliceIterator) Next() bool {
+	s.idx++
+	return s.idx < len(s.series)
+}
+
+func (s *SliceIterator) At() pb.TimeSeries {
+	return s.series[s.idx]
+}
+
+func (s *SliceIterator) Close() {}
@@ -0,0 +1,37 @@
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/storage"
+)
+
+type closeCountingSet struct {
+	storage.ChunkSeriesSet
+	closed int
+}
+
+func (c *closeCountingSet) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestStreamIteratorClose(t *testing.T) {
+	// 提前结束迭代时关闭响应并取消读取
+	set := &closeCountingSet{ChunkSeriesSet: storage.EmptyChunkSeriesSet()}
+	var cancelled int
+	it := &StreamIterator{css: set, cancel: func() { cancelled++ }}
+	it.Close()
+	if set.closed != 1 || cancelled != 1 {
+		t.Fatalf("got closed %d cancelled %d, want 1 1", set.closed, cancelled)
+	}
+
+	// 读完之后同样释放
+	set.closed, cancelled = 0, 0
+	if it.Next() {
+		t.Fatal("expected empty iterator")
+	}
+	if set.closed != 1 || cancelled != 1 {
+		t.Fatalf("got closed %d cancelled %d after Next, want 1 1", set.closed, cancelled)
+	}
+}
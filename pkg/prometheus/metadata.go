@@ -0,0 +1,232 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// 这些聚合函数的结果与原始值的含义不同 (点数/统计量/分位数/速率), 无论原始类型是什么都作为 gauge
+var gaugeAggregations = map[string]struct{}{
+	"count":  {},
+	"avg":    {},
+	"stddev": {},
+	"sumsq":  {},
+	"median": {},
+	"p50":    {},
+	"p90":    {},
+	"p95":    {},
+	"p99":    {},
+	"p999":   {},
+	"rate":   {},
+}
+
+// 这些聚合函数的结果不再具有原始值的单位
+var unitlessAggregations = map[string]struct{}{
+	"count": {},
+	"sumsq": {},
+	"rate":  {},
+}
+
+// 经典直方图和 summary 的子序列后缀, 元数据登记在去掉后缀的指标族名下
+var familySuffixes = []string{"_bucket", "_sum", "_count", "_total"}
+
+// MetadataCache 定期从 /api/v1/metadata 拉取原始指标的元数据, 用于推导降采样序列的 TYPE/HELP/UNIT
+// nil 表示没有原始元数据, 只根据聚合函数推导类型
+type MetadataCache struct {
+	addr     string
+	api      v1.API
+	interval time.Duration
+
+	lock     sync.RWMutex
+	metadata map[string][]v1.Metadata
+	// 最近一次拉取是否成功, 失败时缓存可能缺失或过期
+	ready bool
+}
+
+func NewMetadataCache(addr string, interval time.Duration) (*MetadataCache, error) {
+	client, err := api.NewClient(api.Config{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MetadataCache{
+		addr:     addr,
+		api:      v1.NewAPI(client),
+		interval: interval,
+		metadata: make(map[string][]v1.Metadata),
+	}
+	return m, nil
+}
+
+// Run 立即拉取一次元数据, 之后定期刷新, 直到 ctx 结束
+// 第一次拉取在后台进行, 数据源较慢时不阻塞启动, 拉取成功前 Ready 返回 false
+func (m *MetadataCache) Run(ctx context.Context) {
+	// 第一次拉取失败不影响启动, 后续定期重试
+	m.refresh()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.refresh()
+		}
+	}
+}
+
+func (m *MetadataCache) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.api.Metadata(ctx, "", "")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"addr":  m.addr,
+			"error": err,
+		}).Errorln("get prometheus metadata failed")
+
+		m.lock.Lock()
+		m.ready = false
+		m.lock.Unlock()
+		return
+	}
+
+	metadata := make(map[string][]v1.Metadata, len(result))
+	for name, mds := range result {
+		if len(mds) > 0 {
+			metadata[name] = mds
+		}
+	}
+
+	m.lock.Lock()
+	m.metadata = metadata
+	m.ready = true
+	m.lock.Unlock()
+}
+
+// Ready 返回最近一次拉取是否成功
+func (m *MetadataCache) Ready() bool {
+	if m == nil {
+		return false
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.ready
+}
+
+// Metadata 返回全部原始指标的元数据, 不同 target 上报的元数据可能不一致, 每个指标保留全部条目
+func (m *MetadataCache) Metadata() map[string][]v1.Metadata {
+	if m == nil {
+		return nil
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.metadata
+}
+
+// source 查找原始指标的元数据, 经典直方图/summary 的子序列和 OpenMetrics 计数器按指标族查找
+// 子序列本身都是单调递增的, 作为 counter 返回
+func (m *MetadataCache) source(metric string) (v1.Metadata, bool) {
+	if m == nil {
+		return v1.Metadata{}, false
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	// 不同 target 上报的元数据可能不一致, 取第一个
+	if mds, ok := m.metadata[metric]; ok {
+		return mds[0], true
+	}
+	for _, suffix := range familySuffixes {
+		family, ok := strings.CutSuffix(metric, suffix)
+		if !ok {
+			continue
+		}
+
+		mds, ok := m.metadata[family]
+		if !ok {
+			continue
+		}
+		md := mds[0]
+		switch md.Type {
+		case v1.MetricTypeHistogram, v1.MetricTypeSummary, v1.MetricTypeCounter:
+			md.Type = v1.MetricTypeCounter
+		default:
+			md.Type = v1.MetricTypeGauge
+		}
+		return md, true
+	}
+	return v1.Metadata{}, false
+}
+
+// Downsample 返回降采样序列的元数据, 非降采样指标返回 false
+func (m *MetadataCache) Downsample(name string) (prompb.MetricMetadata, bool) {
+	metric, interval, agg, ok := pb.ParseDownSampleMetric(name)
+	if !ok {
+		return prompb.MetricMetadata{}, false
+	}
+
+	src, found := m.source(metric)
+	return downsampleMetadata(name, metric, interval, agg, src, found), true
+}
+
+// downsampleMetadata 按照聚合函数和原始指标类型推导降采样序列的元数据
+//   - count/avg/stddev/sumsq/分位数/rate: gauge
+//   - sum/first/last/min/max/lttb 等: 原始指标为 counter 时窗口之间仍然单调递增, 保持 counter, 否则为 gauge
+func downsampleMetadata(name, metric, interval, agg string, src v1.Metadata, found bool) prompb.MetricMetadata {
+	md := prompb.MetricMetadata{
+		Type:             prompb.MetricMetadata_GAUGE,
+		MetricFamilyName: name,
+		Help:             fmt.Sprintf("Downsampled %s of %s over %s windows", agg, metric, interval),
+	}
+	if !found {
+		return md
+	}
+
+	if _, ok := gaugeAggregations[agg]; !ok && src.Type == v1.MetricTypeCounter {
+		md.Type = prompb.MetricMetadata_COUNTER
+	}
+	if _, ok := unitlessAggregations[agg]; !ok {
+		md.Unit = src.Unit
+	}
+	if len(src.Help) > 0 {
+		md.Help += ": " + src.Help
+	}
+	return md
+}
+
+// batchMetadata 返回 batch 中所有降采样指标的元数据, 每个指标只返回一次
+func (m *MetadataCache) batchMetadata(batch []prompb.TimeSeries) []prompb.MetricMetadata {
+	var (
+		seen = make(map[string]struct{})
+		mds  []prompb.MetricMetadata
+	)
+	for _, ts := range batch {
+		name := metricName(ts.Labels)
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		if md, ok := m.Downsample(name); ok {
+			mds = append(mds, md)
+		}
+	}
+	return mds
+}
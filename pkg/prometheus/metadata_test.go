@@ -0,0 +1,76 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestMetadataCacheDownsample(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{
+			"http_requests_total":[{"type":"counter","help":"Total requests.","unit":""}],
+			"process_resident_memory_bytes":[{"type":"gauge","help":"Resident memory.","unit":"bytes"}],
+			"latency_seconds":[{"type":"histogram","help":"Latency.","unit":"seconds"}]
+		}}`))
+	}))
+	defer srv.Close()
+
+	m, err := NewMetadataCache(srv.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.refresh()
+
+	for _, tc := range []struct {
+		name string
+		typ  prompb.MetricMetadata_MetricType
+		unit string
+		help string
+	}{
+		{"http_requests_total:downsample_5m_sum", prompb.MetricMetadata_COUNTER, "", "Downsampled sum of http_requests_total over 5m windows: Total requests."},
+		{"http_requests_total:downsample_5m_last", prompb.MetricMetadata_COUNTER, "", ""},
+		{"http_requests_total:downsample_5m_count", prompb.MetricMetadata_GAUGE, "", ""},
+		{"http_requests_total:downsample_1h_p99", prompb.MetricMetadata_GAUGE, "", ""},
+		{"process_resident_memory_bytes:downsample_5m_sum", prompb.MetricMetadata_GAUGE, "bytes", ""},
+		{"process_resident_memory_bytes:downsample_5m_count", prompb.MetricMetadata_GAUGE, "", ""},
+		// 经典直方图的子序列按指标族查找, 本身是 counter
+		{"latency_seconds_bucket:downsample_5m_last", prompb.MetricMetadata_COUNTER, "seconds", ""},
+		// 没有原始元数据时只根据聚合函数推导
+		{"unknown:downsample_5m_sum", prompb.MetricMetadata_GAUGE, "", "Downsampled sum of unknown over 5m windows"},
+	} {
+		md, ok := m.Downsample(tc.name)
+		if !ok {
+			t.Fatalf("%s: expected downsample metadata", tc.name)
+		}
+		if md.Type != tc.typ || md.Unit != tc.unit {
+			t.Fatalf("%s: got type %s unit %q, want %s %q", tc.name, md.Type, md.Unit, tc.typ, tc.unit)
+		}
+		if len(tc.help) > 0 && md.Help != tc.help {
+			t.Fatalf("%s: got help %q, want %q", tc.name, md.Help, tc.help)
+		}
+	}
+
+	if _, ok := m.Downsample("http_requests_total"); ok {
+		t.Fatal("unexpected metadata for raw metric")
+	}
+
+	// 没有元数据来源时所有降采样指标都是 gauge
+	var empty *MetadataCache
+	if md, ok := empty.Downsample("http_requests_total:downsample_5m_sum"); !ok || md.Type != prompb.MetricMetadata_GAUGE {
+		t.Fatalf("unexpected metadata %v without source", md)
+	}
+
+	mds := m.batchMetadata([]prompb.TimeSeries{
+		testSeries("http_requests_total:downsample_5m_sum", 60000, 1),
+		testSeries("http_requests_total:downsample_5m_sum", 60000, 2, "instance", "b"),
+		testSeries("http_requests_total", 60000, 3),
+	})
+	if len(mds) != 1 || mds[0].MetricFamilyName != "http_requests_total:downsample_5m_sum" {
+		t.Fatalf("unexpected batch metadata %v", mds)
+	}
+}
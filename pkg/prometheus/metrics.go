@@ -0,0 +1,49 @@
+package prometheus
+
+import (
+	promclient "github.com/prometheus/client_golang/prometheus"
+)
+
+// 写出相关的自监控指标, 通过 proxy 的 /metrics 暴露
+var (
+	sentSamplesTotal = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "psd_remote_write_sent_samples_total",
+		Help: "The total number of samples successfully sent to the target",
+	}, []string{"target"})
+	retriedSamplesTotal = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "psd_remote_write_retried_samples_total",
+		Help: "The total number of samples which failed on recoverable errors and were retried",
+	}, []string{"target"})
+	failedSamplesTotal = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "psd_remote_write_failed_samples_total",
+		Help: "The total number of samples which failed on non-recoverable errors",
+	}, []string{"target"})
+	droppedSamplesTotal = promclient.NewCounterVec(promclient.CounterOpts{
+		Name: "psd_remote_write_dropped_samples_total",
+		Help: "The total number of samples which were dropped before being sent, e.g. on shutdown",
+	}, []string{"target"})
+	shardsGauge = promclient.NewGaugeVec(promclient.GaugeOpts{
+		Name: "psd_remote_write_shards",
+		Help: "The number of shards used for parallel sending to the target",
+	}, []string{"target"})
+	desiredShardsGauge = promclient.NewGaugeVec(promclient.GaugeOpts{
+		Name: "psd_remote_write_shards_desired",
+		Help: "The number of shards that the queue manager calculated to be needed",
+	}, []string{"target"})
+	pendingSamplesGauge = promclient.NewGaugeVec(promclient.GaugeOpts{
+		Name: "psd_remote_write_samples_pending",
+		Help: "The number of samples pending in the shards to be sent to the target",
+	}, []string{"target"})
+)
+
+func init() {
+	promclient.MustRegister(
+		sentSamplesTotal,
+		retriedSamplesTotal,
+		failedSamplesTotal,
+		droppedSamplesTotal,
+		shardsGauge,
+		desiredShardsGauge,
+		pendingSamplesGauge,
+	)
+}
@@ -0,0 +1,435 @@
+package prometheus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	gproto "google.golang.org/protobuf/proto"
+
+	"prom-stream-downsample/pkg/pb"
+	"prom-stream-downsample/pkg/version"
+)
+
+const (
+	otlpScopeName = "prom-stream-downsample"
+
+	otlpAttrAggregation = "downsample.aggregation"
+	otlpAttrResolution  = "downsample.resolution"
+)
+
+// otlpResourceLabels 与 prometheus 的 OTLP 兼容规范一致, job/instance 映射为资源属性
+var otlpResourceLabels = map[string]string{
+	"job":      "service.name",
+	"instance": "service.instance.id",
+}
+
+// seriesGrouper 由需要将多个序列放在同一次请求中写出的 Sink 实现
+type seriesGrouper interface {
+	groupSeries(batch []prompb.TimeSeries) []seriesGroup
+}
+
+// OTLPSink 通过 OTLP/HTTP (protobuf) 协议写出
+//
+// 指标名保持降采样指标名不变, 与 remote write 写出的结果可以用相同的方式查询;
+// 聚合函数和 resolution 作为数据点属性, job/instance 作为资源属性, 其余 label 作为数据点属性.
+// 指标类型按照聚合函数确定:
+//   - count: 窗口内的点数, 单调的 delta sum
+//   - sum/sumsq: 窗口内的累加值, 非单调的 delta sum
+//   - 原始指标为经典直方图的 _bucket/_sum/_count 且聚合函数为 last: 还原为 cumulative histogram,
+//     同一个直方图的序列由 groupSeries 分配到同一个 shard 并在同一次请求中写出
+//   - 其它: gauge
+type OTLPSink struct {
+	url    string
+	auth   Auth
+	client *http.Client
+}
+
+func NewOTLPSink(url string, auth Auth) *OTLPSink {
+	return &OTLPSink{
+		url:    url,
+		auth:   auth,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (o *OTLPSink) Name() string {
+	return pb.SinkTypeOTLP
+}
+
+func (o *OTLPSink) Close() error {
+	return nil
+}
+
+func (o *OTLPSink) Send(batch []prompb.TimeSeries) error {
+	// ExportMetricsServiceRequest 与 MetricsData 的编码完全一致 (都只有 repeated ResourceMetrics resource_metrics = 1),
+	// 这里使用 MetricsData 避免引入 collector 包的 grpc 依赖
+	data, err := gproto.Marshal(&metricspb.MetricsData{ResourceMetrics: toResourceMetrics(batch)})
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", o.url, &buf)
+	if err != nil {
+		return err
+	}
+
+	o.auth.apply(httpReq)
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	httpReq.Header.Set("User-Agent", "prom-remote-write-shard")
+
+	resp, err := o.client.Do(httpReq)
+	if err != nil {
+		return RecoverableError{error: err}
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 != 2 {
+		all, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("otlp export status code %d: %s", resp.StatusCode, string(all))
+
+		// OTLP/HTTP 规范中可以重试的状态码
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return RecoverableError{
+				error:      err,
+				retryAfter: retryAfterDuration(resp.Header.Get("Retry-After")),
+			}
+		}
+		return err
+	}
+
+	logrus.Warnln("otlp export series success", len(batch))
+	return nil
+}
+
+// groupSeries 同一个直方图的 _bucket/_sum/_count 序列作为一组, 按照去掉 le 和后缀的 label 分配 shard,
+// 避免被拆分到不同的请求中还原出不完整的直方图
+func (o *OTLPSink) groupSeries(batch []prompb.TimeSeries) []seriesGroup {
+	var (
+		groups     = make([]seriesGroup, 0, len(batch))
+		histograms = make(map[string]int)
+	)
+	for _, ts := range batch {
+		key := histogramKey(splitOTLPSeries(ts))
+		if len(key) == 0 {
+			groups = append(groups, seriesGroup{hash: labelsHash(ts.Labels), series: []prompb.TimeSeries{ts}})
+			continue
+		}
+
+		if i, ok := histograms[key]; ok {
+			groups[i].series = append(groups[i].series, ts)
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		histograms[key] = len(groups)
+		groups = append(groups, seriesGroup{hash: h.Sum64(), series: []prompb.TimeSeries{ts}})
+	}
+	return groups
+}
+
+// otlpSeries 是拆分后的一个降采样序列
+type otlpSeries struct {
+	name, metric, interval, agg string
+
+	resource []prompb.Label
+	attrs    []prompb.Label
+	le       string
+	samples  []prompb.Sample
+}
+
+func toResourceMetrics(batch []prompb.TimeSeries) []*metricspb.ResourceMetrics {
+	var (
+		resources = make(map[string]*metricspb.ResourceMetrics)
+		metrics   = make(map[string]map[string]*metricspb.Metric)
+		order     []string
+	)
+
+	metricOf := func(s otlpSeries, name string, lbs []prompb.Label) (*metricspb.Metric, []*commonpb.KeyValue) {
+		key := labelsKey(s.resource)
+		rm, ok := resources[key]
+		if !ok {
+			rm = &metricspb.ResourceMetrics{
+				Resource: &resourcepb.Resource{Attributes: resourceAttributes(s.resource)},
+				ScopeMetrics: []*metricspb.ScopeMetrics{{
+					Scope: &commonpb.InstrumentationScope{Name: otlpScopeName, Version: version.Version},
+				}},
+			}
+			resources[key] = rm
+			metrics[key] = make(map[string]*metricspb.Metric)
+			order = append(order, key)
+		}
+
+		m, ok := metrics[key][name]
+		if !ok {
+			m = &metricspb.Metric{Name: name}
+			metrics[key][name] = m
+			rm.ScopeMetrics[0].Metrics = append(rm.ScopeMetrics[0].Metrics, m)
+		}
+
+		attrs := make([]*commonpb.KeyValue, 0, len(lbs)+2)
+		for _, l := range lbs {
+			attrs = append(attrs, stringKeyValue(l.Name, l.Value))
+		}
+		attrs = append(attrs, stringKeyValue(otlpAttrAggregation, s.agg), stringKeyValue(otlpAttrResolution, s.interval))
+		return m, attrs
+	}
+
+	series := make([]otlpSeries, 0, len(batch))
+	for _, ts := range batch {
+		series = append(series, splitOTLPSeries(ts))
+	}
+
+	histograms := collectHistograms(series)
+	for _, s := range series {
+		if h, ok := histograms[histogramKey(s)]; ok {
+			// 已经合并到直方图中, _bucket 序列在这里生成数据点, _sum/_count 跳过
+			if len(s.le) == 0 || h.emitted {
+				continue
+			}
+			h.emitted = true
+
+			// 经典直方图的 _bucket/_sum/_count 合并为一个指标
+			name := fmt.Sprintf(pb.DownSampleMetricExtendFormat, strings.TrimSuffix(s.metric, "_bucket"), s.interval, s.agg)
+			m, attrs := metricOf(s, name, withoutLabel(s.attrs, "le"))
+			if m.Data == nil {
+				m.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				}}
+			}
+			hist := m.Data.(*metricspb.Metric_Histogram).Histogram
+			hist.DataPoints = append(hist.DataPoints, h.dataPoint(attrs))
+			continue
+		}
+
+		m, attrs := metricOf(s, s.name, s.attrs)
+		interval, _ := model.ParseDuration(s.interval)
+		points := make([]*metricspb.NumberDataPoint, 0, len(s.samples))
+		for _, sample := range s.samples {
+			p := &metricspb.NumberDataPoint{
+				Attributes:   attrs,
+				TimeUnixNano: uint64(sample.Timestamp) * uint64(time.Millisecond),
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: sample.Value},
+			}
+			points = append(points, p)
+		}
+
+		switch s.agg {
+		case "count", "sum", "sumsq":
+			// delta sum 的起始时间为降采样窗口的起始时间, 降采样点的时间为窗口的中位, 这里按照一个 resolution 估算
+			for _, p := range points {
+				if start := int64(p.TimeUnixNano) - int64(interval); start > 0 && interval > 0 {
+					p.StartTimeUnixNano = uint64(start)
+				}
+			}
+			if m.Data == nil {
+				m.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+					IsMonotonic:            s.agg == "count",
+				}}
+			}
+			sum := m.Data.(*metricspb.Metric_Sum).Sum
+			sum.DataPoints = append(sum.DataPoints, points...)
+		default:
+			if m.Data == nil {
+				m.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+			}
+			gauge := m.Data.(*metricspb.Metric_Gauge).Gauge
+			gauge.DataPoints = append(gauge.DataPoints, points...)
+		}
+	}
+
+	rms := make([]*metricspb.ResourceMetrics, 0, len(order))
+	for _, key := range order {
+		rms = append(rms, resources[key])
+	}
+	return rms
+}
+
+func splitOTLPSeries(ts prompb.TimeSeries) otlpSeries {
+	s := otlpSeries{samples: ts.Samples}
+	for _, l := range ts.Labels {
+		switch {
+		case l.Name == pb.MetricLabelName:
+			s.name = l.Value
+		case len(otlpResourceLabels[l.Name]) > 0:
+			s.resource = append(s.resource, l)
+		default:
+			s.attrs = append(s.attrs, l)
+		}
+	}
+
+	var ok bool
+	s.metric, s.interval, s.agg, ok = pb.ParseDownSampleMetric(s.name)
+	if !ok {
+		s.metric = s.name
+	}
+
+	if strings.HasSuffix(s.metric, "_bucket") {
+		for _, l := range s.attrs {
+			if l.Name == "le" {
+				s.le = l.Value
+				break
+			}
+		}
+	}
+	return s
+}
+
+func withoutLabel(lbs []prompb.Label, name string) []prompb.Label {
+	res := make([]prompb.Label, 0, len(lbs))
+	for _, l := range lbs {
+		if l.Name != name {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// otlpHistogram 是由经典直方图的 _bucket/_sum/_count 序列还原的直方图
+type otlpHistogram struct {
+	ts      int64
+	buckets map[float64]float64 // le -> 累计计数
+	sum     *float64
+	emitted bool
+}
+
+// histogramKey 同一个直方图的 _bucket/_sum/_count 序列 key 相同, 不是直方图的序列返回空字符串
+func histogramKey(s otlpSeries) string {
+	if s.agg != "last" {
+		return ""
+	}
+
+	var base string
+	switch {
+	case len(s.le) > 0:
+		base = strings.TrimSuffix(s.metric, "_bucket")
+	case strings.HasSuffix(s.metric, "_sum"):
+		base = strings.TrimSuffix(s.metric, "_sum")
+	case strings.HasSuffix(s.metric, "_count"):
+		base = strings.TrimSuffix(s.metric, "_count")
+	default:
+		return ""
+	}
+	return base + "|" + s.interval + "|" + labelsKey(s.resource) + "|" + labelsKey(withoutLabel(s.attrs, "le"))
+}
+
+// collectHistograms 只有包含 +Inf bucket 的直方图才会被还原, 否则其序列仍然按照 gauge 写出
+func collectHistograms(series []otlpSeries) map[string]*otlpHistogram {
+	candidates := make(map[string]*otlpHistogram)
+	for _, s := range series {
+		if len(s.le) == 0 || len(s.samples) != 1 {
+			continue
+		}
+		key := histogramKey(s)
+		if len(key) == 0 {
+			continue
+		}
+
+		le, err := strconv.ParseFloat(s.le, 64)
+		if err != nil {
+			continue
+		}
+
+		h, ok := candidates[key]
+		if !ok {
+			h = &otlpHistogram{ts: s.samples[0].Timestamp, buckets: make(map[float64]float64)}
+			candidates[key] = h
+		}
+		h.buckets[le] = s.samples[0].Value
+	}
+
+	histograms := make(map[string]*otlpHistogram)
+	for key, h := range candidates {
+		if _, ok := h.buckets[math.Inf(1)]; ok {
+			histograms[key] = h
+		}
+	}
+
+	for _, s := range series {
+		if h, ok := histograms[histogramKey(s)]; ok && strings.HasSuffix(s.metric, "_sum") && len(s.samples) == 1 {
+			v := s.samples[0].Value
+			h.sum = &v
+		}
+	}
+	return histograms
+}
+
+func (h *otlpHistogram) dataPoint(attrs []*commonpb.KeyValue) *metricspb.HistogramDataPoint {
+	les := make([]float64, 0, len(h.buckets))
+	for le := range h.buckets {
+		les = append(les, le)
+	}
+	sort.Float64s(les)
+
+	p := &metricspb.HistogramDataPoint{
+		Attributes:     attrs,
+		TimeUnixNano:   uint64(h.ts) * uint64(time.Millisecond),
+		Count:          uint64(h.buckets[math.Inf(1)]),
+		Sum:            h.sum,
+		ExplicitBounds: les[:len(les)-1],
+	}
+
+	// prometheus 的 bucket 是累计计数, OTLP 的 bucket 是每个区间的计数
+	var prev float64
+	for _, le := range les {
+		cur := h.buckets[le]
+		p.BucketCounts = append(p.BucketCounts, uint64(math.Max(cur-prev, 0)))
+		prev = cur
+	}
+	return p
+}
+
+func resourceAttributes(lbs []prompb.Label) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(lbs))
+	for _, l := range lbs {
+		attrs = append(attrs, stringKeyValue(otlpResourceLabels[l.Name], l.Value))
+	}
+	return attrs
+}
+
+func stringKeyValue(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   k,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}},
+	}
+}
+
+func labelsKey(lbs []prompb.Label) string {
+	var sb strings.Builder
+	for _, l := range lbs {
+		sb.WriteString(l.Name)
+		sb.WriteByte(0xff)
+		sb.WriteString(l.Value)
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
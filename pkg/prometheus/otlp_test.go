@@ -0,0 +1,148 @@
+package prometheus
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+func TestOTLPSink(t *testing.T) {
+	// 本地的 OTLP 接收端, 解码 ExportMetricsServiceRequest
+	var received *metricspb.MetricsData
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(gr)
+
+		received = &metricspb.MetricsData{}
+		if err := gproto.Unmarshal(body, received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	sink := NewOTLPSink(srv.URL, Auth{})
+	err := sink.Send([]prompb.TimeSeries{
+		testSeries("up:downsample_5m_avg", 60000, 1, "env", "prod"),
+		testSeries("http_requests_total:downsample_5m_count", 60000, 10),
+		testSeries("latency_bucket:downsample_5m_last", 60000, 2, "le", "0.1"),
+		testSeries("latency_bucket:downsample_5m_last", 60000, 5, "le", "1"),
+		testSeries("latency_bucket:downsample_5m_last", 60000, 6, "le", "+Inf"),
+		testSeries("latency_sum:downsample_5m_last", 60000, 3.5),
+		testSeries("latency_count:downsample_5m_last", 60000, 6),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received.ResourceMetrics) != 1 {
+		t.Fatalf("got %d resources, want 1", len(received.ResourceMetrics))
+	}
+	rm := received.ResourceMetrics[0]
+	if attr := rm.Resource.Attributes[0]; attr.Key != "service.name" || attr.Value.GetStringValue() != "node" {
+		t.Fatalf("unexpected resource attribute %v", attr)
+	}
+
+	metrics := make(map[string]*metricspb.Metric)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	if len(metrics) != 3 {
+		t.Fatalf("got %d metrics, want 3", len(metrics))
+	}
+
+	gauge := metrics["up:downsample_5m_avg"].GetGauge()
+	if gauge == nil || len(gauge.DataPoints) != 1 {
+		t.Fatal("expected avg as gauge")
+	}
+	attrs := make(map[string]string)
+	for _, kv := range gauge.DataPoints[0].Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	if attrs["env"] != "prod" || attrs[otlpAttrAggregation] != "avg" || attrs[otlpAttrResolution] != "5m" {
+		t.Fatalf("unexpected data point attributes %v", attrs)
+	}
+
+	sum := metrics["http_requests_total:downsample_5m_count"].GetSum()
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA {
+		t.Fatal("expected count as monotonic delta sum")
+	}
+
+	hist := metrics["latency:downsample_5m_last"].GetHistogram()
+	if hist == nil || len(hist.DataPoints) != 1 {
+		t.Fatal("expected classic histogram to be restored")
+	}
+	p := hist.DataPoints[0]
+	if p.Count != 6 || p.GetSum() != 3.5 || len(p.ExplicitBounds) != 2 {
+		t.Fatalf("unexpected histogram point %v", p)
+	}
+	for i, want := range []uint64{2, 3, 1} {
+		if p.BucketCounts[i] != want {
+			t.Fatalf("got bucket counts %v", p.BucketCounts)
+		}
+	}
+}
+
+func TestOTLPGroupSeries(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		batches [][]prompb.TimeSeries
+	)
+	qm := NewQueueManager("test", QueueConfig{
+		MinShards:         4,
+		MaxShards:         4,
+		MaxSamplesPerSend: 2,
+		BatchSendDeadline: time.Hour,
+	}, func(_ context.Context, batch []prompb.TimeSeries) error {
+		lock.Lock()
+		batches = append(batches, append([]prompb.TimeSeries(nil), batch...))
+		lock.Unlock()
+		return nil
+	})
+	qm.group = NewOTLPSink("", Auth{}).groupSeries
+	qm.Start(context.Background())
+
+	err := qm.Append(context.Background(), []prompb.TimeSeries{
+		testSeries("latency_bucket:downsample_5m_last", 60000, 2, "le", "0.1"),
+		testSeries("up:downsample_5m_avg", 60000, 1),
+		testSeries("latency_bucket:downsample_5m_last", 60000, 5, "le", "1"),
+		testSeries("latency_bucket:downsample_5m_last", 60000, 6, "le", "+Inf"),
+		testSeries("latency_sum:downsample_5m_last", 60000, 3.5),
+		testSeries("latency_count:downsample_5m_last", 60000, 6),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qm.Stop()
+
+	// 直方图的 5 个序列超过 max_samples_per_send 也必须在同一次请求中写出
+	var found bool
+	for _, batch := range batches {
+		var n int
+		for _, ts := range batch {
+			if strings.HasPrefix(ts.Labels[0].Value, "latency_") {
+				n++
+			}
+		}
+		if n != 0 && n != 5 {
+			t.Fatalf("histogram split across sends: %d of 5 series in one batch", n)
+		}
+		found = found || n == 5
+	}
+	if !found {
+		t.Fatal("histogram series not sent")
+	}
+}
@@ -0,0 +1,202 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// Pushdown 由支持将聚合下推到服务端的 Source 实现
+// 不支持下推的聚合函数仍然走原始数据读取 + 本地聚合
+type Pushdown interface {
+	// PushdownAgg 返回该聚合函数能否下推, 以及下推后返回的是否已经是最终的聚合值
+	// final 为 false 时, 返回的数据仍需要在本地使用同一个聚合函数再聚合一次
+	PushdownAgg(agg string) (supported bool, final bool)
+	// ReadPushdown 读取 [start, end] 时间范围内经过服务端聚合的数据
+	ReadPushdown(span *pb.DurationSpan, start, end time.Time, agg string, matchers ...pb.Matcher) (Iterator, error)
+}
+
+// overTimeFuncs 是本地聚合函数与 promQL *_over_time 函数的对应关系
+// 只保留与本地算法结果一致的函数, 分位数等插值方式不同的函数不下推
+var overTimeFuncs = map[string]string{
+	"avg":    "avg_over_time",
+	"min":    "min_over_time",
+	"max":    "max_over_time",
+	"sum":    "sum_over_time",
+	"count":  "count_over_time",
+	"last":   "last_over_time",
+	"stddev": "stddev_over_time",
+}
+
+// hintFuncs 是可以通过 remote read hints 下推的聚合函数
+// 后端是否遵守 hints 是不确定的, 因此只保留 "对服务端预聚合结果再做一次同样的聚合, 结果不变" 的函数
+// 例如 count 不在其中: 对预聚合后的点再 count 一次得到的是点数而不是原始点数;
+// avg 也不在其中: 各个预聚合区间的点数不同时, 平均值的平均值不等于原始点的平均值
+var hintFuncs = map[string]string{
+	"min": "min_over_time",
+	"max": "max_over_time",
+	"sum": "sum_over_time",
+}
+
+// hintsProbe 记录后端是否遵守 remote read hints
+// 不遵守 hints 的后端每次下推都返回原始数据, 每个聚合函数各读一次原始数据反而增加了读取量;
+// 下推读取的结果中出现窗口内多于 hintsMaxPoints 个点的序列时认为后端不遵守, 之后不再下推, 所有聚合函数共用一次原始数据读取
+type hintsProbe struct {
+	ignored atomic.Bool
+}
+
+// 遵守 hints 时每个窗口只返回一个预聚合点, 窗口边界未对齐时可能有两个
+const hintsMaxPoints = 2
+
+func (h *hintsProbe) observe(addr []string, ts pb.TimeSeries) {
+	if len(ts.Points) <= hintsMaxPoints || h.ignored.Swap(true) {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"addr":   addr,
+		"points": len(ts.Points),
+	}).Warnln("remote read backend ignores read hints, stop pushdown")
+}
+
+// hintsIterator 在遍历下推结果时检查后端是否遵守 hints
+type hintsIterator struct {
+	Iterator
+	addr  []string
+	probe *hintsProbe
+}
+
+func (h *hintsIterator) At() pb.TimeSeries {
+	ts := h.Iterator.At()
+	h.probe.observe(h.addr, ts)
+	return ts
+}
+
+// PushdownAgg remote read 通过 ReadHints(func/step/range) 下推, thanos/victoriametrics 等后端会使用 hints 减少返回的数据
+// 发现后端不遵守 hints 后不再下推
+func (p *Prometheus) PushdownAgg(agg string) (bool, bool) {
+	if p.hints.ignored.Load() {
+		return false, false
+	}
+	_, ok := hintFuncs[agg]
+	return ok, false
+}
+
+func (p *Prometheus) ReadPushdown(
+	span *pb.DurationSpan,
+	start time.Time,
+	end time.Time,
+	agg string,
+	matchers ...pb.Matcher,
+) (Iterator, error) {
+	fn, ok := hintFuncs[agg]
+	if !ok {
+		return nil, fmt.Errorf("agg %s can not push down", agg)
+	}
+
+	window := end.Sub(start).Milliseconds()
+	it, err := p.chunkRemoteReadV2(span, start, end, toLabelMatchers(matchers), &storage.SelectHints{
+		Start: start.UnixMilli(),
+		End:   end.UnixMilli(),
+		Step:  window,
+		Range: window,
+		Func:  fn,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hintsIterator{Iterator: it, addr: p.remoteReadGroup, probe: p.hints}, nil
+}
+
+// PushdownAgg query_range 通过 *_over_time(selector[window]) 直接在服务端计算出最终的聚合值
+func (q *QueryRangeSource) PushdownAgg(agg string) (bool, bool) {
+	_, ok := overTimeFuncs[agg]
+	return ok, true
+}
+
+func (q *QueryRangeSource) ReadPushdown(
+	span *pb.DurationSpan,
+	start time.Time,
+	end time.Time,
+	agg string,
+	matchers ...pb.Matcher,
+) (Iterator, error) {
+	fn, ok := overTimeFuncs[agg]
+	if !ok {
+		return nil, fmt.Errorf("agg %s can not push down", agg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+
+	// *_over_time 函数会丢弃 __name__, 所以先查出匹配的指标名, 再按指标名分别查询并还原 __name__
+	names, _, err := q.api.LabelValues(ctx, pb.MetricLabelName, []string{vectorSelector(matchers)}, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		series   []pb.TimeSeries
+		duration float64
+	)
+	for _, name := range names {
+		ms := make([]pb.Matcher, 0, len(matchers)+1)
+		ms = append(ms, matchers...)
+		ms = append(ms, pb.Matcher{
+			Name:  pb.MetricLabelName,
+			Type:  pb.LabelMatcher_EQ,
+			Value: string(name),
+		})
+
+		query := (&parser.Call{
+			Func: parser.Functions[fn],
+			Args: parser.Expressions{&parser.MatrixSelector{
+				VectorSelector: &parser.VectorSelector{LabelMatchers: toLabelMatchers(ms)},
+				Range:          end.Sub(start),
+			}},
+		}).String()
+
+		value, err := q.instantQuery(span, query, end)
+		if err != nil {
+			return nil, err
+		}
+		duration += span.QueryDuration
+
+		vector, ok := value.(model.Vector)
+		if !ok {
+			return nil, fmt.Errorf("unexpected query result type: %s", value.Type())
+		}
+		for _, s := range vector {
+			s.Metric[model.MetricNameLabel] = name
+		}
+		series = append(series, vectorToTimeSeries(vector)...)
+	}
+
+	span.QueryDuration = duration
+	return newSliceIterator(series), nil
+}
+
+func vectorSelector(matchers []pb.Matcher) string {
+	return (&parser.VectorSelector{LabelMatchers: toLabelMatchers(matchers)}).String()
+}
+
+func vectorToTimeSeries(vector model.Vector) []pb.TimeSeries {
+	series := make([]pb.TimeSeries, 0, len(vector))
+	for _, s := range vector {
+		series = append(series, pb.TimeSeries{
+			Labels: metricToLabels(s.Metric),
+			Points: []pb.Point{{
+				Timestamp: int64(s.Timestamp),
+				Value:     float64(s.Value),
+			}},
+		})
+	}
+	return series
+}
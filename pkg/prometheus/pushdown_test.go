@@ -0,0 +1,38 @@
+package prometheus
+
+import (
+	"testing"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+func TestHintsProbe(t *testing.T) {
+	p := &Prometheus{hints: &hintsProbe{}}
+	if supported, final := p.PushdownAgg("max"); !supported || final {
+		t.Fatalf("got supported %v final %v, want true false", supported, final)
+	}
+
+	// 遵守 hints 时每个窗口只有一个预聚合点, 继续下推
+	it := &hintsIterator{
+		Iterator: newSliceIterator([]pb.TimeSeries{{Points: []pb.Point{{Timestamp: 1, Value: 1}}}}),
+		probe:    p.hints,
+	}
+	for it.Next() {
+		it.At()
+	}
+	if supported, _ := p.PushdownAgg("max"); !supported {
+		t.Fatal("expected pushdown while backend honours hints")
+	}
+
+	// 返回原始点时不再下推
+	it = &hintsIterator{
+		Iterator: newSliceIterator([]pb.TimeSeries{{Points: []pb.Point{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}}}}),
+		probe:    p.hints,
+	}
+	for it.Next() {
+		it.At()
+	}
+	if supported, _ := p.PushdownAgg("max"); supported {
+		t.Fatal("expected no pushdown after backend ignores hints")
+	}
+}
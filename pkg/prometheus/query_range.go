@@ -0,0 +1,124 @@
+package prometheus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// QueryRangeSource 通过 prometheus http 查询接口读取原始数据
+// 适用于只暴露了查询接口, 没有 remote read 的存储
+type QueryRangeSource struct {
+	addr string
+	api  v1.API
+}
+
+func NewQueryRangeSource(addr string) (*QueryRangeSource, error) {
+	client, err := api.NewClient(api.Config{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryRangeSource{
+		addr: addr,
+		api:  v1.NewAPI(client),
+	}, nil
+}
+
+func (q *QueryRangeSource) Type() string {
+	return pb.SourceTypeQueryRange
+}
+
+// Read 通过 {matchers}[window] 的 matrix 查询获取窗口内的原始点
+func (q *QueryRangeSource) Read(
+	span *pb.DurationSpan,
+	start time.Time,
+	end time.Time,
+	matchers ...pb.Matcher,
+) (Iterator, error) {
+	query := matrixSelector(end.Sub(start), matchers)
+	return q.query(span, query, end)
+}
+
+func (q *QueryRangeSource) query(span *pb.DurationSpan, query string, ts time.Time) (Iterator, error) {
+	value, err := q.instantQuery(span, query, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	if matrix, ok := value.(model.Matrix); ok {
+		return newSliceIterator(matrixToTimeSeries(matrix)), nil
+	}
+	return nil, fmt.Errorf("unexpected query result type: %s", value.Type())
+}
+
+func (q *QueryRangeSource) instantQuery(span *pb.DurationSpan, query string, ts time.Time) (model.Value, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+
+	queryStart := time.Now()
+	value, warnings, err := q.api.Query(ctx, query, ts)
+	if err != nil {
+		return nil, err
+	}
+	span.QueryDuration = time.Since(queryStart).Seconds()
+
+	if len(warnings) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"addr":     q.addr,
+			"query":    query,
+			"warnings": warnings,
+		}).Warnln("query_range source query warnings")
+	}
+	return value, nil
+}
+
+// matrixSelector 将 matchers 转换为 {matchers}[window] 格式的 promQL
+func matrixSelector(window time.Duration, matchers []pb.Matcher) string {
+	return (&parser.MatrixSelector{
+		VectorSelector: &parser.VectorSelector{LabelMatchers: toLabelMatchers(matchers)},
+		Range:          window,
+	}).String()
+}
+
+func metricToLabels(metric model.Metric) []pb.Label {
+	lbs := make([]pb.Label, 0, len(metric))
+	for name, value := range metric {
+		lbs = append(lbs, pb.Label{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(lbs, func(i, j int) bool {
+		return lbs[i].Name < lbs[j].Name
+	})
+	return lbs
+}
+
+func matrixToTimeSeries(matrix model.Matrix) []pb.TimeSeries {
+	series := make([]pb.TimeSeries, 0, len(matrix))
+	for _, ss := range matrix {
+		if len(ss.Values) == 0 {
+			continue
+		}
+
+		ts := pb.TimeSeries{
+			Labels: metricToLabels(ss.Metric),
+			Points: make([]pb.Point, 0, len(ss.Values)),
+		}
+		for _, v := range ss.Values {
+			ts.Points = append(ts.Points, pb.Point{
+				Timestamp: int64(v.Timestamp),
+				Value:     float64(v.Value),
+			})
+		}
+		series = append(series, ts)
+	}
+	return series
+}
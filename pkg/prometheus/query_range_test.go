@@ -0,0 +1,109 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+func TestQueryRangeSourceRead(t *testing.T) {
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		gotQuery = r.Form.Get("query")
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"__name__":"up","job":"prometheus"},"values":[[1,"1"],[61,"0"]]}
+		]}}`))
+	}))
+	defer srv.Close()
+
+	source, err := NewQueryRangeSource(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := time.Unix(300, 0)
+	it, err := source.Read(&pb.DurationSpan{}, end.Add(-5*time.Minute), end,
+		pb.Matcher{Name: pb.MetricLabelName, Type: pb.LabelMatcher_EQ, Value: "up"},
+		pb.Matcher{Name: pb.MetricLabelName, Type: pb.LabelMatcher_NRE, Value: ".+:downsample_.+"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{__name__!~".+:downsample_.+",__name__="up"}[5m]`; gotQuery != want {
+		t.Fatalf("got query %s, want %s", gotQuery, want)
+	}
+
+	if !it.Next() {
+		t.Fatal("expected one series")
+	}
+	ts := it.At()
+	if len(ts.Labels) != 2 || ts.Labels[0].Name != pb.MetricLabelName || ts.Labels[1].Value != "prometheus" {
+		t.Fatalf("unexpected labels %v", ts.Labels)
+	}
+	if len(ts.Points) != 2 || ts.Points[1].Timestamp != 61000 || ts.Points[1].Value != 0 {
+		t.Fatalf("unexpected points %v", ts.Points)
+	}
+	if it.Next() {
+		t.Fatal("expected only one series")
+	}
+}
+
+func TestQueryRangeSourcePushdown(t *testing.T) {
+	var gotQuery string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v1/label/__name__/values":
+			w.Write([]byte(`{"status":"success","data":["up"]}`))
+		case "/api/v1/query":
+			gotQuery = r.Form.Get("query")
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+				{"metric":{"job":"prometheus"},"value":[300,"3"]}
+			]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	source, err := NewQueryRangeSource(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if supported, final := source.PushdownAgg("p99"); supported || !final {
+		t.Fatal("p99 should not be pushed down")
+	}
+
+	end := time.Unix(300, 0)
+	it, err := source.ReadPushdown(&pb.DurationSpan{}, end.Add(-5*time.Minute), end, "max",
+		pb.Matcher{Name: "job", Type: pb.LabelMatcher_EQ, Value: "prometheus"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `max_over_time({__name__="up",job="prometheus"}[5m])`; gotQuery != want {
+		t.Fatalf("got query %s, want %s", gotQuery, want)
+	}
+
+	if !it.Next() {
+		t.Fatal("expected one series")
+	}
+	ts := it.At()
+	if ts.Labels[0].Name != pb.MetricLabelName || ts.Labels[0].Value != "up" {
+		t.Fatalf("metric name not restored: %v", ts.Labels)
+	}
+	if len(ts.Points) != 1 || ts.Points[0].Value != 3 {
+		t.Fatalf("unexpected points %v", ts.Points)
+	}
+}
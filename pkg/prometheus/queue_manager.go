@@ -0,0 +1,481 @@
+package prometheus
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCapacity          = 10000
+	defaultMinShards         = 1
+	defaultMaxShards         = 50
+	defaultMaxSamplesPerSend = 2000
+	defaultMaxBytesPerSend   = 4 << 20
+	defaultBatchSendDeadline = 5 * time.Second
+	defaultMinBackoff        = 30 * time.Millisecond
+	defaultMaxBackoff        = 5 * time.Second
+
+	// 以下参数与 prometheus QueueManager 保持一致
+	shardUpdateDuration    = 10 * time.Second
+	shardToleranceFraction = 0.3
+	ewmaWeight             = 0.2
+)
+
+// QueueConfig 是写出队列的配置, 含义与 prometheus remote_write.queue_config 一致
+type QueueConfig struct {
+	// 每个 shard 队列中缓存的序列数
+	Capacity  int
+	MinShards int
+	MaxShards int
+	// 单次写出的样本数和字节数 (未压缩) 上限, 任意一个达到上限即写出
+	MaxSamplesPerSend int
+	MaxBytesPerSend   int
+	// shard 中的数据最长等待多久写出
+	BatchSendDeadline time.Duration
+	// 可恢复错误重试的初始退避时间, 每次重试翻倍直到 MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func (c QueueConfig) withDefaults() QueueConfig {
+	if c.Capacity <= 0 {
+		c.Capacity = defaultCapacity
+	}
+	if c.MinShards <= 0 {
+		c.MinShards = defaultMinShards
+	}
+	if c.MaxShards <= 0 {
+		c.MaxShards = defaultMaxShards
+	}
+	if c.MaxShards < c.MinShards {
+		c.MaxShards = c.MinShards
+	}
+	if c.MaxSamplesPerSend <= 0 {
+		c.MaxSamplesPerSend = defaultMaxSamplesPerSend
+	}
+	if c.MaxBytesPerSend <= 0 {
+		c.MaxBytesPerSend = defaultMaxBytesPerSend
+	}
+	if c.BatchSendDeadline <= 0 {
+		c.BatchSendDeadline = defaultBatchSendDeadline
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = defaultMinBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = c.MinBackoff
+	}
+	return c
+}
+
+// QueueManager 将输入的序列按 label hash 分配到多个 shard 中, 每个 shard 按样本数/字节数/超时攒批后写出
+// shard 数量根据输入速率、写出耗时和积压的样本数动态调整, 算法与 prometheus QueueManager 一致
+type QueueManager struct {
+	name string
+	cfg  QueueConfig
+	send func(ctx context.Context, batch []prompb.TimeSeries) error
+	// group 不为空时, 同一组的序列分配到同一个 shard 并且总是在同一次请求中写出
+	group func(batch []prompb.TimeSeries) []seriesGroup
+
+	ctx  context.Context
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	// 调整 shard 数量时持有写锁替换 shard, 旧的 shard 在锁外写完, 新的 shard 等旧的写完后才开始写出
+	lock   sync.RWMutex
+	shards *shards
+
+	samplesIn          *ewmaRate
+	samplesOut         *ewmaRate
+	samplesOutDuration *ewmaRate
+	samplesPending     atomic.Int64
+	lastSendTimestamp  atomic.Int64
+}
+
+func NewQueueManager(
+	name string,
+	cfg QueueConfig,
+	send func(ctx context.Context, batch []prompb.TimeSeries) error,
+) *QueueManager {
+	return &QueueManager{
+		name:               name,
+		cfg:                cfg.withDefaults(),
+		send:               send,
+		quit:               make(chan struct{}),
+		samplesIn:          newEWMARate(),
+		samplesOut:         newEWMARate(),
+		samplesOutDuration: newEWMARate(),
+	}
+}
+
+func (qm *QueueManager) Start(ctx context.Context) {
+	qm.ctx = ctx
+	qm.lastSendTimestamp.Store(time.Now().Unix())
+	ready := make(chan struct{})
+	close(ready)
+	qm.shards = qm.newShards(qm.cfg.MinShards, ready)
+
+	qm.wg.Add(1)
+	go qm.updateShardsLoop()
+}
+
+// Stop 停止调整 shard 数量, 并等待所有 shard 中缓存的数据写出
+func (qm *QueueManager) Stop() {
+	close(qm.quit)
+	qm.wg.Wait()
+
+	qm.lock.Lock()
+	qm.shards.stop()
+	qm.lock.Unlock()
+}
+
+// Append 将 batch 中的序列放入 shard 队列, 队列满时阻塞
+// done 不为空时, 在 batch 中所有序列都写出 (或因不可恢复的错误丢弃) 后调用
+// ctx 结束时返回 ctx.Err(), 未写出的序列不会调用 done
+func (qm *QueueManager) Append(ctx context.Context, batch []prompb.TimeSeries, done func()) error {
+	if len(batch) == 0 {
+		if done != nil {
+			done()
+		}
+		return nil
+	}
+
+	var groups []seriesGroup
+	if qm.group != nil {
+		groups = qm.group(batch)
+	} else {
+		groups = make([]seriesGroup, 0, len(batch))
+		for i := range batch {
+			// 不引用 batch 的底层数组, 调用方可以在返回后复用 batch
+			groups = append(groups, seriesGroup{hash: labelsHash(batch[i].Labels), series: []prompb.TimeSeries{batch[i]}})
+		}
+	}
+
+	tracker := &batchTracker{done: done}
+	tracker.remaining.Store(int64(len(groups)))
+
+	qm.lock.RLock()
+	defer qm.lock.RUnlock()
+
+	for i, g := range groups {
+		n := int64(batchSamples(g.series))
+		qm.samplesPending.Add(n)
+		if !qm.shards.enqueue(ctx, queueEntry{hash: g.hash, series: g.series, tracker: tracker}) {
+			var dropped int
+			for _, g := range groups[i:] {
+				dropped += batchSamples(g.series)
+			}
+			qm.samplesPending.Add(-int64(dropped))
+			droppedSamplesTotal.WithLabelValues(qm.name).Add(float64(dropped))
+			return ctx.Err()
+		}
+		qm.samplesIn.incr(n)
+	}
+	return nil
+}
+
+func (qm *QueueManager) updateShardsLoop() {
+	defer qm.wg.Done()
+
+	ticker := time.NewTicker(shardUpdateDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-qm.quit:
+			return
+		case <-ticker.C:
+			qm.samplesIn.tick()
+			qm.samplesOut.tick()
+			qm.samplesOutDuration.tick()
+
+			desired := qm.calculateDesiredShards()
+			if !qm.shouldReshard(desired) {
+				continue
+			}
+			qm.reshard(desired)
+		}
+	}
+}
+
+func (qm *QueueManager) numShards() int {
+	qm.lock.RLock()
+	defer qm.lock.RUnlock()
+	return len(qm.shards.queues)
+}
+
+// shouldReshard 最近一段时间没有写出成功过时不调整, 避免写入目标故障时 shard 数量被无意义地拉满
+func (qm *QueueManager) shouldReshard(desired int) bool {
+	if desired == qm.numShards() {
+		return false
+	}
+
+	lastSend := time.Unix(qm.lastSendTimestamp.Load(), 0)
+	if time.Since(lastSend) > 2*shardUpdateDuration {
+		logrus.WithFields(logrus.Fields{
+			"target":    qm.name,
+			"last_send": lastSend,
+		}).Warnln("skip resharding, remote write is failing")
+		return false
+	}
+	return true
+}
+
+// calculateDesiredShards 根据每个样本的平均写出耗时, 计算消化输入速率和积压样本所需的 shard 数量
+func (qm *QueueManager) calculateDesiredShards() int {
+	current := qm.numShards()
+
+	var (
+		inRate      = qm.samplesIn.rate()
+		outRate     = qm.samplesOut.rate()
+		outDuration = qm.samplesOutDuration.rate() / float64(time.Second)
+		pending     = float64(qm.samplesPending.Load())
+	)
+	pendingSamplesGauge.WithLabelValues(qm.name).Set(pending)
+	if outRate <= 0 {
+		return current
+	}
+
+	// 积压的样本在接下来的若干个调整周期内逐渐消化
+	integralGain := 0.1 / shardUpdateDuration.Seconds()
+	timePerSample := outDuration / outRate
+	desired := timePerSample * (inRate + integralGain*pending)
+	desiredShardsGauge.WithLabelValues(qm.name).Set(desired)
+
+	// 变化在容忍范围内时不调整, 避免 shard 数量频繁抖动
+	lower := float64(current) * (1 - shardToleranceFraction)
+	upper := float64(current) * (1 + shardToleranceFraction)
+	if lower <= desired && desired <= upper {
+		return current
+	}
+
+	n := int(math.Ceil(desired))
+	if n < qm.cfg.MinShards {
+		n = qm.cfg.MinShards
+	} else if n > qm.cfg.MaxShards {
+		n = qm.cfg.MaxShards
+	}
+	return n
+}
+
+func (qm *QueueManager) reshard(n int) {
+	logrus.WithFields(logrus.Fields{
+		"target": qm.name,
+		"from":   qm.numShards(),
+		"to":     n,
+	}).Warnln("remote write resharding")
+
+	// 锁内只替换 shard, Append 不会等待旧 shard 写完; 此后不会再有数据进入旧 shard, 可以在锁外关闭
+	ready := make(chan struct{})
+	qm.lock.Lock()
+	old := qm.shards
+	qm.shards = qm.newShards(n, ready)
+	qm.lock.Unlock()
+
+	// 新 shard 在旧 shard 写完之前只缓存数据, 保证同一序列的样本按顺序写出
+	old.stop()
+	close(ready)
+}
+
+// seriesGroup 是需要在同一次请求中写出的一组序列, hash 决定分配到哪个 shard
+type seriesGroup struct {
+	hash   uint64
+	series []prompb.TimeSeries
+}
+
+type queueEntry struct {
+	hash    uint64
+	series  []prompb.TimeSeries
+	tracker *batchTracker
+}
+
+func (e queueEntry) size() int {
+	var size int
+	for i := range e.series {
+		size += e.series[i].Size()
+	}
+	return size
+}
+
+// batchTracker 记录一个输入 batch 中还有多少组序列没有写出, 全部写出后调用 done
+type batchTracker struct {
+	remaining atomic.Int64
+	done      func()
+}
+
+func (t *batchTracker) finish() {
+	if t.remaining.Add(-1) == 0 && t.done != nil {
+		t.done()
+	}
+}
+
+type shards struct {
+	qm     *QueueManager
+	queues []chan queueEntry
+	wg     sync.WaitGroup
+	// 关闭后才开始写出, 即上一组 shard 已经写完
+	ready <-chan struct{}
+}
+
+func (qm *QueueManager) newShards(n int, ready <-chan struct{}) *shards {
+	s := &shards{qm: qm, queues: make([]chan queueEntry, n), ready: ready}
+	s.wg.Add(n)
+	for i := range s.queues {
+		s.queues[i] = make(chan queueEntry, qm.cfg.Capacity)
+		go s.runShard(s.queues[i])
+	}
+
+	shardsGauge.WithLabelValues(qm.name).Set(float64(n))
+	return s
+}
+
+// enqueue 同一个序列总是分配到同一个 shard, 保证序列内样本的写出顺序
+func (s *shards) enqueue(ctx context.Context, e queueEntry) bool {
+	queue := s.queues[e.hash%uint64(len(s.queues))]
+	select {
+	case <-ctx.Done():
+		return false
+	case queue <- e:
+		return true
+	}
+}
+
+// stop 关闭所有 shard 队列, 等待队列中剩余的数据写出
+func (s *shards) stop() {
+	for _, queue := range s.queues {
+		close(queue)
+	}
+	s.wg.Wait()
+}
+
+func (s *shards) runShard(queue chan queueEntry) {
+	defer s.wg.Done()
+
+	var (
+		qm      = s.qm
+		pending = make([]queueEntry, 0, qm.cfg.MaxSamplesPerSend)
+		batch   = make([]prompb.TimeSeries, 0, qm.cfg.MaxSamplesPerSend)
+		samples int
+		bytes   int
+	)
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+
+		batch = batch[:0]
+		for _, e := range pending {
+			batch = append(batch, e.series...)
+		}
+
+		begin := time.Now()
+		err := qm.send(qm.ctx, batch)
+		qm.samplesOutDuration.incr(int64(time.Since(begin)))
+		qm.samplesOut.incr(int64(samples))
+		qm.samplesPending.Add(-int64(samples))
+		if err == nil {
+			qm.lastSendTimestamp.Store(time.Now().Unix())
+		}
+
+		// ctx 结束导致没有写出的数据不确认
+		if err == nil || qm.ctx.Err() == nil {
+			for _, e := range pending {
+				e.tracker.finish()
+			}
+		}
+
+		pending = pending[:0]
+		samples, bytes = 0, 0
+	}
+
+	// 队列有缓冲, 等待期间 Append 仍然可以写入
+	<-s.ready
+
+	timer := time.NewTimer(qm.cfg.BatchSendDeadline)
+	defer timer.Stop()
+
+	for {
+		select {
+		case e, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			// 一组序列不会被拆分到多次请求中
+			size := e.size()
+			if bytes+size > qm.cfg.MaxBytesPerSend {
+				flush()
+			}
+
+			pending = append(pending, e)
+			samples += batchSamples(e.series)
+			bytes += size
+			if samples >= qm.cfg.MaxSamplesPerSend || bytes >= qm.cfg.MaxBytesPerSend {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(qm.cfg.BatchSendDeadline)
+		}
+	}
+}
+
+func labelsHash(lbs []prompb.Label) uint64 {
+	h := fnv.New64a()
+	for _, l := range lbs {
+		h.Write([]byte(l.Name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(l.Value))
+		h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+// ewmaRate 每个 shardUpdateDuration 周期计算一次指数加权平均速率
+type ewmaRate struct {
+	newEvents atomic.Int64
+
+	lock     sync.Mutex
+	lastRate float64
+	init     bool
+}
+
+func newEWMARate() *ewmaRate {
+	return &ewmaRate{}
+}
+
+func (r *ewmaRate) incr(n int64) {
+	r.newEvents.Add(n)
+}
+
+func (r *ewmaRate) rate() float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lastRate
+}
+
+func (r *ewmaRate) tick() {
+	newEvents := r.newEvents.Swap(0)
+	instantRate := float64(newEvents) / shardUpdateDuration.Seconds()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.init {
+		r.lastRate += ewmaWeight * (instantRate - r.lastRate)
+	} else if newEvents > 0 {
+		r.init = true
+		r.lastRate = instantRate
+	}
+}
@@ -0,0 +1,189 @@
+package prometheus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestQueueManagerBatching(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		batches []int
+	)
+	qm := NewQueueManager("test", QueueConfig{
+		MinShards:         2,
+		MaxShards:         2,
+		MaxSamplesPerSend: 3,
+		BatchSendDeadline: time.Hour,
+	}, func(_ context.Context, batch []prompb.TimeSeries) error {
+		lock.Lock()
+		batches = append(batches, len(batch))
+		lock.Unlock()
+		return nil
+	})
+	qm.Start(context.Background())
+
+	done := make(chan struct{})
+	if err := qm.Append(context.Background(), testInstances(20, 1), func() { close(done) }); err != nil {
+		t.Fatal(err)
+	}
+	// 剩余不足 max_samples_per_send 的数据在 Stop 时写出
+	qm.Stop()
+
+	select {
+	case <-done:
+	default:
+		t.Fatal("batch not acknowledged")
+	}
+
+	var total int
+	for _, n := range batches {
+		if n > 3 {
+			t.Fatalf("batch of %d series exceeds max_samples_per_send", n)
+		}
+		total += n
+	}
+	if total != 20 {
+		t.Fatalf("got %d series sent, want 20", total)
+	}
+}
+
+func TestQueueManagerMaxBytes(t *testing.T) {
+	batch := testInstances(10, 1)
+	size := batch[0].Size()
+
+	var sizes []int
+	qm := NewQueueManager("test", QueueConfig{
+		MaxShards:       1,
+		MaxBytesPerSend: 2*size + 1,
+	}, func(_ context.Context, batch []prompb.TimeSeries) error {
+		var n int
+		for _, ts := range batch {
+			n += ts.Size()
+		}
+		sizes = append(sizes, n)
+		return nil
+	})
+	qm.Start(context.Background())
+	qm.Append(context.Background(), batch, nil)
+	qm.Stop()
+
+	if len(sizes) != 5 {
+		t.Fatalf("got %d sends, want 5", len(sizes))
+	}
+	for _, n := range sizes {
+		if n > 2*size+1 {
+			t.Fatalf("send of %d bytes exceeds max_bytes_per_send", n)
+		}
+	}
+}
+
+func TestQueueManagerDeadline(t *testing.T) {
+	sent := make(chan int, 1)
+	qm := NewQueueManager("test", QueueConfig{
+		BatchSendDeadline: 10 * time.Millisecond,
+	}, func(_ context.Context, batch []prompb.TimeSeries) error {
+		sent <- len(batch)
+		return nil
+	})
+	qm.Start(context.Background())
+	defer qm.Stop()
+
+	qm.Append(context.Background(), testInstances(1, 1), nil)
+	select {
+	case n := <-sent:
+		if n != 1 {
+			t.Fatalf("got %d series, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch not flushed on deadline")
+	}
+}
+
+func TestCalculateDesiredShards(t *testing.T) {
+	qm := NewQueueManager("test", QueueConfig{MinShards: 1, MaxShards: 10}, nil)
+	qm.shards = &shards{queues: make([]chan queueEntry, 1)}
+
+	// 每秒输入 1000 个样本, 每个样本写出耗时 5ms, 需要 5 个 shard
+	perTick := int64(shardUpdateDuration.Seconds())
+	qm.samplesIn.incr(1000 * perTick)
+	qm.samplesOut.incr(1000 * perTick)
+	qm.samplesOutDuration.incr(int64(5*time.Second) * perTick)
+	qm.samplesIn.tick()
+	qm.samplesOut.tick()
+	qm.samplesOutDuration.tick()
+
+	if n := qm.calculateDesiredShards(); n != 5 {
+		t.Fatalf("got %d desired shards, want 5", n)
+	}
+
+	// 积压的样本需要更多的 shard, 但不能超过 max_shards
+	qm.samplesPending.Store(1000000)
+	if n := qm.calculateDesiredShards(); n != 10 {
+		t.Fatalf("got %d desired shards, want 10", n)
+	}
+}
+
+func TestQueueManagerReshard(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		sent    []int64
+		release = make(chan struct{})
+	)
+	qm := NewQueueManager("test", QueueConfig{
+		MinShards:         1,
+		MaxShards:         4,
+		MaxSamplesPerSend: 1,
+	}, func(_ context.Context, batch []prompb.TimeSeries) error {
+		lock.Lock()
+		sent = append(sent, batch[0].Samples[0].Timestamp)
+		first := len(sent) == 1
+		lock.Unlock()
+		if first {
+			<-release
+		}
+		return nil
+	})
+	qm.Start(context.Background())
+
+	if err := qm.Append(context.Background(), testInstances(1, 1), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧 shard 写出阻塞时, 替换 shard 不需要等待旧 shard 写完
+	go qm.reshard(2)
+	for deadline := time.Now().Add(time.Second); qm.numShards() != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("shards not swapped while old shards are draining")
+		}
+	}
+	appended := make(chan error, 1)
+	go func() { appended <- qm.Append(context.Background(), testInstances(1, 2), nil) }()
+	select {
+	case err := <-appended:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("append blocked by draining shards")
+	}
+
+	// 新 shard 在旧 shard 写完之前不写出
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	n := len(sent)
+	lock.Unlock()
+	if n != 1 {
+		t.Fatalf("got %d sends before old shards drained, want 1", n)
+	}
+
+	close(release)
+	qm.Stop()
+	if len(sent) != 2 || sent[0] != 1 || sent[1] != 2 {
+		t.Fatalf("unexpected send order %v", sent)
+	}
+}
@@ -6,10 +6,24 @@ import (
 	"prom-stream-downsample/pkg/pb"
 )
 
-func (p *Prometheus) RemoteRead(
+// Source 是 downsample 原始数据的读取端, 每个 job 可以单独指定使用的 Source
+type Source interface {
+	// Read 读取 [start, end] 时间范围内匹配 matchers 的原始数据
+	Read(span *pb.DurationSpan, start, end time.Time, matchers ...pb.Matcher) (Iterator, error)
+	// Type 返回读取方式, 用于日志和打点
+	Type() string
+}
+
+// Read 通过 remote read 读取原始数据
+func (p *Prometheus) Read(
 	span *pb.DurationSpan,
-	interval time.Duration,
+	start time.Time,
+	end time.Time,
 	matchers ...pb.Matcher,
 ) (Iterator, error) {
-	return p.remoteReadV2(span, interval, matchers...)
+	return p.remoteReadV2(span, start, end, matchers...)
+}
+
+func (p *Prometheus) Type() string {
+	return p.RemoteReadType()
 }
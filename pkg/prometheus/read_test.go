@@ -39,7 +39,7 @@ func TestRemoteRead(t *testing.T) {
 	}
 
 	rc, err := remote.NewReadClient("read-0", &remote.ClientConfig{
-		URL:     &config.URL{u},
+		URL:     &config.URL{URL: u},
 		Timeout: model.Duration(10 * time.Second),
 	})
 	if err != nil {
@@ -47,7 +47,7 @@ func (p *Prometheus) remoteReadV1(
 		},
 	}
 
-	if p.enabledStream {
+	if len(p.endpoints) > 0 && p.endpoints[0].streamed() {
 		// append流式请求协议支持
 		req.AcceptedResponseTypes = append(req.AcceptedResponseTypes, prompb.ReadRequest_STREAMED_XOR_CHUNKS)
 	}
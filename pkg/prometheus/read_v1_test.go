@@ -15,7 +15,7 @@ import (
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
 )
 
-func TestRemoteRead(t *testing.T) {
+func TestRemoteReadV1(t *testing.T) {
 	//p := Prometheus{
 	//	remoteReadGroup: "http://172.18.12.38:9090/api/v1/read",
 	//	enabledStream: false,
@@ -39,7 +39,7 @@ func TestRemoteRead(t *testing.T) {
 	}
 
 	rc, err := remote.NewReadClient("read-0", &remote.ClientConfig{
-		URL:     &config.URL{u},
+		URL:     &config.URL{URL: u},
 		Timeout: model.Duration(10 * time.Second),
 	})
 	if err != nil {
@@ -2,22 +2,28 @@ package prometheus
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
 
 	"prom-stream-downsample/pkg/pb"
 )
 
 func (p *Prometheus) remoteReadV2(
 	span *pb.DurationSpan,
-	interval time.Duration,
+	start time.Time,
+	end time.Time,
 	matchers ...pb.Matcher,
 ) (Iterator, error) {
-	end := time.Now()
-	start := end.Add(-interval)
+	mtcs := toLabelMatchers(matchers)
+	return p.chunkRemoteReadV2(span, start, end, mtcs, nil)
+}
 
+func toLabelMatchers(matchers []pb.Matcher) []*labels.Matcher {
 	var mtcs []*labels.Matcher
 	for _, matcher := range matchers {
 		var matchType labels.MatchType
@@ -39,55 +45,75 @@ func (p *Prometheus) remoteReadV2(
 				matcher.Value,
 			))
 	}
+	return mtcs
+}
 
-	if p.enabledStream {
-		return p.streamRemoteReadV2(span, start, end, mtcs)
-		//return p.sampleRemoteReadV2(span, start, end, mtcs)
-	} else {
-		return p.sampleRemoteReadV2(span, start, end, mtcs)
+// chunkRemoteReadV2 对所有 remote read 地址发起查询, 每个地址按各自协商的响应类型读取
+// sample 响应会被转换为 chunk, 最后统一合并去重
+// hints 不为空时会随请求一起发送, 由后端决定是否使用
+func (p *Prometheus) chunkRemoteReadV2(
+	span *pb.DurationSpan,
+	start time.Time,
+	end time.Time,
+	mtcs []*labels.Matcher,
+	hints *storage.SelectHints,
+) (Iterator, error) {
+	query, err := remote.ToQuery(start.UnixMilli(), end.UnixMilli(), mtcs, hints)
+	if err != nil {
+		return nil, err
 	}
+
+	// streamed 响应在迭代时才读取, ctx 在迭代结束或 Close 后取消
+	// 超时只限制请求和响应头, 迭代期间可能因为写入端背压长时间阻塞, 不能计入超时
+	ctx, cancel := context.WithCancel(context.TODO())
+	timer := time.AfterFunc(readRequestTimeout, cancel)
+	queryStart := time.Now()
+	css, err := p.ReadQuery(ctx, query)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	span.QueryDuration = time.Since(queryStart).Seconds()
+	return &StreamIterator{css: css, cancel: cancel}, nil
 }
 
-func (p *Prometheus) streamRemoteReadV2(span *pb.DurationSpan, start time.Time, end time.Time, mtcs []*labels.Matcher) (Iterator, error) {
-	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
-	defer cancel()
+// readRequestTimeout 是 remote read 请求到收到响应头的超时时间
+const readRequestTimeout = 30 * time.Second
 
-	queriers := make([]storage.ChunkQuerier, 0, len(p.queryables))
-	for _, queryable := range p.queryables {
-		q, err := queryable.ChunkQuerier(ctx, start.UnixMilli(), end.UnixMilli())
+// ReadQuery 对所有 remote read 地址执行 query, 返回合并去重后的结果
+// 结果按需从响应中读取, 调用方需要在迭代完成之前保持 ctx 有效; 返回的结果实现了 io.Closer, 提前结束迭代时关闭未读完的响应
+func (p *Prometheus) ReadQuery(ctx context.Context, query *prompb.Query) (storage.ChunkSeriesSet, error) {
+	sets := make([]storage.ChunkSeriesSet, 0, len(p.endpoints))
+	for _, ep := range p.endpoints {
+		set, err := ep.read(ctx, query)
 		if err != nil {
+			closeChunkSeriesSets(sets)
 			return nil, err
 		}
-		queriers = append(queriers, q)
+		sets = append(sets, set)
 	}
+	return &mergedChunkSeriesSet{
+		ChunkSeriesSet: storage.NewMergeChunkSeriesSet(sets, storage.NewCompactingChunkSeriesMerger(storage.ChainedSeriesMerge)),
+		sets:           sets,
+	}, nil
+}
 
-	ss := storage.NewMergeChunkQuerier(nil, queriers, storage.NewConcatenatingChunkSeriesMerger()).Select(
-		false,
-		nil,
-		mtcs...,
-	)
-
-	return &StreamIterator{css: ss}, nil
+// mergedChunkSeriesSet 在合并结果之外保留每个地址的结果, 用于关闭
+type mergedChunkSeriesSet struct {
+	storage.ChunkSeriesSet
+	sets []storage.ChunkSeriesSet
 }
 
-func (p *Prometheus) sampleRemoteReadV2(span *pb.DurationSpan, start, end time.Time, matchers []*labels.Matcher) (Iterator, error) {
-	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
-	defer cancel()
+func (m *mergedChunkSeriesSet) Close() error {
+	closeChunkSeriesSets(m.sets)
+	return nil
+}
 
-	queriers := make([]storage.Querier, 0, len(p.queryables))
-	for _, queryable := range p.queryables {
-		q, err := queryable.Querier(ctx, start.UnixMilli(), end.UnixMilli())
-		if err != nil {
-			return nil, err
+func closeChunkSeriesSets(sets []storage.ChunkSeriesSet) {
+	for _, set := range sets {
+		if c, ok := set.(io.Closer); ok {
+			c.Close()
 		}
-		queriers = append(queriers, q)
 	}
-
-	ss := storage.NewMergeQuerier(nil, queriers, storage.ChainedSeriesMerge).Select(
-		false,
-		nil,
-		matchers...,
-	)
-
-	return &SampleIterator{ss: ss}, nil
 }
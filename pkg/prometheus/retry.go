@@ -0,0 +1,115 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+// RecoverableError 表示可以重试的写出错误, 如网络错误/5xx/429
+// retryAfter 大于 0 时使用服务端通过 Retry-After 指定的等待时间代替退避时间
+type RecoverableError struct {
+	error
+	retryAfter time.Duration
+}
+
+func (e RecoverableError) Unwrap() error {
+	return e.error
+}
+
+func isRecoverable(err error) (time.Duration, bool) {
+	var re RecoverableError
+	if errors.As(err, &re) {
+		return re.retryAfter, true
+	}
+	return 0, false
+}
+
+// retryAfterDuration 解析 Retry-After 响应头, 支持秒数和 http 时间两种格式
+func retryAfterDuration(v string) time.Duration {
+	if len(v) == 0 {
+		return 0
+	}
+	if sec, err := strconv.Atoi(v); err == nil {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// maxRetryAfter 是 Retry-After 的上限, 只用于防止异常的响应头使 shard 长时间停止写出
+const maxRetryAfter = time.Hour
+
+// retryDelay 返回下一次重试前的等待时间, 服务端指定了 Retry-After 时按服务端的时间等待, 不受 MaxBackoff 限制
+func retryDelay(backoff, retryAfter time.Duration) time.Duration {
+	if retryAfter <= 0 {
+		return backoff
+	}
+	return min(retryAfter, maxRetryAfter)
+}
+
+func batchSamples(batch []prompb.TimeSeries) int {
+	var n int
+	for _, ts := range batch {
+		n += len(ts.Samples)
+	}
+	return n
+}
+
+// send 写出一个 batch, 可恢复错误按指数退避一直重试, 直到成功 或 ctx 结束
+// 不可恢复的错误直接返回, 对应的数据被丢弃
+func (t *WriteTarget) send(ctx context.Context, batch []prompb.TimeSeries) error {
+	var (
+		samples = batchSamples(batch)
+		backoff = t.queueConfig.MinBackoff
+		name    = t.name
+	)
+
+	for {
+		err := t.sink.Send(batch)
+		if err == nil {
+			sentSamplesTotal.WithLabelValues(name).Add(float64(samples))
+			return nil
+		}
+
+		retryAfter, ok := isRecoverable(err)
+		if !ok {
+			failedSamplesTotal.WithLabelValues(name).Add(float64(samples))
+			logrus.WithFields(logrus.Fields{
+				"target":  name,
+				"samples": samples,
+				"error":   err,
+			}).Errorln("sink send failed, non-recoverable error, drop samples")
+			return err
+		}
+
+		sleep := retryDelay(backoff, retryAfter)
+
+		retriedSamplesTotal.WithLabelValues(name).Add(float64(samples))
+		logrus.WithFields(logrus.Fields{
+			"target":  name,
+			"samples": samples,
+			"backoff": sleep,
+			"error":   err,
+		}).Warnln("sink send failed, retry later")
+
+		select {
+		case <-ctx.Done():
+			droppedSamplesTotal.WithLabelValues(name).Add(float64(samples))
+			return ctx.Err()
+		case <-time.After(sleep):
+		}
+
+		backoff *= 2
+		if backoff > t.queueConfig.MaxBackoff {
+			backoff = t.queueConfig.MaxBackoff
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+func TestSendRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int
+		calls    int32
+		wantErr  bool
+	}{
+		{name: "success", statuses: []int{200}, calls: 1},
+		{name: "retry 5xx and 429", statuses: []int{503, 429, 204}, calls: 3},
+		{name: "drop 4xx", statuses: []int{400, 200}, calls: 1, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := atomic.AddInt32(&calls, 1) - 1
+				w.WriteHeader(tc.statuses[i])
+			}))
+			defer srv.Close()
+
+			target := NewWriteTarget(
+				"test",
+				NewRemoteWriteSink(srv.URL, Auth{}, pb.RemoteWriteProtoMsgV1, nil),
+				nil,
+				QueueConfig{MinBackoff: time.Millisecond},
+				TargetFilter{},
+			)
+			err := target.send(context.Background(), testInstances(1, 0))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if calls != tc.calls {
+				t.Fatalf("got %d calls, want %d", calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestRetryAfterHonoured(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	target := NewWriteTarget(
+		"test",
+		NewRemoteWriteSink(srv.URL, Auth{}, pb.RemoteWriteProtoMsgV1, nil),
+		nil,
+		QueueConfig{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+		TargetFilter{},
+	)
+	// Retry-After 超过 max_backoff 时仍然按服务端指定的时间等待
+	begin := time.Now()
+	if err := target.send(context.Background(), testInstances(1, 0)); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("got %d calls, want 2", calls)
+	}
+	if elapsed := time.Since(begin); elapsed < time.Second {
+		t.Fatalf("retried after %s, want at least 1s", elapsed)
+	}
+
+	if d := retryDelay(time.Millisecond, 24*time.Hour); d != maxRetryAfter {
+		t.Fatalf("got delay %s, want %s", d, maxRetryAfter)
+	}
+	if d := retryDelay(time.Millisecond, 0); d != time.Millisecond {
+		t.Fatalf("got delay %s, want backoff", d)
+	}
+}
+
+func TestRetryAfterDuration(t *testing.T) {
+	if d := retryAfterDuration("3"); d != 3*time.Second {
+		t.Fatalf("got %s, want 3s", d)
+	}
+	at := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := retryAfterDuration(at); d <= 0 || d > time.Minute {
+		t.Fatalf("unexpected duration %s for %s", d, at)
+	}
+	if d := retryAfterDuration("soon"); d != 0 {
+		t.Fatalf("got %s, want 0", d)
+	}
+}
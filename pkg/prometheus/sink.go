@@ -0,0 +1,150 @@
+package prometheus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// Sink 是 downsample 结果的写出端
+type Sink interface {
+	Name() string
+	// Send 写出一批序列, 调用方在 Send 返回后会复用 batch, 需要异步使用的实现要自行拷贝
+	Send(batch []prompb.TimeSeries) error
+	// Close 在写入结束时调用, 用于写出缓存中剩余的数据
+	Close() error
+}
+
+// Auth 是写出请求的认证信息, 为空的字段不生效
+type Auth struct {
+	Username    string
+	Password    string
+	BearerToken string
+	Headers     map[string]string
+}
+
+func (a Auth) apply(req *http.Request) {
+	for k, v := range a.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if len(a.Username) > 0 {
+		req.SetBasicAuth(a.Username, a.Password)
+	} else if len(a.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+a.BearerToken)
+	}
+}
+
+// RemoteWriteSink 通过 prometheus remote write 协议写出
+// 配置为 remote write 2.0 时, 如果接收端返回 415 说明不支持, 回退到 1.0 协议
+// 降采样指标的元数据在 1.0 中通过 WriteRequest.Metadata 发送, 在 2.0 中附在每个序列上
+type RemoteWriteSink struct {
+	url      string
+	auth     Auth
+	client   *http.Client
+	metadata *MetadataCache
+
+	v2 atomic.Bool
+}
+
+func NewRemoteWriteSink(url string, auth Auth, protoMsg string, metadata *MetadataCache) *RemoteWriteSink {
+	r := &RemoteWriteSink{
+		url:      url,
+		auth:     auth,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		metadata: metadata,
+	}
+	r.v2.Store(protoMsg == pb.RemoteWriteProtoMsgV2)
+	return r
+}
+
+func (r *RemoteWriteSink) Name() string {
+	return "remote_write"
+}
+
+func (r *RemoteWriteSink) Close() error {
+	return nil
+}
+
+func (r *RemoteWriteSink) Send(batch []prompb.TimeSeries) (err error) {
+	defer func() {
+		if err == nil {
+			logrus.Warnln("remote write series success", len(batch))
+		}
+	}()
+
+	if r.v2.Load() {
+		err = r.send(marshalWriteRequestV2(batch, r.metadata), remoteWriteContentTypeV2, remoteWriteVersionV2)
+		if !errors.Is(err, errUnsupportedMediaType) {
+			return err
+		}
+
+		r.v2.Store(false)
+		logrus.WithFields(logrus.Fields{
+			"url":   r.url,
+			"error": err,
+		}).Warnln("remote write 2.0 is not supported by receiver, fallback to 1.0")
+	}
+
+	marshal, err := proto.Marshal(&prompb.WriteRequest{
+		Timeseries: batch,
+		Metadata:   r.metadata.batchMetadata(batch),
+	})
+	if err != nil {
+		return err
+	}
+	return r.send(marshal, remoteWriteContentTypeV1, remoteWriteVersionV1)
+}
+
+func (r *RemoteWriteSink) send(data []byte, contentType, version string) error {
+	httpReq, err := http.NewRequest("POST", r.url, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return err
+	}
+
+	r.auth.apply(httpReq)
+	httpReq.Header.Add("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", contentType)
+	httpReq.Header.Set("User-Agent", "prom-remote-write-shard")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", version)
+
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		// 网络错误可以重试
+		return RecoverableError{error: err}
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 != 2 {
+		all, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("remote write status code %d: %s", resp.StatusCode, string(all))
+
+		if resp.StatusCode == http.StatusUnsupportedMediaType {
+			return fmt.Errorf("%w: %s", errUnsupportedMediaType, err)
+		}
+
+		// 与 prometheus 一致, 5xx 和 429 可以重试, 其它状态码说明数据本身有问题, 重试也不会成功
+		if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+			return RecoverableError{
+				error:      err,
+				retryAfter: retryAfterDuration(resp.Header.Get("Retry-After")),
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package prometheus
+
+import (
+	"github.com/prometheus/prometheus/prompb"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// TargetFilter 选择写入目标接收哪些降采样结果, 字段为空表示不按该维度过滤
+type TargetFilter struct {
+	Jobs         []string
+	Resolutions  []string
+	Aggregations []string
+}
+
+func contains(ss []string, s string) bool {
+	if len(ss) == 0 {
+		return true
+	}
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// filter 返回 batch 中需要写入该目标的序列, 返回的 slice 由调用方归还到 TimeSeriesPool
+// resolution 和聚合函数从降采样指标名中解析
+func (f TargetFilter) filter(batch pb.WriteBatch) []prompb.TimeSeries {
+	series := pb.TimeSeriesPool.Get().([]prompb.TimeSeries)
+	if !contains(f.Jobs, batch.Job) {
+		return series
+	}
+
+	for _, ts := range batch.Series {
+		if len(f.Resolutions) > 0 || len(f.Aggregations) > 0 {
+			var name string
+			for _, l := range ts.Labels {
+				if l.Name == pb.MetricLabelName {
+					name = l.Value
+					break
+				}
+			}
+
+			_, interval, agg, ok := pb.ParseDownSampleMetric(name)
+			if !ok || !contains(f.Resolutions, interval) || !contains(f.Aggregations, agg) {
+				continue
+			}
+		}
+		series = append(series, ts)
+	}
+	return series
+}
+
+// WriteTarget 是一个写入目标, 拥有独立的输入队列、wal、queue manager 和重试
+type WriteTarget struct {
+	name        string
+	sink        Sink
+	wal         *WALQueue
+	queueConfig QueueConfig
+	filter      TargetFilter
+
+	ch chan []prompb.TimeSeries
+	// 只在 Writer 分发协程中访问
+	stalled bool
+}
+
+func NewWriteTarget(name string, sink Sink, wal *WALQueue, qc QueueConfig, filter TargetFilter) *WriteTarget {
+	return &WriteTarget{
+		name:        name,
+		sink:        sink,
+		wal:         wal,
+		queueConfig: qc.withDefaults(),
+		filter:      filter,
+		ch:          make(chan []prompb.TimeSeries, targetQueueSize),
+	}
+}
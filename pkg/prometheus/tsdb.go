@@ -0,0 +1,132 @@
+package prometheus
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// TSDBSource 以只读方式打开本地的 prometheus TSDB 数据目录或单个 block 作为原始数据读取端
+// 用于对不再由 prometheus 提供服务的历史数据目录/快照做离线降采样
+// 只读取已经持久化的 block, 数据目录中 wal 里尚未落盘的数据不会被读取
+type TSDBSource struct {
+	path   string
+	blocks []tsdb.BlockReader
+	closer io.Closer
+
+	mint, maxt int64
+}
+
+func NewTSDBSource(path string) (*TSDBSource, error) {
+	s := &TSDBSource{path: path, mint: math.MaxInt64, maxt: math.MinInt64}
+
+	// 目录下存在 meta.json 说明是单个 block, 否则按照数据目录处理
+	if _, err := os.Stat(filepath.Join(path, "meta.json")); err == nil {
+		block, err := tsdb.OpenBlock(nil, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.blocks = []tsdb.BlockReader{block}
+		s.closer = block
+	} else {
+		db, err := tsdb.OpenDBReadOnly(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		blocks, err := db.Blocks()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		s.blocks = blocks
+		s.closer = db
+	}
+
+	if len(s.blocks) == 0 {
+		s.closer.Close()
+		return nil, fmt.Errorf("no blocks found in %s", path)
+	}
+
+	for _, b := range s.blocks {
+		meta := b.Meta()
+		if meta.MinTime < s.mint {
+			s.mint = meta.MinTime
+		}
+		if meta.MaxTime > s.maxt {
+			s.maxt = meta.MaxTime
+		}
+	}
+	return s, nil
+}
+
+func (s *TSDBSource) Type() string {
+	return pb.SourceTypeTSDB
+}
+
+// TimeRange 返回所有 block 覆盖的时间范围 [mint, maxt)
+func (s *TSDBSource) TimeRange() (time.Time, time.Time) {
+	return time.UnixMilli(s.mint), time.UnixMilli(s.maxt)
+}
+
+func (s *TSDBSource) Close() error {
+	return s.closer.Close()
+}
+
+// Read 读取 [start, end) 时间范围内的原始数据
+// 离线降采样时窗口首尾相接, 这里使用左闭右开区间避免边界点被重复计算
+func (s *TSDBSource) Read(
+	span *pb.DurationSpan,
+	start time.Time,
+	end time.Time,
+	matchers ...pb.Matcher,
+) (Iterator, error) {
+	mint, maxt := start.UnixMilli(), end.UnixMilli()-1
+
+	queryStart := time.Now()
+	var queriers []storage.Querier
+	for _, b := range s.blocks {
+		meta := b.Meta()
+		if meta.MaxTime <= mint || meta.MinTime > maxt {
+			continue
+		}
+
+		q, err := tsdb.NewBlockQuerier(b, mint, maxt)
+		if err != nil {
+			for _, q := range queriers {
+				q.Close()
+			}
+			return nil, err
+		}
+		queriers = append(queriers, q)
+	}
+
+	if len(queriers) == 0 {
+		return newSliceIterator(nil), nil
+	}
+
+	querier := storage.NewMergeQuerier(queriers, nil, storage.ChainedSeriesMerge)
+	defer querier.Close()
+
+	// querier 关闭后 series 不能再读取, 因此这里需要把数据全部读到内存中
+	it := &SampleIterator{ss: querier.Select(true, nil, toLabelMatchers(matchers)...)}
+	var series []pb.TimeSeries
+	for it.Next() {
+		if ts := it.At(); len(ts.Points) > 0 {
+			series = append(series, ts)
+		}
+	}
+	if err := it.ss.Err(); err != nil {
+		return nil, err
+	}
+
+	span.QueryDuration = time.Since(queryStart).Seconds()
+	return newSliceIterator(series), nil
+}
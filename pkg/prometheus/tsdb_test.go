@@ -0,0 +1,85 @@
+package prometheus
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+func writeTestBlock(t *testing.T, dir string) string {
+	w, err := tsdb.NewBlockWriter(log.NewNopLogger(), dir, tsdb.DefaultBlockDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	app := w.Appender(context.Background())
+	for _, lbs := range []labels.Labels{
+		labels.FromStrings(pb.MetricLabelName, "up", "job", "prometheus"),
+		labels.FromStrings(pb.MetricLabelName, "up:downsample_5m_avg", "job", "prometheus"),
+	} {
+		// 每分钟一个点, 共 10 分钟
+		for i := int64(0); i < 10; i++ {
+			if _, err := app.Append(0, lbs, i*60*1000, float64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := w.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, id.String())
+}
+
+func TestTSDBSource(t *testing.T) {
+	dir := t.TempDir()
+	blockDir := writeTestBlock(t, dir)
+
+	for _, path := range []string{dir, blockDir} {
+		source, err := NewTSDBSource(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mint, maxt := source.TimeRange()
+		if mint.UnixMilli() != 0 || maxt.UnixMilli() != 9*60*1000+1 {
+			t.Fatalf("%s: unexpected time range [%d, %d)", path, mint.UnixMilli(), maxt.UnixMilli())
+		}
+
+		// [0m, 5m) 窗口内只有 5 个点, 右边界的点属于下一个窗口
+		it, err := source.Read(&pb.DurationSpan{}, time.UnixMilli(0), time.UnixMilli(5*60*1000),
+			pb.Matcher{Name: pb.MetricLabelName, Type: pb.LabelMatcher_RE, Value: "up.*"},
+			pb.Matcher{Name: pb.MetricLabelName, Type: pb.LabelMatcher_NRE, Value: ".+:downsample_.+"},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var series []pb.TimeSeries
+		for it.Next() {
+			series = append(series, it.At())
+		}
+		if len(series) != 1 {
+			t.Fatalf("%s: got %d series, want 1", path, len(series))
+		}
+		if len(series[0].Points) != 5 || series[0].Points[4].Value != 4 {
+			t.Fatalf("%s: unexpected points %v", path, series[0].Points)
+		}
+
+		if err := source.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
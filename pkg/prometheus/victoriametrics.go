@@ -0,0 +1,141 @@
+package prometheus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// VMImportSink 通过 VictoriaMetrics 的 /api/v1/import 接口写出
+// 同一个序列的样本合并为一行 {"metric":{...},"values":[...],"timestamps":[...]},
+// lttb/m4 等一个窗口输出多个点的聚合不需要为每个点重复发送 label, 请求体使用 gzip 压缩
+type VMImportSink struct {
+	url    string
+	auth   Auth
+	client *http.Client
+}
+
+func NewVMImportSink(url string, auth Auth) *VMImportSink {
+	return &VMImportSink{
+		url:    url,
+		auth:   auth,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (v *VMImportSink) Name() string {
+	return pb.SinkTypeVictoriaMetrics
+}
+
+func (v *VMImportSink) Close() error {
+	return nil
+}
+
+type vmImportLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+func (v *VMImportSink) Send(batch []prompb.TimeSeries) error {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if err := writeVMImport(gw, batch); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", v.url, &buf)
+	if err != nil {
+		return err
+	}
+
+	v.auth.apply(httpReq)
+	httpReq.Header.Set("Content-Type", "application/stream+json")
+	httpReq.Header.Set("Content-Encoding", "gzip")
+	httpReq.Header.Set("User-Agent", "prom-remote-write-shard")
+
+	resp, err := v.client.Do(httpReq)
+	if err != nil {
+		return RecoverableError{error: err}
+	}
+	defer func() {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 != 2 {
+		all, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("victoriametrics import status code %d: %s", resp.StatusCode, string(all))
+
+		// 与 remote write 一致, 5xx 和 429 可以重试
+		if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+			return RecoverableError{
+				error:      err,
+				retryAfter: retryAfterDuration(resp.Header.Get("Retry-After")),
+			}
+		}
+		return err
+	}
+
+	logrus.Warnln("victoriametrics import series success", len(batch))
+	return nil
+}
+
+// writeVMImport 将 label 相同的序列合并为一行, 保持序列第一次出现的顺序
+func writeVMImport(w io.Writer, batch []prompb.TimeSeries) error {
+	var (
+		lines   = make(map[string]*vmImportLine)
+		order   []string
+		skipped int
+	)
+	for _, ts := range batch {
+		key := labelsKey(ts.Labels)
+		line, ok := lines[key]
+		if !ok {
+			line = &vmImportLine{Metric: make(map[string]string, len(ts.Labels))}
+			for _, l := range ts.Labels {
+				line.Metric[l.Name] = l.Value
+			}
+			lines[key] = line
+			order = append(order, key)
+		}
+
+		for _, s := range ts.Samples {
+			// json 无法表示 NaN/Inf
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				skipped++
+				continue
+			}
+			line.Values = append(line.Values, s.Value)
+			line.Timestamps = append(line.Timestamps, s.Timestamp)
+		}
+	}
+
+	if skipped > 0 {
+		logrus.WithField("samples", skipped).Warnln("victoriametrics import skip non-finite samples")
+	}
+
+	enc := json.NewEncoder(w)
+	for _, key := range order {
+		if len(lines[key].Values) == 0 {
+			continue
+		}
+		if err := enc.Encode(lines[key]); err != nil {
+			return fmt.Errorf("encode victoriametrics import line: %w", err)
+		}
+	}
+	return nil
+}
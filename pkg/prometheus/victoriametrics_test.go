@@ -0,0 +1,74 @@
+package prometheus
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestVMImportSink(t *testing.T) {
+	var (
+		lines []vmImportLine
+		fail  = true
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 第一次请求返回 503, 验证可以重试
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		scanner := bufio.NewScanner(gr)
+		for scanner.Scan() {
+			var line vmImportLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Error(err)
+			}
+			lines = append(lines, line)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// lttb 一个窗口输出多个点, 同一序列的点合并为一行
+	lttb := testSeries("up:downsample_5m_lttb", 60000, 1)
+	lttb.Samples = append(lttb.Samples, prompb.Sample{Timestamp: 120000, Value: 2})
+	batch := []prompb.TimeSeries{
+		lttb,
+		testSeries("up:downsample_5m_avg", 60000, math.NaN()),
+		testSeries("up:downsample_5m_lttb", 60000, 3),
+	}
+
+	sink := NewVMImportSink(srv.URL, Auth{})
+	err := sink.Send(batch)
+	if _, ok := isRecoverable(err); !ok {
+		t.Fatalf("got error %v, want recoverable", err)
+	}
+	if err := sink.Send(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// NaN 无法编码, avg 序列没有可写的点被跳过
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+	line := lines[0]
+	if line.Metric["__name__"] != "up:downsample_5m_lttb" || line.Metric["job"] != "node" {
+		t.Fatalf("unexpected metric %v", line.Metric)
+	}
+	if len(line.Values) != 3 || len(line.Timestamps) != 3 || line.Timestamps[1] != 120000 || line.Values[2] != 3 {
+		t.Fatalf("unexpected line %+v", line)
+	}
+}
@@ -0,0 +1,496 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checkpointFileName = "checkpoint"
+	segmentNameFormat  = "%08d"
+	recordHeaderSize   = 8 // 4 字节长度 + 4 字节 crc32
+)
+
+var (
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errWALSealed = errors.New("wal queue sealed")
+)
+
+// WALPosition 表示 wal 中的一个位置, 即 segment 序号和 segment 内的偏移
+type WALPosition struct {
+	Segment int
+	Offset  int64
+}
+
+func (p WALPosition) before(o WALPosition) bool {
+	return p.Segment < o.Segment || (p.Segment == o.Segment && p.Offset < o.Offset)
+}
+
+// WALQueue 是位于 downsample 和 sink 之间的磁盘队列
+// 写入的 batch 按顺序追加到 segment 文件中, 写出成功后通过 checkpoint 记录确认位置,
+// 写入目标故障或进程重启后, 从 checkpoint 开始按顺序重放未确认的 batch
+// 队列总大小超过 maxSize 时丢弃最旧的 segment
+// segment 在写满切换时以及每隔 syncInterval 执行 fsync, 机器掉电时最多丢失 syncInterval 内写入的数据
+type WALQueue struct {
+	dir          string
+	segmentSize  int64
+	maxSize      int64
+	syncInterval time.Duration
+
+	lock     sync.Mutex
+	notify   chan struct{}
+	done     chan struct{}
+	dirty    bool // 当前 segment 有尚未 fsync 的数据
+	sealed   bool
+	segments []int         // 现存的 segment 序号, 升序
+	sizes    map[int]int64 // 每个 segment 的大小
+	writer   *os.File      // 当前写入的 segment, 总是 segments 的最后一个
+	reader   *os.File      // 当前读取的 segment
+	readPos  WALPosition   // 下一条待读取记录的位置
+	ckpt     WALPosition   // 已确认写出的位置
+	dropped  int64         // 因超出 maxSize 被丢弃的字节数
+}
+
+func OpenWALQueue(dir string, segmentSize, maxSize int64, syncInterval time.Duration) (*WALQueue, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	q := &WALQueue{
+		dir:          dir,
+		segmentSize:  segmentSize,
+		maxSize:      maxSize,
+		syncInterval: syncInterval,
+		notify:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		sizes:        make(map[int]int64),
+	}
+
+	if err := q.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		idx, err := strconv.Atoi(e.Name())
+		if err != nil || e.IsDir() {
+			continue
+		}
+
+		// checkpoint 之前的 segment 已经全部确认, 直接删除
+		if idx < q.ckpt.Segment {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, idx)
+		q.sizes[idx] = info.Size()
+	}
+	sort.Ints(q.segments)
+
+	// 总是新建一个 segment 用于写入, 避免在上次异常退出时写了一半的记录后面追加
+	next := q.ckpt.Segment
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1] + 1
+	}
+	if err := q.createSegment(next); err != nil {
+		return nil, err
+	}
+
+	q.readPos = q.ckpt
+	if len(q.segments) > 0 && q.readPos.Segment < q.segments[0] {
+		q.readPos = WALPosition{Segment: q.segments[0]}
+	}
+
+	if q.syncInterval > 0 {
+		go q.syncLoop()
+	}
+	return q, nil
+}
+
+// syncLoop 定期 fsync 当前写入的 segment, 直到 Close
+func (q *WALQueue) syncLoop() {
+	ticker := time.NewTicker(q.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+			q.lock.Lock()
+			if err := q.syncSegment(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"dir":   q.dir,
+					"error": err,
+				}).Errorln("wal queue sync segment failed")
+			}
+			q.lock.Unlock()
+		}
+	}
+}
+
+func (q *WALQueue) syncSegment() error {
+	if !q.dirty || q.writer == nil {
+		return nil
+	}
+	if err := q.writer.Sync(); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+func (q *WALQueue) segmentPath(idx int) string {
+	return filepath.Join(q.dir, fmt.Sprintf(segmentNameFormat, idx))
+}
+
+func (q *WALQueue) createSegment(idx int) error {
+	f, err := os.OpenFile(q.segmentPath(idx), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(q.dir); err != nil {
+		f.Close()
+		return err
+	}
+
+	// 写满的 segment 不会再写入, 切换前落盘
+	if q.writer != nil {
+		if err := q.syncSegment(); err != nil {
+			f.Close()
+			return err
+		}
+		q.writer.Close()
+	}
+	q.writer = f
+	q.segments = append(q.segments, idx)
+	q.sizes[idx] = 0
+	return nil
+}
+
+func (q *WALQueue) writeSegment() int {
+	return q.segments[len(q.segments)-1]
+}
+
+// Append 将一个 batch 追加到队列尾部
+func (q *WALQueue) Append(batch []prompb.TimeSeries) error {
+	data, err := proto.Marshal(&prompb.WriteRequest{Timeseries: batch})
+	if err != nil {
+		return err
+	}
+	data = snappy.Encode(nil, data)
+
+	buf := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(data, castagnoliTable))
+	copy(buf[recordHeaderSize:], data)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.sealed {
+		return errWALSealed
+	}
+
+	if q.sizes[q.writeSegment()] > 0 && q.sizes[q.writeSegment()]+int64(len(buf)) > q.segmentSize {
+		if err := q.createSegment(q.writeSegment() + 1); err != nil {
+			return err
+		}
+	}
+
+	// 一次 write 写入整条记录, 读取端在同一把锁下读取, 不会读到半条记录
+	if _, err := q.writer.Write(buf); err != nil {
+		return err
+	}
+	q.sizes[q.writeSegment()] += int64(len(buf))
+	q.dirty = true
+	q.truncateOverflow()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// truncateOverflow 在队列总大小超过 maxSize 时删除最旧的 segment, 写入中的 segment 不会被删除
+func (q *WALQueue) truncateOverflow() {
+	if q.maxSize <= 0 {
+		return
+	}
+
+	var total int64
+	for _, idx := range q.segments {
+		total += q.sizes[idx]
+	}
+
+	for total > q.maxSize && len(q.segments) > 1 {
+		oldest := q.segments[0]
+		total -= q.sizes[oldest]
+		q.dropped += q.sizes[oldest]
+
+		if q.readPos.Segment <= oldest {
+			if q.reader != nil {
+				q.reader.Close()
+				q.reader = nil
+			}
+			q.readPos = WALPosition{Segment: q.segments[1]}
+		}
+		if q.ckpt.Segment <= oldest {
+			q.ckpt = WALPosition{Segment: q.segments[1]}
+		}
+
+		os.Remove(q.segmentPath(oldest))
+		delete(q.sizes, oldest)
+		q.segments = q.segments[1:]
+
+		logrus.WithFields(logrus.Fields{
+			"dir":     q.dir,
+			"segment": oldest,
+			"dropped": q.dropped,
+		}).Errorln("wal queue exceeds max size, drop oldest segment")
+	}
+}
+
+// Next 阻塞读取下一个未读取的 batch, 返回 batch 以及该 batch 之后的位置, 写出成功后需要调用 Ack 确认
+// 队列被 Seal 且数据全部读完后返回 io.EOF
+func (q *WALQueue) Next(ctx context.Context) ([]prompb.TimeSeries, WALPosition, error) {
+	for {
+		q.lock.Lock()
+		batch, pos, err := q.read()
+		sealed := q.sealed
+		q.lock.Unlock()
+
+		if err == nil {
+			return batch, pos, nil
+		}
+		if err != io.EOF {
+			return nil, WALPosition{}, err
+		}
+		if sealed {
+			return nil, WALPosition{}, io.EOF
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, WALPosition{}, ctx.Err()
+		case <-q.notify:
+		}
+	}
+}
+
+// read 读取 readPos 处的记录, 没有新数据时返回 io.EOF
+func (q *WALQueue) read() ([]prompb.TimeSeries, WALPosition, error) {
+	for {
+		seg := q.readPos.Segment
+		if q.readPos.Offset >= q.sizes[seg] {
+			// 当前 segment 已经读完, 如果还有后续 segment 则切换过去
+			next := -1
+			for _, idx := range q.segments {
+				if idx > seg {
+					next = idx
+					break
+				}
+			}
+			if next < 0 {
+				return nil, q.readPos, io.EOF
+			}
+			q.switchReader(WALPosition{Segment: next})
+			continue
+		}
+
+		if q.reader == nil {
+			f, err := os.Open(q.segmentPath(seg))
+			if err != nil {
+				return nil, q.readPos, err
+			}
+			q.reader = f
+		}
+
+		data, n, err := readRecord(q.reader, q.readPos.Offset, q.sizes[seg])
+		if err != nil {
+			// 记录损坏(通常是异常退出时写了一半), 跳过当前 segment 剩余的数据
+			logrus.WithFields(logrus.Fields{
+				"dir":     q.dir,
+				"segment": seg,
+				"offset":  q.readPos.Offset,
+				"error":   err,
+			}).Errorln("wal queue read corrupted record, skip segment")
+			q.readPos.Offset = q.sizes[seg]
+			continue
+		}
+		q.readPos.Offset += n
+
+		var req prompb.WriteRequest
+		decomp, err := snappy.Decode(nil, data)
+		if err == nil {
+			err = proto.Unmarshal(decomp, &req)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"dir":     q.dir,
+				"segment": seg,
+				"error":   err,
+			}).Errorln("wal queue decode record failed, skip record")
+			continue
+		}
+		return req.Timeseries, q.readPos, nil
+	}
+}
+
+func (q *WALQueue) switchReader(pos WALPosition) {
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+	q.readPos = pos
+}
+
+// readRecord 读取 segment 中 offset 处的一条记录, size 为 segment 的大小
+// 长度超过 segment 剩余大小的记录与 crc 不一致一样视为损坏, 避免按损坏的长度分配内存
+func readRecord(f *os.File, offset, size int64) ([]byte, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if int64(length) > size-offset-recordHeaderSize {
+		return nil, 0, fmt.Errorf("record length %d exceeds segment size %d at offset %d", length, size, offset)
+	}
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset+recordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(data, castagnoliTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("record checksum mismatch")
+	}
+	return data, recordHeaderSize + int64(length), nil
+}
+
+// Ack 确认 pos 之前的数据已经写出, 持久化 checkpoint 并删除已经全部确认的 segment
+func (q *WALQueue) Ack(pos WALPosition) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if !q.ckpt.before(pos) {
+		return nil
+	}
+	q.ckpt = pos
+
+	for len(q.segments) > 1 && q.segments[0] < pos.Segment {
+		os.Remove(q.segmentPath(q.segments[0]))
+		delete(q.sizes, q.segments[0])
+		q.segments = q.segments[1:]
+	}
+	return q.saveCheckpoint()
+}
+
+// Seal 表示不会再有新的数据写入, 数据全部读完后 Next 返回 io.EOF
+func (q *WALQueue) Seal() {
+	q.lock.Lock()
+	q.sealed = true
+	q.lock.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *WALQueue) Close() error {
+	close(q.done)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	if err := q.syncSegment(); err != nil {
+		q.writer.Close()
+		return err
+	}
+	return q.writer.Close()
+}
+
+func (q *WALQueue) loadCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(q.dir, checkpointFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != 16 {
+		return fmt.Errorf("invalid wal checkpoint in %s", q.dir)
+	}
+
+	q.ckpt = WALPosition{
+		Segment: int(binary.BigEndian.Uint64(data[0:8])),
+		Offset:  int64(binary.BigEndian.Uint64(data[8:16])),
+	}
+	return nil
+}
+
+// saveCheckpoint 先写临时文件并 fsync 再 rename, rename 之后 fsync 目录, 保证掉电后 checkpoint 文件不会写坏或丢失
+func (q *WALQueue) saveCheckpoint() error {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data[0:8], uint64(q.ckpt.Segment))
+	binary.BigEndian.PutUint64(data[8:16], uint64(q.ckpt.Offset))
+
+	tmp := filepath.Join(q.dir, checkpointFileName+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(q.dir, checkpointFileName)); err != nil {
+		return err
+	}
+	return syncDir(q.dir)
+}
+
+// syncDir fsync 目录, 使目录中新建和 rename 的文件落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,134 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALQueueReplay(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	q, err := OpenWALQueue(dir, 64, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 5; i++ {
+		if err := q.Append(testInstances(1, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// segment 很小, 每条记录都会单独占用一个 segment
+	if len(q.segments) != 5 {
+		t.Fatalf("got %d segments, want 5", len(q.segments))
+	}
+
+	// 只确认前两条, 模拟写出过程中进程退出
+	for i := int64(0); i < 2; i++ {
+		batch, pos, err := q.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if batch[0].Samples[0].Timestamp != i {
+			t.Fatalf("got batch %d, want %d", batch[0].Samples[0].Timestamp, i)
+		}
+		if err := q.Ack(pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := q.Next(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开后从 checkpoint 开始重放, 未确认的第三条需要再次读出
+	q, err = OpenWALQueue(dir, 64, 0, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.Seal()
+
+	var got []int64
+	for {
+		batch, pos, err := q.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, batch[0].Samples[0].Timestamp)
+		if err := q.Ack(pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 3 || got[0] != 2 || got[2] != 4 {
+		t.Fatalf("unexpected replay %v", got)
+	}
+}
+
+func TestWALQueueMaxSize(t *testing.T) {
+	q, err := OpenWALQueue(t.TempDir(), 64, 200, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := int64(0); i < 10; i++ {
+		if err := q.Append(testInstances(1, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Seal()
+
+	if q.dropped == 0 {
+		t.Fatal("expected oldest segments to be dropped")
+	}
+
+	// 最旧的数据被丢弃, 剩余的数据仍然按顺序读出, 且最新的一条一定保留
+	var last int64 = -1
+	for {
+		batch, _, err := q.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := batch[0].Samples[0].Timestamp
+		if ts <= last {
+			t.Fatalf("out of order batch %d after %d", ts, last)
+		}
+		last = ts
+	}
+	if last != 9 {
+		t.Fatalf("got last batch %d, want 9", last)
+	}
+}
+
+func TestReadRecordCorruptLength(t *testing.T) {
+	// 损坏的长度远大于 segment, 不应按该长度分配内存
+	buf := make([]byte, recordHeaderSize+4)
+	binary.BigEndian.PutUint32(buf[0:4], 0xffffffff)
+	path := filepath.Join(t.TempDir(), "00000000")
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, _, err := readRecord(f, 0, int64(len(buf))); err == nil {
+		t.Fatal("expected corrupted record")
+	}
+}
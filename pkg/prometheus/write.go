@@ -1,116 +1,257 @@
 package prometheus
 
 import (
-	"bytes"
 	"context"
 	"io"
-	"net/http"
-	"runtime"
 	"sync"
 	"time"
 
 	"prom-stream-downsample/pkg/pb"
 
-	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
 	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
 )
 
-func (p *Prometheus) putBuffer(buf []prompb.TimeSeries) {
+const (
+	walRetryInterval = 5 * time.Second
+	// 每个写入目标的输入队列长度, 以 batch 为单位
+	targetQueueSize = 64
+	// 写入目标输入队列满时最多等待的时间, 超时后认为写入目标阻塞
+	targetEnqueueTimeout = time.Second
+)
+
+func putBuffer(buf []prompb.TimeSeries) {
 	buf = buf[:0]
 	pb.TimeSeriesPool.Put(buf)
 }
 
-func (p *Prometheus) getMaxConcurrent() int {
-	c := runtime.GOMAXPROCS(0)
-	if c < 2 {
-		c = 4
-	} else if c > 8 {
-		c = 8
-	}
-	return c
+// Writer 将 writeCh 中的降采样结果按照 filter 分发到各个写入目标
+// 每个写入目标有独立的队列、wal 和重试, 一个写入目标变慢或故障不会影响其它写入目标
+type Writer struct {
+	writeCh  chan pb.WriteBatch
+	targets  []*WriteTarget
+	blocking bool
 }
 
-func (p *Prometheus) StartRemoteWrite(ctx context.Context) {
-	ticker := time.NewTicker(time.Second * 5)
+// NewWriter blocking 为 true 时, 写入目标的输入队列满时阻塞等待 (离线模式不能丢数据);
+// 否则最多等待 targetEnqueueTimeout, 超时后丢弃该写入目标的这一批数据, 并在其恢复前不再等待它;
+// 只有一个写入目标时总是阻塞, 交给 downsample 的 backpressure 策略处理
+func NewWriter(writeCh chan pb.WriteBatch, targets []*WriteTarget, blocking bool) *Writer {
+	return &Writer{
+		writeCh:  writeCh,
+		targets:  targets,
+		blocking: blocking || len(targets) == 1,
+	}
+}
 
+// Start 启动所有写入目标, writeCh 被关闭且数据全部交给写入目标后, 等待写入目标退出后返回
+// 这里不监听 ctx, 开启 wal 时 writeCh 中剩余的数据也要写入 wal, 在下次启动后重放
+func (w *Writer) Start(ctx context.Context) {
 	var wg sync.WaitGroup
-	wg.Add(p.getMaxConcurrent())
-	for i := 0; i < p.getMaxConcurrent(); i++ {
-		go func() {
+	wg.Add(len(w.targets))
+	for _, t := range w.targets {
+		go func(t *WriteTarget) {
 			defer wg.Done()
+			t.run(ctx)
+		}(t)
+	}
 
-			for batch := range p.writeCh {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-				}
-
-				if len(batch) > 0 {
-					p.send(batch)
-					p.putBuffer(batch)
-				}
-			}
-		}()
+	for batch := range w.writeCh {
+		w.dispatch(batch)
+		putBuffer(batch.Series)
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			ticker.Stop()
-			wg.Wait()
-			return
-		case <-ticker.C:
-			select {
-			case batch := <-p.writeCh:
-				if len(batch) > 0 {
-					p.writeCh <- batch
-				}
-			default:
-			}
-		case batch := <-p.writeCh:
-			if len(batch) > 0 {
-				p.writeCh <- batch
-			}
-		}
+	for _, t := range w.targets {
+		close(t.ch)
 	}
+	wg.Wait()
 }
 
-func (p *Prometheus) send(batch []prompb.TimeSeries) {
-	marshal, err := proto.Marshal(&prompb.WriteRequest{Timeseries: batch})
-	if err != nil {
-		logrus.Errorln("send series proto marshal failed", err)
+func (w *Writer) dispatch(batch pb.WriteBatch) {
+	if len(batch.Series) == 0 {
 		return
 	}
 
-	httpReq, err := http.NewRequest("POST", p.remoteWriteURL, bytes.NewReader(snappy.Encode(nil, marshal)))
-	if err != nil {
-		return
+	for _, t := range w.targets {
+		series := t.filter.filter(batch)
+		if len(series) == 0 {
+			putBuffer(series)
+			continue
+		}
+
+		if w.blocking {
+			t.ch <- series
+			continue
+		}
+
+		if !t.enqueue(series) {
+			droppedSamplesTotal.WithLabelValues(t.name).Add(float64(batchSamples(series)))
+			logrus.WithFields(logrus.Fields{
+				"target": t.name,
+				"series": len(series),
+			}).Errorln("write target is stalled, drop series")
+			putBuffer(series)
+		}
 	}
+}
 
-	httpReq.Header.Add("Content-Encoding", "snappy")
-	httpReq.Header.Set("Content-Type", "application/x-protobuf")
-	httpReq.Header.Set("User-Agent", "prom-remote-write-shard")
-	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+// enqueue 输入队列满时等待 targetEnqueueTimeout, 避免正常的写入目标因为突发的数据丢数据;
+// 超时后标记为阻塞, 之后只做非阻塞的尝试, 直到输入队列重新可写, 避免拖慢其它写入目标
+func (t *WriteTarget) enqueue(series []prompb.TimeSeries) bool {
+	select {
+	case t.ch <- series:
+		t.stalled = false
+		return true
+	default:
+	}
 
-	resp, err := http.DefaultClient.Do(httpReq)
-	if err != nil {
-		logrus.Errorln("api do failed", err)
-		return
+	if t.stalled {
+		return false
+	}
+
+	timer := time.NewTimer(targetEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case t.ch <- series:
+		return true
+	case <-timer.C:
+		t.stalled = true
+		return false
+	}
+}
+
+// run 处理写入目标输入队列中的数据, 输入队列关闭且数据全部写出 或 ctx 结束后返回
+// 返回前会关闭 sink, 保证 sink 中缓存的数据被写出
+func (t *WriteTarget) run(ctx context.Context) {
+	qm := NewQueueManager(t.name, t.queueConfig, t.send)
+	if g, ok := t.sink.(seriesGrouper); ok {
+		qm.group = g.groupSeries
+	}
+	qm.Start(ctx)
+
+	if t.wal != nil {
+		t.walWrite(ctx, qm)
+	} else {
+		t.directWrite(ctx, qm)
+	}
+
+	if err := t.sink.Close(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"target": t.name,
+			"error":  err,
+		}).Errorln("sink close failed")
+	}
+}
+
+// directWrite 直接将 batch 交给 queue manager 写出
+// ctx 结束后 queue manager 不再接收数据, 剩余的数据被丢弃
+func (t *WriteTarget) directWrite(ctx context.Context, qm *QueueManager) {
+	defer qm.Stop()
+
+	for batch := range t.ch {
+		// queue manager 只持有 batch 中的序列, batch 本身可以直接复用
+		qm.Append(ctx, batch, nil)
+		putBuffer(batch)
 	}
-	defer func() {
-		io.Copy(io.Discard, resp.Body)
-		resp.Body.Close()
+}
+
+// walWrite batch 先追加到 wal, 再由单独的协程从 wal 中按顺序读取交给 queue manager 写出
+// 可恢复的错误会一直重试直到成功, 期间新的数据继续堆积在 wal 中; 不可恢复的错误丢弃对应的 batch
+func (t *WriteTarget) walWrite(ctx context.Context, qm *QueueManager) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for batch := range t.ch {
+			if err := t.wal.Append(batch); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"target": t.name,
+					"series": len(batch),
+					"error":  err,
+				}).Errorln("wal append failed")
+			}
+			putBuffer(batch)
+		}
+		t.wal.Seal()
 	}()
 
-	if resp.StatusCode >= 400 {
-		all, _ := io.ReadAll(resp.Body)
-		logrus.Errorln("api do status code >= 400", resp.StatusCode, string(all))
-		return
+	t.replayWAL(ctx, qm)
+	// 等待 shard 中的数据写出并确认后再关闭 wal
+	qm.Stop()
+	wg.Wait()
+
+	if err := t.wal.Close(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"target": t.name,
+			"error":  err,
+		}).Errorln("wal close failed")
 	}
+}
 
-	logrus.Warnln("remote write series success", len(batch))
-	return
+func (t *WriteTarget) replayWAL(ctx context.Context, qm *QueueManager) {
+	acker := &walAcker{wal: t.wal}
+	for {
+		batch, pos, err := t.wal.Next(ctx)
+		if err == io.EOF || ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"target": t.name,
+				"error":  err,
+			}).Errorln("wal read failed")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(walRetryInterval):
+			}
+			continue
+		}
+
+		if err := qm.Append(ctx, batch, acker.track(pos)); err != nil {
+			return
+		}
+	}
+}
+
+// walAcker batch 被拆分到多个 shard 中写出, 完成的顺序与读取的顺序不一定一致
+// 只有某个位置之前的 batch 全部写出后才能确认该位置
+type walAcker struct {
+	wal *WALQueue
+
+	lock    sync.Mutex
+	pending []*walAckEntry
+}
+
+type walAckEntry struct {
+	pos  WALPosition
+	done bool
+}
+
+func (a *walAcker) track(pos WALPosition) func() {
+	entry := &walAckEntry{pos: pos}
+
+	a.lock.Lock()
+	a.pending = append(a.pending, entry)
+	a.lock.Unlock()
+
+	return func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+
+		entry.done = true
+		var ack *WALPosition
+		for len(a.pending) > 0 && a.pending[0].done {
+			ack = &a.pending[0].pos
+			a.pending = a.pending[1:]
+		}
+		if ack == nil {
+			return
+		}
+
+		if err := a.wal.Ack(*ack); err != nil {
+			logrus.WithField("error", err).Errorln("wal ack failed")
+		}
+	}
 }
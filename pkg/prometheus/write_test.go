@@ -0,0 +1,90 @@
+package prometheus
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+type testSink struct {
+	lock   sync.Mutex
+	names  []string
+	block  chan struct{}
+	closed bool
+}
+
+func (s *testSink) Name() string {
+	return "test"
+}
+
+func (s *testSink) Send(batch []prompb.TimeSeries) error {
+	if s.block != nil {
+		<-s.block
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, ts := range batch {
+		s.names = append(s.names, ts.Labels[0].Value)
+	}
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestWriterRouting(t *testing.T) {
+	var (
+		hot  = &testSink{}
+		cold = &testSink{}
+		// slow 一直阻塞, 不能影响其它写入目标
+		slow = &testSink{block: make(chan struct{})}
+	)
+
+	writeCh := make(chan pb.WriteBatch, 16)
+	writer := NewWriter(writeCh, []*WriteTarget{
+		NewWriteTarget("hot", hot, nil, QueueConfig{}, TargetFilter{Resolutions: []string{"5m"}}),
+		NewWriteTarget("cold", cold, nil, QueueConfig{}, TargetFilter{Jobs: []string{"node"}, Aggregations: []string{"max"}}),
+		NewWriteTarget("slow", slow, nil, QueueConfig{Capacity: 1, MaxShards: 1, MaxSamplesPerSend: 1}, TargetFilter{}),
+	}, false)
+
+	done := make(chan struct{})
+	go func() {
+		writer.Start(context.Background())
+		close(done)
+	}()
+
+	for i := 0; i < 2*targetQueueSize; i++ {
+		writeCh <- pb.WriteBatch{Job: "node", Series: []prompb.TimeSeries{testSeries("up:downsample_5m_avg", 1, 1), testSeries("up:downsample_1h_max", 1, 1)}}
+	}
+	writeCh <- pb.WriteBatch{Job: "app", Series: []prompb.TimeSeries{testSeries("up:downsample_1h_max", 1, 1)}}
+	close(writeCh)
+
+	// 放行 slow, 让 writer 可以退出
+	close(slow.block)
+	<-done
+
+	if len(hot.names) != 2*targetQueueSize {
+		t.Fatalf("hot got %d series, want %d", len(hot.names), 2*targetQueueSize)
+	}
+	for _, name := range hot.names {
+		if name != "up:downsample_5m_avg" {
+			t.Fatalf("hot got unexpected series %s", name)
+		}
+	}
+	if len(cold.names) != 2*targetQueueSize {
+		t.Fatalf("cold got %d series, want %d", len(cold.names), 2*targetQueueSize)
+	}
+	if len(slow.names) >= 4*targetQueueSize+1 {
+		t.Fatalf("slow got %d series, expected some to be dropped", len(slow.names))
+	}
+	if !hot.closed || !cold.closed || !slow.closed {
+		t.Fatal("sinks not closed")
+	}
+}
@@ -0,0 +1,132 @@
+package prometheus
+
+import (
+	"errors"
+	"math"
+
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+const (
+	remoteWriteContentTypeV1 = "application/x-protobuf"
+	remoteWriteContentTypeV2 = "application/x-protobuf;proto=" + pb.RemoteWriteProtoMsgV2
+	remoteWriteVersionV1     = "0.1.0"
+	remoteWriteVersionV2     = "2.0.0"
+)
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// io.prometheus.write.v2.Request 的字段编号
+// 当前依赖的 prometheus 版本中没有 remote write 2.0 的 proto 定义, 这里直接按照协议编码
+const (
+	requestSymbolsField    = 4
+	requestTimeSeriesField = 5
+
+	seriesLabelsRefsField = 1
+	seriesSamplesField    = 2
+	seriesMetadataField   = 5
+
+	sampleValueField     = 1
+	sampleTimestampField = 2
+
+	metadataTypeField    = 1
+	metadataHelpRefField = 3
+	metadataUnitRefField = 4
+)
+
+// symbolTable 是 remote write 2.0 的字符串表, 请求中的 label 和元数据都通过下标引用, 第一个元素必须是空字符串
+type symbolTable struct {
+	symbols []string
+	refs    map[string]uint32
+}
+
+func newSymbolTable() *symbolTable {
+	t := &symbolTable{refs: make(map[string]uint32)}
+	t.ref("")
+	return t
+}
+
+func (t *symbolTable) ref(s string) uint32 {
+	if ref, ok := t.refs[s]; ok {
+		return ref
+	}
+
+	ref := uint32(len(t.symbols))
+	t.symbols = append(t.symbols, s)
+	t.refs[s] = ref
+	return ref
+}
+
+// marshalWriteRequestV2 将 batch 编码为 io.prometheus.write.v2.Request
+// 降采样序列的 label 大量重复, 通过字符串表可以显著减小请求体积
+func marshalWriteRequestV2(batch []prompb.TimeSeries, metadata *MetadataCache) []byte {
+	var (
+		symbols = newSymbolTable()
+		series  []byte
+		buf     []byte
+	)
+
+	for _, ts := range batch {
+		buf = appendTimeSeriesV2(buf[:0], symbols, ts, metadata)
+		series = protowire.AppendTag(series, requestTimeSeriesField, protowire.BytesType)
+		series = protowire.AppendBytes(series, buf)
+	}
+
+	var req []byte
+	for _, s := range symbols.symbols {
+		req = protowire.AppendTag(req, requestSymbolsField, protowire.BytesType)
+		req = protowire.AppendString(req, s)
+	}
+	return append(req, series...)
+}
+
+func appendTimeSeriesV2(b []byte, symbols *symbolTable, ts prompb.TimeSeries, metadata *MetadataCache) []byte {
+	var (
+		refs []byte
+		name string
+	)
+	for _, l := range ts.Labels {
+		if l.Name == pb.MetricLabelName {
+			name = l.Value
+		}
+		refs = protowire.AppendVarint(refs, uint64(symbols.ref(l.Name)))
+		refs = protowire.AppendVarint(refs, uint64(symbols.ref(l.Value)))
+	}
+	b = protowire.AppendTag(b, seriesLabelsRefsField, protowire.BytesType)
+	b = protowire.AppendBytes(b, refs)
+
+	var sample []byte
+	for _, s := range ts.Samples {
+		sample = sample[:0]
+		if s.Value != 0 {
+			sample = protowire.AppendTag(sample, sampleValueField, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+		}
+		if s.Timestamp != 0 {
+			sample = protowire.AppendTag(sample, sampleTimestampField, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+		}
+		b = protowire.AppendTag(b, seriesSamplesField, protowire.BytesType)
+		b = protowire.AppendBytes(b, sample)
+	}
+
+	if md, ok := metadata.Downsample(name); ok {
+		var m []byte
+		m = protowire.AppendTag(m, metadataTypeField, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(md.Type))
+		if len(md.Help) > 0 {
+			m = protowire.AppendTag(m, metadataHelpRefField, protowire.VarintType)
+			m = protowire.AppendVarint(m, uint64(symbols.ref(md.Help)))
+		}
+		if len(md.Unit) > 0 {
+			m = protowire.AppendTag(m, metadataUnitRefField, protowire.VarintType)
+			m = protowire.AppendVarint(m, uint64(symbols.ref(md.Unit)))
+		}
+		b = protowire.AppendTag(b, seriesMetadataField, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	return b
+}
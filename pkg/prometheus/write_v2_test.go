@@ -0,0 +1,184 @@
+package prometheus
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// decodedSeriesV2 是测试中解码出来的 remote write 2.0 序列, label 已经通过字符串表还原
+type decodedSeriesV2 struct {
+	labels   []string
+	samples  []prompb.Sample
+	typ      uint64
+	helpText string
+}
+
+// fields 解析一层 protobuf 消息, 返回 (字段编号, 原始值) 列表, varint/fixed64 以 uint64 返回
+func fields(t *testing.T, b []byte) (nums []protowire.Number, values []any) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var v any
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		if n < 0 {
+			t.Fatal(protowire.ParseError(n))
+		}
+		b = b[n:]
+		nums, values = append(nums, num), append(values, v)
+	}
+	return nums, values
+}
+
+func decodeWriteRequestV2(t *testing.T, b []byte) []decodedSeriesV2 {
+	var (
+		symbols []string
+		raw     [][]byte
+	)
+	nums, values := fields(t, b)
+	for i, num := range nums {
+		switch num {
+		case requestSymbolsField:
+			symbols = append(symbols, string(values[i].([]byte)))
+		case requestTimeSeriesField:
+			raw = append(raw, values[i].([]byte))
+		}
+	}
+	if len(symbols) == 0 || symbols[0] != "" {
+		t.Fatalf("first symbol must be empty, got %q", symbols)
+	}
+
+	var series []decodedSeriesV2
+	for _, r := range raw {
+		var ds decodedSeriesV2
+		nums, values := fields(t, r)
+		for i, num := range nums {
+			b := values[i]
+			switch num {
+			case seriesLabelsRefsField:
+				refs := b.([]byte)
+				for len(refs) > 0 {
+					ref, n := protowire.ConsumeVarint(refs)
+					ds.labels = append(ds.labels, symbols[ref])
+					refs = refs[n:]
+				}
+			case seriesSamplesField:
+				var s prompb.Sample
+				snums, svalues := fields(t, b.([]byte))
+				for j, snum := range snums {
+					switch snum {
+					case sampleValueField:
+						s.Value = math.Float64frombits(svalues[j].(uint64))
+					case sampleTimestampField:
+						s.Timestamp = int64(svalues[j].(uint64))
+					}
+				}
+				ds.samples = append(ds.samples, s)
+			case seriesMetadataField:
+				mnums, mvalues := fields(t, b.([]byte))
+				for j, mnum := range mnums {
+					switch mnum {
+					case metadataTypeField:
+						ds.typ = mvalues[j].(uint64)
+					case metadataHelpRefField:
+						ds.helpText = symbols[mvalues[j].(uint64)]
+					}
+				}
+			}
+		}
+		series = append(series, ds)
+	}
+	return series
+}
+
+func TestMarshalWriteRequestV2(t *testing.T) {
+	batch := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: pb.MetricLabelName, Value: "up:downsample_5m_avg"}, {Name: "job", Value: "node"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 0.5}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: pb.MetricLabelName, Value: "up:downsample_5m_lttb"}, {Name: "job", Value: "node"}},
+			Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0}},
+		},
+	}
+
+	series := decodeWriteRequestV2(t, marshalWriteRequestV2(batch, nil))
+	if len(series) != 2 {
+		t.Fatalf("got %d series, want 2", len(series))
+	}
+	for i, ds := range series {
+		for j, l := range batch[i].Labels {
+			if ds.labels[2*j] != l.Name || ds.labels[2*j+1] != l.Value {
+				t.Fatalf("series %d: unexpected labels %v", i, ds.labels)
+			}
+		}
+		if len(ds.samples) != len(batch[i].Samples) {
+			t.Fatalf("series %d: unexpected samples %v", i, ds.samples)
+		}
+		for j, s := range batch[i].Samples {
+			if ds.samples[j].Timestamp != s.Timestamp || ds.samples[j].Value != s.Value {
+				t.Fatalf("series %d: got sample %v, want %v", i, ds.samples[j], s)
+			}
+		}
+		if ds.typ != uint64(prompb.MetricMetadata_GAUGE) || len(ds.helpText) == 0 {
+			t.Fatalf("series %d: unexpected metadata type %d help %q", i, ds.typ, ds.helpText)
+		}
+	}
+}
+
+func TestRemoteWriteV2Fallback(t *testing.T) {
+	var versions []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		versions = append(versions, r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		if r.Header.Get("Content-Type") != remoteWriteContentTypeV1 {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if _, err := snappy.Decode(nil, body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	sink := NewRemoteWriteSink(srv.URL, Auth{}, pb.RemoteWriteProtoMsgV2, nil)
+	for i := 0; i < 2; i++ {
+		if err := sink.Send(testInstances(1, int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 第一次 2.0 请求返回 415 后回退到 1.0, 之后不再尝试 2.0
+	want := []string{remoteWriteVersionV2, remoteWriteVersionV1, remoteWriteVersionV1}
+	if len(versions) != len(want) {
+		t.Fatalf("got versions %v, want %v", versions, want)
+	}
+	for i := range want {
+		if versions[i] != want[i] {
+			t.Fatalf("got versions %v, want %v", versions, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 拆分后的子查询最多同时执行的个数
+const splitConcurrency = 8
+
+// resultsCache 是 query_range 结果的缓存, 与 thanos/cortex query-frontend 类似:
+// 查询按 splitInterval (对齐到 step) 拆分为多个子查询并行执行, 已经完整的子查询结果按 LRU 缓存, 总大小超过 maxBytes 时淘汰最久未使用的结果
+// 结束时间在最近 maxFreshness 内的子查询数据可能还在写入, 不缓存; 降采样数据在窗口结束后才写出, 还需要额外等待两个 resolution 间隔
+type resultsCache struct {
+	maxBytes      int
+	splitInterval time.Duration
+	maxFreshness  time.Duration
+
+	lock  sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	size  int
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+func newResultsCache(maxBytes int, splitInterval, maxFreshness time.Duration) *resultsCache {
+	return &resultsCache{
+		maxBytes:      maxBytes,
+		splitInterval: splitInterval,
+		maxFreshness:  maxFreshness,
+		ll:            list.New(),
+		items:         make(map[string]*list.Element),
+	}
+}
+
+// tenantHeaders 是透传给数据源、会影响查询结果的认证/租户请求头
+var tenantHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Scope-OrgID"}
+
+// key 包含数据源、改写后的查询、resolution、子查询的时间范围以及认证/租户请求头, 不同租户的结果不会互相命中
+// 请求头只保存摘要, 缓存中不保存凭据
+func (r *resultsCache) key(part rangePart, header http.Header) string {
+	h := sha256.New()
+	for _, name := range tenantHeaders {
+		for _, v := range header.Values(name) {
+			fmt.Fprintf(h, "%s\x00%s\x00", name, v)
+		}
+	}
+	return fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%d\x00%v\x00%v\x00%x",
+		part.url, part.query, part.tier, part.lookBackDelta, part.step, part.start, part.end, h.Sum(nil))
+}
+
+// get 每次返回新解码的结果, 调用方可以修改
+func (r *resultsCache) get(key string) (*apiResponse, bool) {
+	r.lock.Lock()
+	elem, ok := r.items[key]
+	if ok {
+		r.ll.MoveToFront(elem)
+	}
+	r.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	resp := &apiResponse{}
+	if err := json.Unmarshal(elem.Value.(*cacheEntry).value, resp); err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+func (r *resultsCache) set(key string, resp *apiResponse) {
+	value, err := json.Marshal(resp)
+	if err != nil || len(key)+len(value) > r.maxBytes {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if elem, ok := r.items[key]; ok {
+		r.size -= len(key) + len(elem.Value.(*cacheEntry).value)
+		r.ll.Remove(elem)
+	}
+	r.items[key] = r.ll.PushFront(&cacheEntry{key: key, value: value})
+	r.size += len(key) + len(value)
+
+	for r.size > r.maxBytes {
+		oldest := r.ll.Back()
+		entry := oldest.Value.(*cacheEntry)
+		r.ll.Remove(oldest)
+		delete(r.items, entry.key)
+		r.size -= len(entry.key) + len(entry.value)
+	}
+}
+
+// cacheable 判断结束于 end 的子查询结果是否已经完整, interval 为查询的降采样数据的 resolution, 原始数据为 0
+// 降采样窗口结束后才写出, 写出时还要等待延迟到达的数据, 所以降采样数据至少要等待两个 resolution 间隔
+func (r *resultsCache) cacheable(end float64, interval time.Duration, now time.Time) bool {
+	return end < float64(now.Add(-r.maxFreshness-2*interval).Unix())
+}
+
+// reset 清空缓存, 配置重新加载后代理规则可能变化, 缓存的结果不再有效
+func (r *resultsCache) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.ll.Init()
+	r.items = make(map[string]*list.Element)
+	r.size = 0
+}
+
+// splitRange 将 [start, end] 按 interval 的整数倍边界拆分, 每个子区间的起止时间都在 step 网格上
+func splitRange(start, end float64, step int64, interval time.Duration) [][2]float64 {
+	var (
+		ranges [][2]float64
+		span   = int64(interval / time.Second)
+		e      = int64(end)
+	)
+	for s := int64(start); s <= e; {
+		next := (s/span + 1) * span
+		sub := s + (next-1-s)/step*step
+		if sub > e {
+			sub = e
+		}
+		ranges = append(ranges, [2]float64{float64(s), float64(sub)})
+		s = sub + step
+	}
+	return ranges
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestSplitRange(t *testing.T) {
+	day := int64(24 * 3600)
+	// 起始时间不在天边界上, 子查询的起止时间都在 step=7200 的网格上
+	ranges := splitRange(float64(day-3600), float64(3*day), 7200, 24*time.Hour)
+	want := [][2]float64{
+		{float64(day - 3600), float64(day - 3600)},
+		{float64(day + 3600), float64(2*day - 3600)},
+		{float64(2*day + 3600), float64(3*day - 3600)},
+	}
+	if len(ranges) != len(want) {
+		t.Fatalf("got ranges %v, want %v", ranges, want)
+	}
+	for i := range want {
+		if ranges[i] != want[i] {
+			t.Fatalf("got ranges %v, want %v", ranges, want)
+		}
+	}
+}
+
+func TestResultsCacheEvict(t *testing.T) {
+	c := newResultsCache(150, time.Hour, 0)
+	resp := &apiResponse{Status: "success", Data: &matrixData{ResultType: "matrix", Result: model.Matrix{}}}
+	c.set("a", resp)
+	c.set("b", resp)
+	c.get("a")
+	c.set("c", resp)
+	// 容量只能容纳两个结果, 最久未使用的 b 被淘汰
+	if _, ok := c.get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+
+	c.reset()
+	if _, ok := c.get("a"); ok || c.size != 0 {
+		t.Fatal("expected empty cache after reset")
+	}
+}
+
+func TestQueryRangeCache(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		queries []string
+	)
+	srv := matrixServer("x", 1, &queries)
+	defer srv.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		srv.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy("x", "avg")
+	p.cache = newResultsCache(1<<20, 24*time.Hour, 10*time.Minute)
+
+	// 查询范围覆盖最近 3 天, 最后一天的部分结束时间在 max_freshness 内, 不缓存
+	end := float64(time.Now().Unix())
+	q := &QueryParams{Query: "x", Start: end - 3*24*3600, End: end, Step: 3600}
+	part := rangePart{url: upstream.URL, query: q.Query, tier: rawTier, step: q.Step, start: q.Start, end: q.End}
+
+	resp := p.queryRange(context.Background(), http.Header{}, part, q)
+	if resp.Status != "success" || len(resp.Data.Result) != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if n := len(resp.Data.Result[0].Values); n != 3*24+1 {
+		t.Fatalf("got %d points, want %d", n, 3*24+1)
+	}
+	first := len(queries)
+	if first < 4 {
+		t.Fatalf("got %d upstream queries, want at least 4", first)
+	}
+
+	resp = p.queryRange(context.Background(), http.Header{}, part, q)
+	if n := len(resp.Data.Result[0].Values); n != 3*24+1 {
+		t.Fatalf("got %d points from cache, want %d", n, 3*24+1)
+	}
+	if again := len(queries) - first; again != 1 {
+		t.Fatalf("got %d upstream queries after cache, want 1", again)
+	}
+
+	// 不同租户的结果不互相命中
+	before := len(queries)
+	resp = p.queryRange(context.Background(), http.Header{"X-Scope-Orgid": []string{"other"}}, part, q)
+	if resp.Status != "success" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if again := len(queries) - before; again != first {
+		t.Fatalf("got %d upstream queries for another tenant, want %d", again, first)
+	}
+}
+
+func TestResultsCacheFreshness(t *testing.T) {
+	c := newResultsCache(1<<20, time.Hour, 10*time.Minute)
+	now := time.Now()
+	end := float64(now.Add(-time.Hour).Unix())
+	if !c.cacheable(end, 0, now) {
+		t.Fatal("expected raw part to be cacheable")
+	}
+	if !c.cacheable(end, 5*time.Minute, now) {
+		t.Fatal("expected 5m part to be cacheable")
+	}
+	// 1h 的降采样数据至少要等待两个窗口
+	if c.cacheable(end, time.Hour, now) {
+		t.Fatal("expected 1h part not to be cacheable")
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// selectorControl 是选择器中伪 label matcher 指定的降采样方式, 如 x{__resolution__="1h", __agg__="max"}
+type selectorControl struct {
+	resolution string // 为 raw 时查询原始数据
+	agg        string
+}
+
+func (c selectorControl) raw() bool {
+	return c.resolution == pb.ResolutionRaw
+}
+
+// downsampleOff 判断请求是否通过 X-Downsample 请求头或 downsample 参数关闭了降采样
+func (q *QueryParams) downsampleOff() bool {
+	return strings.EqualFold(q.Downsample, pb.DownsampleOff)
+}
+
+// extractControls 从 expr 的选择器中去除伪 label matcher, 返回每个选择器指定的降采样方式
+// 伪 label matcher 只支持 =, 其它类型直接去除
+func extractControls(expr parser.Expr) map[*parser.VectorSelector]selectorControl {
+	controls := make(map[*parser.VectorSelector]selectorControl)
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		vector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		var (
+			ctl      selectorControl
+			found    bool
+			matchers = vector.LabelMatchers[:0]
+		)
+		for _, m := range vector.LabelMatchers {
+			if m.Name != pb.ResolutionLabelName && m.Name != pb.AggLabelName {
+				matchers = append(matchers, m)
+				continue
+			}
+			if m.Type != labels.MatchEqual {
+				logrus.WithField("matcher", m.String()).Warnln("ignore downsample control matcher, only = is supported")
+				continue
+			}
+
+			found = true
+			if m.Name == pb.ResolutionLabelName {
+				ctl.resolution = m.Value
+			} else {
+				ctl.agg = m.Value
+			}
+		}
+		vector.LabelMatchers = matchers
+		if found {
+			controls[vector] = ctl
+		}
+		return nil
+	})
+	return controls
+}
+
+// stripControls 去除 query 中的伪 label matcher, 没有伪 label matcher 时原样返回
+func stripControls(query string) string {
+	if !strings.Contains(query, pb.ResolutionLabelName) && !strings.Contains(query, pb.AggLabelName) {
+		return query
+	}
+
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return query
+	}
+	if len(extractControls(expr)) == 0 {
+		return query
+	}
+	return expr.String()
+}
+
+// resolutionByInterval 按 __resolution__ 的值查找 resolution
+func (p *Proxy) resolutionByInterval(interval string) *pb.ResolutionSet {
+	for i := range p.resolutions {
+		if p.resolutions[i].StringInterval == interval {
+			return &p.resolutions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const explainPath = "/api/v1/downsample/explain"
+
+// selectorExplain 是一个选择器的改写方式
+type selectorExplain struct {
+	Selector    string `json:"selector"`
+	Metric      string `json:"metric"`
+	Rewritten   bool   `json:"rewritten"`
+	Replacement string `json:"replacement,omitempty"`
+	Resolution  string `json:"resolution,omitempty"`
+	Aggregation string `json:"aggregation,omitempty"`
+	// 包裹 range vector 的函数, 以及改写后的函数
+	Function          string `json:"function,omitempty"`
+	RewrittenFunction string `json:"rewrittenFunction,omitempty"`
+}
+
+// explain 记录改写前的选择器
+func (rw *selectorRewrite) explain() selectorExplain {
+	se := selectorExplain{
+		Selector:    selectorString(rw.vector, rw.matrix),
+		Metric:      rw.metric,
+		Rewritten:   true,
+		Resolution:  rw.rset.StringInterval,
+		Aggregation: rw.agg,
+	}
+	if rw.call != nil {
+		se.Function = rw.call.Func.Name
+		se.RewrittenFunction = rw.fn
+	}
+	if rw.avg {
+		se.Aggregation = "sum/count"
+		se.RewrittenFunction = "sum_over_time/sum_over_time"
+	}
+	return se
+}
+
+// rewritten 记录改写后的选择器
+func (se selectorExplain) rewritten(rw *selectorRewrite) selectorExplain {
+	se.Replacement = selectorString(rw.vector, rw.matrix)
+	return se
+}
+
+func selectorString(vector *parser.VectorSelector, matrix *parser.MatrixSelector) string {
+	if matrix != nil {
+		return matrix.String()
+	}
+	return vector.String()
+}
+
+// explainData 是 explain 接口的结果, 与实际转发使用同样的改写逻辑
+type explainData struct {
+	QueryType      string `json:"queryType"`
+	Query          string `json:"query"`
+	ParsedQuery    string `json:"parsedQuery"`
+	RewrittenQuery string `json:"rewrittenQuery"`
+	Downsample     bool   `json:"downsample"`
+	Fallback       bool   `json:"fallback"`
+	// 外层查询使用的 resolution, 只改写子查询时为空
+	Resolution string `json:"resolution,omitempty"`
+
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	Step  string `json:"step,omitempty"`
+	Time  string `json:"time,omitempty"`
+
+	DefaultLookBackDelta string `json:"defaultLookbackDelta"`
+	LookBackDelta        string `json:"lookbackDelta,omitempty"`
+
+	Backend string `json:"backend"`
+	// 在原始数据保留边界拆分时, 拆分点之后的部分查询原始数据源
+	StitchAt string `json:"stitchAt,omitempty"`
+
+	Selectors []selectorExplain `json:"selectors"`
+}
+
+// explainHandler 返回查询在 proxy 中的改写过程, 不实际执行查询
+// 参数与 query/query_range 一致, 指定 start/end/step 时按 range query 改写, 否则按 instant query 改写
+func (p *Proxy) explainHandler(c *gin.Context) {
+	q, err := p.bindQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "errorType": "bad_data", "error": err.Error()})
+		return
+	}
+
+	queryPath, queryType := instantQueryPath, instantQ
+	if q.Start > 0 || q.End > 0 || q.Step > 0 {
+		queryPath, queryType = rangeQueryPath, rangeQ
+	}
+
+	query := q.Query
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "error", "errorType": "bad_data", "error": err.Error()})
+		return
+	}
+
+	replaceR := p.queryReplace(q, queryPath)
+
+	data := explainData{
+		QueryType:            queryType,
+		Query:                query,
+		ParsedQuery:          expr.String(),
+		RewrittenQuery:       replaceR.finalQuery,
+		Downsample:           !q.downsampleOff(),
+		Fallback:             replaceR.fallback,
+		DefaultLookBackDelta: replaceR.defaultLookBackDelta.String(),
+		Backend:              p.targetBackend(replaceR),
+		Selectors:            p.explainSelectors(q.Query, replaceR.selectors),
+	}
+	if replaceR.resolution != nil {
+		data.Resolution = replaceR.resolution.StringInterval
+	}
+
+	if queryPath == instantQueryPath {
+		data.Time = p.changeTime(q.Time)
+	} else {
+		replaceR.align(q)
+		data.Start, data.End = p.changeTime(q.Start), p.changeTime(q.End)
+		data.Step = (time.Duration(q.Step) * time.Second).String()
+		data.LookBackDelta = p.lookBackDeltaParam(replaceR)
+		if split, ok := p.stitchPoint(q, replaceR, time.Now()); ok {
+			data.StitchAt = p.changeTime(split)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": data})
+}
+
+// explainSelectors 在改写结果之外, 补充匹配 proxy_metrics 但没有改写的选择器
+func (p *Proxy) explainSelectors(query string, rewritten []selectorExplain) []selectorExplain {
+	selectors := append([]selectorExplain{}, rewritten...)
+
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return selectors
+	}
+	done := make(map[string]int)
+	for _, se := range rewritten {
+		done[se.Selector]++
+	}
+
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		var (
+			vector *parser.VectorSelector
+			matrix *parser.MatrixSelector
+		)
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			vector, matrix = n.VectorSelector.(*parser.VectorSelector), n
+		case *parser.VectorSelector:
+			if len(path) > 0 {
+				if _, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+					return nil
+				}
+			}
+			vector = n
+		default:
+			return nil
+		}
+
+		_, metric, ok := p.checkMetricName(vector)
+		if !ok {
+			return nil
+		}
+		s := selectorString(vector, matrix)
+		if done[s] > 0 {
+			done[s]--
+			return nil
+		}
+		selectors = append(selectors, selectorExplain{Selector: s, Metric: metric})
+		return nil
+	})
+	return selectors
+}
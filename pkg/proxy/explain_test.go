@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExplainHandler(t *testing.T) {
+	p := newTestProxy("x", "avg", "max")
+	p.rowProxyPath, p.downsampleProxyPath = "http://row", "http://downsample"
+
+	v := url.Values{}
+	v.Set("query", `max_over_time(x[1d]) / quantile_over_time(0.5, x[1h])`)
+	v.Set("time", "5184000")
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, explainPath+"?"+v.Encode(), nil)
+	p.explainHandler(c)
+
+	var resp struct {
+		Status string      `json:"status"`
+		Data   explainData `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	data := resp.Data
+	if data.QueryType != instantQ || data.Backend != "http://row" {
+		t.Fatalf("unexpected explain %+v", data)
+	}
+	if want := mustFormat(t, `max_over_time({__name__="x:downsample_5m_max"}[1d]) / quantile_over_time(0.5, x[1h])`); data.RewrittenQuery != want {
+		t.Fatalf("got rewritten query %s, want %s", data.RewrittenQuery, want)
+	}
+	// 改写的选择器在前, 匹配但没有改写的选择器在后
+	if len(data.Selectors) != 2 {
+		t.Fatalf("unexpected selectors %+v", data.Selectors)
+	}
+	if se := data.Selectors[0]; !se.Rewritten || se.Selector != "x[1d]" || se.Aggregation != "max" || se.Resolution != "5m" || se.Function != "max_over_time" {
+		t.Fatalf("unexpected rewritten selector %+v", se)
+	}
+	if se := data.Selectors[1]; se.Rewritten || se.Selector != "x[1h]" {
+		t.Fatalf("unexpected selector %+v", se)
+	}
+
+	// range query 使用降采样数据源, 并修改 lookback_delta
+	p.prometheusSupportLookBackDelta = true
+	v = url.Values{}
+	v.Set("query", `x`)
+	v.Set("start", "0")
+	v.Set("end", "5184000")
+	v.Set("step", "3600")
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, explainPath+"?"+v.Encode(), nil)
+	p.explainHandler(c)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	data = resp.Data
+	if data.QueryType != rangeQ || data.Backend != "http://downsample" || data.Resolution != "5m" || data.LookBackDelta != "10m0s" {
+		t.Fatalf("unexpected explain %+v", data)
+	}
+
+	// explain 只计算改写结果, 不计入改写打点
+	for _, queryType := range []string{instantQ, rangeQ} {
+		if n := testutil.ToFloat64(p.proxyDownsampleTotalCounter.WithLabelValues(queryType)); n != 0 {
+			t.Fatalf("explain counted %v %s query rewrites", n, queryType)
+		}
+	}
+}
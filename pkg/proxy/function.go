@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// rangeFuncTier 是 range vector 函数在降采样数据上的等价改写: 使用 agg 的降采样指标, 并把函数替换为 fn (为空表示不变)
+type rangeFuncTier struct {
+	agg string
+	fn  string
+}
+
+// rangeFuncTiers 中没有的函数 (quantile_over_time/stddev_over_time/changes/irate 等) 在降采样数据上没有正确的结果, 只能查询原始数据
+// avg_over_time 只能改写为 sum/count, 各窗口 avg 的平均值与原始数据的平均值不一致;
+// rate/increase 在窗口内发生 counter 重置时, last 降采样丢失了重置前的增量, 同样只能查询原始数据
+var rangeFuncTiers = map[string]rangeFuncTier{
+	"max_over_time":  {agg: "max"},
+	"min_over_time":  {agg: "min"},
+	"sum_over_time":  {agg: "sum"},
+	"last_over_time": {agg: "last"},
+	// 每个窗口的点数之和即为总点数
+	"count_over_time": {agg: "count", fn: "sum_over_time"},
+}
+
+// selectorRewrite 是对一个需要代理的选择器的改写
+type selectorRewrite struct {
+	vector *parser.VectorSelector
+	matrix *parser.MatrixSelector // 为 nil 表示不在 range vector 中的选择器
+	metric string
+	agg    string
+	rset   *pb.ResolutionSet
+	// 包裹选择器的最内层子查询, 为 nil 表示不在子查询中
+	subquery *parser.SubqueryExpr
+
+	// 需要替换函数时, call 为包裹 matrix 的函数, parent 为 call 的父节点 (nil 表示 call 是根节点)
+	call   *parser.Call
+	parent parser.Node
+	fn     string
+	// avg_over_time 改写为 sum_over_time(:sum) / sum_over_time(:count)
+	avg bool
+}
+
+// planRewrites 找出 expr 中所有需要代理的选择器, 并按照包裹它的函数选择降采样聚合
+// range query (instant 为 false) 的选择器使用 rset, 不在 range vector 中的选择器使用默认聚合, rset 为空时不改写子查询之外的选择器;
+// instant query 按照 range vector 的窗口选择 resolution, 只改写 range vector
+// 子查询中的选择器按照子查询的窗口和 step 选择 resolution
+// controls 中选择器指定的 resolution 和聚合优先于自动选择
+// 存在需要代理但没有正确降采样聚合, 或降采样指标没有覆盖 ts 处计算所需数据的选择器时返回 fallback;
+// raw 为需要代理但没有合适的 resolution 或被指定使用原始数据, 仍然查询原始指标的选择器数量
+func (p *Proxy) planRewrites(
+	expr parser.Expr,
+	rset *pb.ResolutionSet,
+	instant bool,
+	start, end time.Time,
+	controls map[*parser.VectorSelector]selectorControl,
+) (rewrites []*selectorRewrite, raw int, fallback bool) {
+	subqueryRsets := make(map[*parser.SubqueryExpr]*pb.ResolutionSet)
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		var parent parser.Node
+		if len(path) > 0 {
+			parent = path[len(path)-1]
+		}
+
+		rs, sq := rset, enclosingSubquery(path)
+		if sq != nil {
+			if _, ok := subqueryRsets[sq]; !ok {
+				subqueryRsets[sq], _ = p.selectRangeResolution(sq.Range, sq.Step)
+			}
+			rs = subqueryRsets[sq]
+		}
+		from, to := subqueryFrom(start, path), subqueryTo(end, path)
+
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			vector := n.VectorSelector.(*parser.VectorSelector)
+			mp, metricName, metricFind := p.checkMetricName(vector)
+			if !metricFind {
+				return nil
+			}
+
+			if instant && sq == nil {
+				rs, _ = p.checkResolution(n.Range, instantQ)
+			}
+			ctl := controls[vector]
+			if rs = p.controlResolution(ctl, rs); rs == nil {
+				raw++
+				return nil
+			}
+
+			rw := &selectorRewrite{vector: vector, matrix: n, metric: metricName, rset: rs, subquery: sq}
+			call, ok := parent.(*parser.Call)
+			switch {
+			case len(ctl.agg) > 0:
+				rw.planControl(call, ctl.agg)
+			case !ok:
+				// 直接查询 range vector 的原始点, 使用默认聚合
+				rw.agg = mp.Agg
+			case !rw.planCall(call, mp):
+				fallback = true
+				return nil
+			}
+			if call != nil && len(path) > 1 {
+				rw.parent = path[len(path)-2]
+			}
+			if (len(rw.agg) == 0 && !rw.avg) || !rw.rangeCovered() || !p.covered(rw, from, to) {
+				fallback = true
+				return nil
+			}
+			rewrites = append(rewrites, rw)
+		case *parser.VectorSelector:
+			// range vector 中的选择器已经在 MatrixSelector 中处理
+			// instant query 不修改 lookback_delta, 不在 range vector 中的选择器改写后可能查不到数据
+			if _, ok := parent.(*parser.MatrixSelector); ok || instant {
+				return nil
+			}
+			mp, metricName, metricFind := p.checkMetricName(n)
+			if !metricFind {
+				return nil
+			}
+			ctl := controls[n]
+			if rs = p.controlResolution(ctl, rs); rs == nil {
+				raw++
+				return nil
+			}
+			rw := &selectorRewrite{vector: n, metric: metricName, agg: mp.Agg, rset: rs, subquery: sq}
+			if len(ctl.agg) > 0 {
+				rw.agg = ctl.agg
+			}
+			if len(rw.agg) == 0 || !p.covered(rw, from, to) {
+				fallback = true
+				return nil
+			}
+			rewrites = append(rewrites, rw)
+		}
+		return nil
+	})
+	return rewrites, raw, fallback
+}
+
+// enclosingSubquery 返回最内层包裹当前节点的子查询
+func enclosingSubquery(path []parser.Node) *parser.SubqueryExpr {
+	for i := len(path) - 1; i >= 0; i-- {
+		if sq, ok := path[i].(*parser.SubqueryExpr); ok {
+			return sq
+		}
+	}
+	return nil
+}
+
+// subqueryFrom 返回当前节点最早的计算时间, 每层子查询向前回溯其窗口和 offset
+func subqueryFrom(ts time.Time, path []parser.Node) time.Time {
+	for _, node := range path {
+		if sq, ok := node.(*parser.SubqueryExpr); ok {
+			ts = ts.Add(-sq.Range - sq.OriginalOffset)
+		}
+	}
+	return ts
+}
+
+// subqueryTo 返回 ts 处计算时外层所有子查询最晚的计算时间
+func subqueryTo(ts time.Time, path []parser.Node) time.Time {
+	for _, node := range path {
+		if sq, ok := node.(*parser.SubqueryExpr); ok {
+			ts = ts.Add(-sq.OriginalOffset)
+		}
+	}
+	return ts
+}
+
+// additive 判断改写后的函数是否累加窗口内的每个点 (sum/count 降采样指标), 扩大窗口会重复计入相邻窗口, 结果偏大
+func (rw *selectorRewrite) additive() bool {
+	return !rw.avg && (rw.agg == "sum" || rw.agg == "count")
+}
+
+// rangeCovered 判断累加的函数的 range 是否至少包含一个完整的降采样窗口, range 小于 resolution 时无法在降采样数据上计算, 只能查询原始数据
+func (rw *selectorRewrite) rangeCovered() bool {
+	return rw.matrix == nil || !rw.additive() || rw.matrix.Range >= time.Duration(rw.rset.SampleInterval)
+}
+
+// expandRange 判断当前 range 是否 < resolution * 4, 如果是, 则替换为 resolution * 4 的 range vector, 保证窗口内有足够的降采样点
+// 只扩大 max/min/last/avg 等重复计算结果不变的改写, sum/count 保持原 range
+func (rw *selectorRewrite) expandRange() {
+	if rw.additive() {
+		return
+	}
+	if interval := time.Duration(rw.rset.SampleInterval); rw.matrix != nil && rw.matrix.Range < interval*pb.ExtrapolatedMultiple {
+		rw.matrix.Range = interval * pb.ExtrapolatedMultiple
+	}
+}
+
+func (rw *selectorRewrite) planCall(call *parser.Call, mp pb.MetricProxy) bool {
+	rw.call = call
+	if call.Func.Name == "avg_over_time" && mp.Has("sum") && mp.Has("count") {
+		rw.avg = true
+		return true
+	}
+
+	tier, ok := rangeFuncTiers[call.Func.Name]
+	if !ok || !mp.Has(tier.agg) {
+		return false
+	}
+	rw.agg, rw.fn = tier.agg, tier.fn
+	return true
+}
+
+// planControl 使用 __agg__ 指定的聚合, 只有函数的等价改写使用同一个聚合时才替换函数
+func (rw *selectorRewrite) planControl(call *parser.Call, agg string) {
+	rw.agg = agg
+	if call == nil {
+		return
+	}
+	if tier, ok := rangeFuncTiers[call.Func.Name]; ok && tier.agg == agg {
+		rw.call, rw.fn = call, tier.fn
+	}
+}
+
+// controlResolution 返回 __resolution__ 指定的 resolution, 没有指定时返回 rs; 指定 raw 或不存在的 resolution 时返回 nil, 查询原始数据
+func (p *Proxy) controlResolution(ctl selectorControl, rs *pb.ResolutionSet) *pb.ResolutionSet {
+	switch {
+	case ctl.raw():
+		return nil
+	case len(ctl.resolution) == 0:
+		return rs
+	}
+
+	if rs = p.resolutionByInterval(ctl.resolution); rs == nil {
+		logrus.WithField("resolution", ctl.resolution).Warnln("unknown downsample resolution in query, use raw data")
+	}
+	return rs
+}
+
+// apply 执行改写, 函数被替换为新的表达式时返回新的根节点
+func (p *Proxy) apply(root parser.Expr, rw *selectorRewrite) parser.Expr {
+	if !rw.avg {
+		p.injectReplacedMetric(rw.vector, rw.metric, rw.agg, rw.rset.StringInterval)
+		if len(rw.fn) > 0 {
+			rw.call.Func = parser.Functions[rw.fn]
+		}
+		return root
+	}
+
+	countVector := cloneVectorSelector(rw.vector)
+	p.injectReplacedMetric(rw.vector, rw.metric, "sum", rw.rset.StringInterval)
+	p.injectReplacedMetric(countVector, rw.metric, "count", rw.rset.StringInterval)
+
+	sumOverTime := parser.Functions["sum_over_time"]
+	div := &parser.ParenExpr{Expr: &parser.BinaryExpr{
+		Op:             parser.DIV,
+		LHS:            &parser.Call{Func: sumOverTime, Args: parser.Expressions{rw.matrix}},
+		RHS:            &parser.Call{Func: sumOverTime, Args: parser.Expressions{&parser.MatrixSelector{VectorSelector: countVector, Range: rw.matrix.Range}}},
+		VectorMatching: &parser.VectorMatching{Card: parser.CardOneToOne},
+	}}
+	return replaceNode(root, rw.parent, rw.call, div)
+}
+
+// covered 判断改写后的降采样指标是否存在且覆盖 [from, to] 处计算所需的数据, __name__ 为正则时无法判断, 认为覆盖
+func (p *Proxy) covered(rw *selectorRewrite, from, to time.Time) bool {
+	for _, m := range rw.vector.LabelMatchers {
+		if m.Name == pb.MetricLabelName && m.Type != labels.MatchEqual {
+			return true
+		}
+	}
+
+	var rge time.Duration
+	if rw.matrix != nil {
+		rge = rw.matrix.Range
+	}
+	first, last := selectorFrom(from, rw.vector, rge), selectorTo(to, rw.vector)
+
+	aggs := []string{rw.agg}
+	if rw.avg {
+		aggs = []string{"sum", "count"}
+	}
+	for _, agg := range aggs {
+		name := fmt.Sprintf(pb.DownSampleMetricExtendFormat, rw.metric, rw.rset.StringInterval, agg)
+		if !p.index.covered(name, first, last, time.Duration(rw.rset.SampleInterval)) {
+			return false
+		}
+	}
+	return true
+}
+
+func cloneVectorSelector(v *parser.VectorSelector) *parser.VectorSelector {
+	c := *v
+	c.LabelMatchers = make([]*labels.Matcher, 0, len(v.LabelMatchers))
+	for _, m := range v.LabelMatchers {
+		c.LabelMatchers = append(c.LabelMatchers, labels.MustNewMatcher(m.Type, m.Name, m.Value))
+	}
+	return &c
+}
+
+// replaceNode 将 parent 中的子节点 old 替换为 new, parent 为 nil 时 old 是根节点
+func replaceNode(root parser.Expr, parent parser.Node, old, new parser.Expr) parser.Expr {
+	switch n := parent.(type) {
+	case nil:
+		return new
+	case *parser.Call:
+		for i := range n.Args {
+			if n.Args[i] == old {
+				n.Args[i] = new
+			}
+		}
+	case *parser.AggregateExpr:
+		if n.Expr == old {
+			n.Expr = new
+		}
+		if n.Param == old {
+			n.Param = new
+		}
+	case *parser.BinaryExpr:
+		if n.LHS == old {
+			n.LHS = new
+		}
+		if n.RHS == old {
+			n.RHS = new
+		}
+	case *parser.ParenExpr:
+		n.Expr = new
+	case *parser.UnaryExpr:
+		n.Expr = new
+	case *parser.SubqueryExpr:
+		n.Expr = new
+	case *parser.StepInvariantExpr:
+		n.Expr = new
+	}
+	return root
+}
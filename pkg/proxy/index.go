@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+const (
+	// 覆盖起始时间二分查找的精度
+	coveragePrecision = time.Hour
+	// 覆盖范围的缓存时长, 过期后重新查找, 以便感知回填和过期删除
+	coverageTTL = time.Hour
+	// 同时查找覆盖范围的指标数
+	coverageConcurrency = 8
+)
+
+// seriesIndex 记录降采样数据源中实际存在的降采样指标以及数据覆盖的范围
+// 指标名通过 label values 接口定期刷新; 覆盖的起始时间和最新数据时间 (watermark) 在刷新指标名后通过 series 接口二分查找并缓存,
+// 查询时只读取缓存, series 接口按 block 过滤, 精度为 block 的时间跨度
+// 第一次刷新成功之前认为所有降采样指标都存在, 覆盖范围查找成功之前认为覆盖所有时间, 与没有索引时的行为一致
+type seriesIndex struct {
+	addr        string
+	api         v1.API
+	maxLookback time.Duration
+
+	lock     sync.Mutex
+	ready    bool
+	names    map[string]struct{}
+	coverage map[string]coverage
+}
+
+type coverage struct {
+	start time.Time
+	// 查找时最新数据的时间, 降采样停止写入后不再前进
+	end     time.Time
+	checked time.Time
+}
+
+func newSeriesIndex(addr string, maxLookback time.Duration) (*seriesIndex, error) {
+	client, err := api.NewClient(api.Config{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+
+	return &seriesIndex{
+		addr:        addr,
+		api:         v1.NewAPI(client),
+		maxLookback: maxLookback,
+		names:       make(map[string]struct{}),
+		coverage:    make(map[string]coverage),
+	}, nil
+}
+
+// run 定期刷新降采样指标名, 直到 ctx 结束
+func (s *seriesIndex) run(ctx context.Context, interval time.Duration) {
+	s.refresh(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refresh(ctx)
+		}
+	}
+}
+
+func (s *seriesIndex) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	values, _, err := s.api.LabelValues(
+		ctx,
+		pb.MetricLabelName,
+		[]string{fmt.Sprintf(`{%s=~".+:downsample_.+"}`, pb.MetricLabelName)},
+		time.Time{},
+		time.Time{},
+	)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"addr":  s.addr,
+			"error": err,
+		}).Errorln("refresh downsample series index failed")
+		return
+	}
+
+	names := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		names[string(v)] = struct{}{}
+	}
+
+	s.lock.Lock()
+	s.names = names
+	s.ready = true
+	// 已经不存在的指标不再需要覆盖起始时间
+	for name := range s.coverage {
+		if _, ok := names[name]; !ok {
+			delete(s.coverage, name)
+		}
+	}
+	s.lock.Unlock()
+
+	s.refreshCoverage(ctx, names)
+}
+
+// refreshCoverage 并行查找没有缓存或缓存过期的指标的覆盖范围, 同时最多查找 coverageConcurrency 个指标
+func (s *seriesIndex) refreshCoverage(ctx context.Context, names map[string]struct{}) {
+	var (
+		sem = make(chan struct{}, coverageConcurrency)
+		wg  sync.WaitGroup
+	)
+	defer wg.Wait()
+
+	for name := range names {
+		s.lock.Lock()
+		cov, ok := s.coverage[name]
+		s.lock.Unlock()
+		if ok && time.Since(cov.checked) <= coverageTTL {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			cov, err := s.findCoverage(ctx, name)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"metric": name,
+					"error":  err,
+				}).Errorln("find downsample series coverage failed")
+				return
+			}
+
+			s.lock.Lock()
+			s.coverage[name] = cov
+			s.lock.Unlock()
+		}(name)
+	}
+}
+
+// covered 判断降采样指标 name 是否存在且数据覆盖 [from, to], 只读取缓存, 不会请求数据源
+// 最新数据时间是 checked 时查找的, 之后持续写入的数据未知, 并且最近的窗口要在结束后才写出,
+// 因此 to 允许超过最新数据时间 距离查找的时长 + 2 个 interval + 查找精度, 超过时认为降采样已停止写入, 近期数据不完整
+func (s *seriesIndex) covered(name string, from, to time.Time, interval time.Duration) bool {
+	if s == nil {
+		return true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.ready {
+		return true
+	}
+	if _, ok := s.names[name]; !ok {
+		return false
+	}
+	cov, ok := s.coverage[name]
+	if !ok {
+		return true
+	}
+	if from.Before(cov.start) {
+		return false
+	}
+	lag := time.Since(cov.checked) + 2*interval + coveragePrecision
+	return cov.end.IsZero() || to.Sub(cov.end) <= lag
+}
+
+// findCoverage 查找 name 覆盖的起始时间和最新数据时间
+func (s *seriesIndex) findCoverage(ctx context.Context, name string) (coverage, error) {
+	start, err := s.coverageStart(ctx, name)
+	if err != nil {
+		return coverage{}, err
+	}
+	end, err := s.coverageEnd(ctx, name, start)
+	if err != nil {
+		return coverage{}, err
+	}
+	return coverage{start: start, end: end, checked: time.Now()}, nil
+}
+
+// coverageStart 二分查找 name 最早存在数据的时间, 假设降采样数据从起始时间开始是连续的
+// 回溯范围的起始时间就存在数据时, 无法确定更早的数据是否存在, 返回零值表示覆盖所有时间
+func (s *seriesIndex) coverageStart(ctx context.Context, name string) (time.Time, error) {
+	now := time.Now()
+	lo, hi := now.Add(-s.maxLookback), now
+	match := []string{fmt.Sprintf(`{%s=%q}`, pb.MetricLabelName, name)}
+
+	exists := func(end time.Time) (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		series, _, err := s.api.Series(ctx, match, lo, end)
+		return len(series) > 0, err
+	}
+
+	ok, err := exists(hi)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		// 回溯范围内没有数据, 任何查询都不覆盖
+		return now, nil
+	}
+	if ok, err := exists(lo); err != nil || ok {
+		return time.Time{}, err
+	}
+
+	for hi.Sub(lo) > coveragePrecision {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		ok, err := exists(mid)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, nil
+}
+
+// coverageEnd 二分查找 name 最新数据的时间, start 为覆盖起始时间
+// 最近一个精度范围内存在数据时返回零值, 表示仍在持续写入
+func (s *seriesIndex) coverageEnd(ctx context.Context, name string, start time.Time) (time.Time, error) {
+	now := time.Now()
+	lo, hi := now.Add(-s.maxLookback), now
+	if start.After(lo) {
+		lo = start
+	}
+	if !lo.Before(hi) {
+		// 回溯范围内没有数据
+		return lo, nil
+	}
+	match := []string{fmt.Sprintf(`{%s=%q}`, pb.MetricLabelName, name)}
+
+	// exists 判断 [from, now] 内是否存在数据
+	exists := func(from time.Time) (bool, error) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		series, _, err := s.api.Series(ctx, match, from, now)
+		return len(series) > 0, err
+	}
+
+	if ok, err := exists(now.Add(-coveragePrecision)); err != nil || ok {
+		return time.Time{}, err
+	}
+	for hi.Sub(lo) > coveragePrecision {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		ok, err := exists(mid)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// selectorFrom 返回查询在 ts 处计算时选择器最早需要的数据时间
+func selectorFrom(ts time.Time, vector *parser.VectorSelector, rge time.Duration) time.Time {
+	return ts.Add(-vector.OriginalOffset - rge)
+}
+
+// selectorTo 返回查询在 ts 处计算时选择器最晚需要的数据时间
+func selectorTo(ts time.Time, vector *parser.VectorSelector) time.Time {
+	return ts.Add(-vector.OriginalOffset)
+}
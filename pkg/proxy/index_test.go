@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// indexServer 模拟降采样数据源, 只有 x:downsample_5m_max 存在, 数据从 coverageStart 开始, 到 coverageEnd 结束, coverageEnd 为零值时持续写入
+func indexServer(coverageStart, coverageEnd time.Time) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/api/v1/label/__name__/values":
+			fmt.Fprint(w, `{"status":"success","data":["x:downsample_5m_max"]}`)
+		case "/api/v1/series":
+			start, _ := strconv.ParseFloat(r.Form.Get("start"), 64)
+			end, _ := strconv.ParseFloat(r.Form.Get("end"), 64)
+			if r.Form.Get("match[]") != `{__name__="x:downsample_5m_max"}` || end < float64(coverageStart.Unix()) ||
+				(!coverageEnd.IsZero() && start > float64(coverageEnd.Unix())) {
+				fmt.Fprint(w, `{"status":"success","data":[]}`)
+				return
+			}
+			fmt.Fprint(w, `{"status":"success","data":[{"__name__":"x:downsample_5m_max"}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestRangeQueryReplaceCoverage(t *testing.T) {
+	now := time.Now()
+	srv := indexServer(now.Add(-10*24*time.Hour), time.Time{})
+	defer srv.Close()
+
+	index, err := newSeriesIndex(srv.URL, 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.refresh(context.Background())
+
+	p := newTestProxy("x", "avg", "max", "min")
+	p.index = index
+	end := float64(now.Unix())
+
+	for _, tc := range []struct {
+		query    string
+		days     float64
+		replaced bool
+	}{
+		{`max_over_time(x[1h])`, 5, true},
+		// 查询范围早于降采样数据的起始时间
+		{`max_over_time(x[1h])`, 30, false},
+		// 降采样指标不存在
+		{`min_over_time(x[1h])`, 5, false},
+		{`x`, 5, false},
+	} {
+		rr := p.rangeQueryReplace(tc.query, end-tc.days*24*3600, end, 3600)
+		if rr.needChangeLookBackDelta != tc.replaced {
+			t.Errorf("%s over %vd: got replaced %v, want %v (%s)", tc.query, tc.days, rr.needChangeLookBackDelta, tc.replaced, rr.finalQuery)
+		}
+		if !tc.replaced && rr.finalQuery != tc.query {
+			t.Errorf("%s over %vd: expected raw query, got %s", tc.query, tc.days, rr.finalQuery)
+		}
+	}
+
+	cov := index.coverage["x:downsample_5m_max"]
+	if d := cov.start.Sub(now.Add(-10 * 24 * time.Hour)); d < 0 || d > coveragePrecision {
+		t.Fatalf("unexpected coverage start %s", cov.start)
+	}
+	if !cov.end.IsZero() {
+		t.Fatalf("got coverage end %s, want live", cov.end)
+	}
+}
+
+func TestSeriesIndexCoverageEnd(t *testing.T) {
+	now := time.Now()
+	// 降采样 2 天前停止写入
+	srv := indexServer(now.Add(-10*24*time.Hour), now.Add(-2*24*time.Hour))
+	defer srv.Close()
+
+	index, err := newSeriesIndex(srv.URL, 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.refresh(context.Background())
+
+	cov := index.coverage["x:downsample_5m_max"]
+	if d := now.Add(-2 * 24 * time.Hour).Sub(cov.end); d < 0 || d > coveragePrecision {
+		t.Fatalf("unexpected coverage end %s", cov.end)
+	}
+
+	p := newTestProxy("x", "avg", "max")
+	p.index = index
+	for _, tc := range []struct {
+		end      time.Time
+		replaced bool
+	}{
+		{now.Add(-3 * 24 * time.Hour), true},
+		// 查询结束时间晚于最新数据
+		{now, false},
+	} {
+		end := float64(tc.end.Unix())
+		rr := p.rangeQueryReplace(`max_over_time(x[1h])`, end-5*24*3600, end, 3600)
+		if rr.needChangeLookBackDelta != tc.replaced {
+			t.Errorf("end %s: got replaced %v, want %v (%s)", tc.end, rr.needChangeLookBackDelta, tc.replaced, rr.finalQuery)
+		}
+	}
+}
+
+func TestSeriesIndexCoverageUnbounded(t *testing.T) {
+	now := time.Now()
+	// 数据早于回溯范围的起始时间
+	srv := indexServer(now.Add(-200*24*time.Hour), time.Time{})
+	defer srv.Close()
+
+	index, err := newSeriesIndex(srv.URL, 90*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.refresh(context.Background())
+
+	if cov := index.coverage["x:downsample_5m_max"]; !cov.start.IsZero() {
+		t.Fatalf("got coverage start %s, want unbounded", cov.start)
+	}
+	if !index.covered("x:downsample_5m_max", now.Add(-365*24*time.Hour), now, 5*time.Minute) {
+		t.Fatal("expected coverage before max lookback")
+	}
+}
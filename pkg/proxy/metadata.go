@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+const metadataPath = "/api/v1/metadata"
+
+// metadataHandler 代替 /api/v1/metadata, 在原始指标的元数据之外
+// 为需要代理的指标在每个 resolution 下按每个可用的聚合补充降采样指标的元数据, 使 grafana 等可以看到降采样指标的类型和说明
+// 参数与 prometheus 一致: metric 只返回指定指标, limit 限制返回的指标数, limit_per_metric 限制每个指标返回的条目数
+// 元数据缓存未就绪或最近一次刷新失败时直接转发给原始数据源, 避免返回缺失或过期的结果
+func (p *Proxy) metadataHandler(c *gin.Context, upstream *url.URL) {
+	if !p.metadata.Ready() {
+		httputil.NewSingleHostReverseProxy(upstream).ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	// 解析失败时为 0, 不限制
+	limitPerMetric, _ := strconv.Atoi(c.Query("limit_per_metric"))
+	original := func(mds []v1.Metadata) []v1.Metadata {
+		if limitPerMetric > 0 && limitPerMetric < len(mds) {
+			return mds[:limitPerMetric]
+		}
+		return mds
+	}
+
+	data := make(map[string][]v1.Metadata)
+
+	if metric := c.Query("metric"); len(metric) > 0 {
+		if md, ok := p.metadata.Downsample(metric); ok {
+			data[metric] = []v1.Metadata{toV1Metadata(md.Type.String(), md.Help, md.Unit)}
+		} else if mds, ok := p.metadata.Metadata()[metric]; ok {
+			data[metric] = original(mds)
+		}
+	} else {
+		for name, mds := range p.metadata.Metadata() {
+			data[name] = original(mds)
+
+			mp, _, ok := p.mps.Contains(name)
+			if !ok {
+				continue
+			}
+			for _, rs := range p.resolutions {
+				for _, agg := range mp.AllAggs() {
+					ds := fmt.Sprintf(pb.DownSampleMetricExtendFormat, name, rs.StringInterval, agg)
+					if dmd, ok := p.metadata.Downsample(ds); ok {
+						data[ds] = []v1.Metadata{toV1Metadata(dmd.Type.String(), dmd.Help, dmd.Unit)}
+					}
+				}
+			}
+		}
+	}
+
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit >= 0 && limit < len(data) {
+		names := make([]string, 0, len(data))
+		for name := range data {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names[limit:] {
+			delete(data, name)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": data})
+}
+
+func toV1Metadata(tp, help, unit string) v1.Metadata {
+	return v1.Metadata{
+		Type: v1.MetricType(strings.ToLower(tp)),
+		Help: help,
+		Unit: unit,
+	}
+}
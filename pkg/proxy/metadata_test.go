@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+
+	p8s "prom-stream-downsample/pkg/prometheus"
+)
+
+func TestMetadataHandler(t *testing.T) {
+	var failed atomic.Bool
+	failed.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failed.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{
+			"x":[{"type":"gauge","help":"X.","unit":""},{"type":"gauge","help":"Another x.","unit":""}]
+		}}`))
+	}))
+	defer srv.Close()
+	upstream, _ := url.Parse(srv.URL)
+
+	serve := func(p *Proxy, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(closeNotifyRecorder{w})
+		c.Request = httptest.NewRequest(http.MethodGet, metadataPath+"?"+query, nil)
+		p.metadataHandler(c, upstream)
+		return w
+	}
+
+	// 第一次拉取在后台进行, 完成前缓存未就绪, 转发给原始数据源
+	p := newTestProxy("x", "avg", "max")
+	metadata, err := p8s.NewMetadataCache(srv.URL, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.metadata = metadata
+	if w := serve(p, ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want upstream status", w.Code)
+	}
+
+	failed.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go metadata.Run(ctx)
+	for deadline := time.Now().Add(5 * time.Second); !metadata.Ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("metadata cache not ready")
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"", 2},
+		{"limit_per_metric=1", 1},
+		{"metric=x&limit_per_metric=1", 1},
+	} {
+		w := serve(p, tc.query)
+		var resp struct {
+			Data map[string][]v1.Metadata `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(resp.Data["x"]); got != tc.want {
+			t.Fatalf("query %q: got %d metadata for x, want %d", tc.query, got, tc.want)
+		}
+		if tc.query != "metric=x&limit_per_metric=1" {
+			for _, ds := range []string{"x:downsample_5m_avg", "x:downsample_5m_max"} {
+				if len(resp.Data[ds]) != 1 {
+					t.Fatalf("query %q: missing downsample metadata %s in %+v", tc.query, ds, resp.Data)
+				}
+			}
+		}
+	}
+}
+
+// closeNotifyRecorder 为 ResponseRecorder 补充 CloseNotify, gin 转发请求时需要
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (closeNotifyRecorder) CloseNotify() <-chan bool {
+	return nil
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,11 +14,11 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"golang.org/x/mod/semver"
 
 	"prom-stream-downsample/pkg/config"
 	"prom-stream-downsample/pkg/pb"
 	p8s "prom-stream-downsample/pkg/prometheus"
+	"prom-stream-downsample/pkg/util"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -43,6 +44,8 @@ type QueryParams struct {
 	Step    int64   `form:"step" json:"step"`
 	Time    float64 `form:"time" json:"time"`
 	Timeout string  `form:"timeout" json:"timeout"`
+	// 为 off 时不使用降采样数据, 未指定时使用 X-Downsample 请求头
+	Downsample string `form:"downsample" json:"downsample"`
 }
 
 type Proxy struct {
@@ -50,6 +53,9 @@ type Proxy struct {
 	//proxyPath   string
 	rowProxyPath        string
 	downsampleProxyPath string
+	rawRetention        time.Duration
+	restoreMetricName   bool
+	downsampleLabels    bool
 	flushProxy          func() pb.MetricProxySet
 	mps                 pb.MetricProxySet
 
@@ -59,6 +65,12 @@ type Proxy struct {
 
 	prometheusInfo                 *p8s.PrometheusMetaInfo
 	prometheusSupportLookBackDelta bool
+	metadata                       *p8s.MetadataCache
+	index                          *seriesIndex
+	indexRefreshInterval           time.Duration
+	cache                          *resultsCache
+	readers                        map[string]*p8s.Prometheus // 各数据源的 remote read 客户端
+	readersLock                    sync.Mutex
 
 	proxyTotalCounter           prometheus.Counter
 	proxyDownsampleTotalCounter prometheus.CounterVec
@@ -88,6 +100,9 @@ func NewProxy(
 		//proxyPath:   proxyPath,
 		rowProxyPath:        dataSources.Row,
 		downsampleProxyPath: dataSources.Downsample,
+		rawRetention:        time.Duration(config.Get().ProxyConfig.RawRetention),
+		restoreMetricName:   config.Get().ProxyConfig.RestoreMetricName,
+		downsampleLabels:    config.Get().ProxyConfig.DownsampleLabels,
 		flushProxy:          fn,
 		mps:                 fn(),
 		reload:              ch,
@@ -107,6 +122,45 @@ func NewProxy(
 	if err := pxy.metaInfo(); err != nil {
 		return nil, err
 	}
+
+	// 原始指标的元数据从原始数据源获取
+	interval := config.Get().GlobalConfig.Metadata.RefreshInterval
+	if interval == 0 {
+		interval = config.DefaultMetadataRefreshInterval
+	}
+	metadata, err := p8s.NewMetadataCache(pxy.rowProxyPath, time.Duration(interval))
+	if err != nil {
+		return nil, err
+	}
+	pxy.metadata = metadata
+
+	// 降采样指标索引从降采样数据源获取
+	ic := config.Get().ProxyConfig.SeriesIndex
+	if ic.RefreshInterval == 0 {
+		ic.RefreshInterval = config.DefaultSeriesIndex.RefreshInterval
+	}
+	if ic.MaxLookback == 0 {
+		ic.MaxLookback = config.DefaultSeriesIndex.MaxLookback
+	}
+	index, err := newSeriesIndex(pxy.downsampleProxyPath, time.Duration(ic.MaxLookback))
+	if err != nil {
+		return nil, err
+	}
+	pxy.index = index
+	pxy.indexRefreshInterval = time.Duration(ic.RefreshInterval)
+
+	if rc := config.Get().ProxyConfig.ResultsCache; rc.Enabled {
+		if rc.SplitInterval == 0 {
+			rc.SplitInterval = config.DefaultResultsCache.SplitInterval
+		}
+		if rc.MaxSizeMB == 0 {
+			rc.MaxSizeMB = config.DefaultResultsCache.MaxSizeMB
+		}
+		if rc.MaxFreshness == 0 {
+			rc.MaxFreshness = config.DefaultResultsCache.MaxFreshness
+		}
+		pxy.cache = newResultsCache(rc.MaxSizeMB<<20, time.Duration(rc.SplitInterval), time.Duration(rc.MaxFreshness))
+	}
 	return pxy, nil
 }
 
@@ -117,7 +171,7 @@ func (p *Proxy) metaInfo() error {
 	}
 
 	// 如果当前版本号大于2.43.0，则开启自动lookbackDelta
-	if semver.Compare(semver.Build(info.Version), "2.43.0") >= 0 {
+	if util.CompareVersion(info.Version, "2.43.0") >= 0 {
 		p.prometheusSupportLookBackDelta = true
 	}
 
@@ -161,15 +215,32 @@ func (p *Proxy) injectOtherRouter() {
 	})
 }
 
-func (p *Proxy) StartProxy() {
+// StartProxy 注册代理路由并启动后台刷新, ctx 结束时停止元数据和序列索引的刷新
+func (p *Proxy) StartProxy(ctx context.Context) {
 	rowProxyUrl, _ := url.Parse(p.rowProxyPath)
 	downsampleProxyUrl, _ := url.Parse(p.downsampleProxyPath)
 
 	p.injectOtherRouter()
+	go p.metadata.Run(ctx)
+	go p.index.run(ctx, p.indexRefreshInterval)
+
 	apiV1 := p.r.Group(apiV1Prefix)
 	apiV1.Any("*name", func(c *gin.Context) {
 		p.proxyTotalCounter.Inc()
 
+		if c.Request.URL.Path == metadataPath {
+			p.metadataHandler(c, rowProxyUrl)
+			return
+		}
+		if c.Request.URL.Path == explainPath {
+			p.explainHandler(c)
+			return
+		}
+		if c.Request.URL.Path == remoteReadPath {
+			p.remoteReadHandler(c)
+			return
+		}
+
 		// 如果匹配到非 query_range/query path, 则直接转发
 		if c.Request.URL.Path != instantQueryPath &&
 			c.Request.URL.Path != rangeQueryPath {
@@ -179,19 +250,16 @@ func (p *Proxy) StartProxy() {
 		}
 
 		// 解析通用查询参数结构体
-		q := &QueryParams{}
-		if err := c.ShouldBind(q); err != nil {
-			logrus.WithFields(logrus.Fields{
-				"path": c.Request.URL.Path,
-				"err":  err,
-			}).Errorf("bind query params error: %v", err)
+		q, err := p.bindQuery(c)
+		if err != nil {
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 
 		v := url.Values{}
 		// 对instant 和 range query 的共同参数进行解析
-		replaceR := p.queryReplace(q.Query, q.Start, q.End, c.Request.URL.Path)
+		replaceR := p.queryReplace(q, c.Request.URL.Path)
+		p.observe(c.Request.URL.Path, replaceR)
 		v.Add("query", replaceR.finalQuery) // 对query进行替换
 		v.Add("timeout", q.Timeout)
 
@@ -201,15 +269,15 @@ func (p *Proxy) StartProxy() {
 		} else if c.Request.URL.Path == rangeQueryPath {
 			// 匹配到 query_range, 则将query参数中的原metric 根据 start和end 替换为对应的downsample metric
 			// 解析 range query 特有参数 start, end, step
+			// 使用降采样数据时 step 和 start 对齐到 resolution
+			replaceR.align(q)
 			step := time.Duration(q.Step) * time.Second
 			v.Add("start", p.changeTime(q.Start))
 			v.Add("end", p.changeTime(q.End))
 			v.Add("step", step.String())
 
 			// TODO 继续观察： 当前只在query_range中使用lookbackDelta参数调整功能
-			if replaceR.needChangeLookBackDelta && p.prometheusSupportLookBackDelta {
-				// 如果 在queryReplace中判定需要调整回溯窗口 且 当前p8s版本支持动态LookBackDelta功能 -> 则设置lookbackDelta参数
-				expandLookBackDelta := replaceR.autoExpandLookBackDelta()
+			if expandLookBackDelta := p.lookBackDeltaParam(replaceR); len(expandLookBackDelta) > 0 {
 				v.Add("lookback_delta", expandLookBackDelta)
 				logrus.Warnf(
 					"query [%s] auto expand lookback_delta, from [%s] to [%s]\n",
@@ -220,20 +288,68 @@ func (p *Proxy) StartProxy() {
 			}
 		}
 
+		// 配置了原始数据保留时长时, 在保留边界拆分查询, 近期部分使用原始数据
+		if c.Request.URL.Path == rangeQueryPath && p.stitchQuery(c, q, replaceR) {
+			return
+		}
+
+		// 开启结果缓存时, range query 拆分后执行, 已缓存的部分不再查询
+		if c.Request.URL.Path == rangeQueryPath && p.cache != nil {
+			p.rangeQuery(c, q, replaceR)
+			return
+		}
+
 		// 设置请求体
 		p.setRequest(c.Request, c.Request.Method, v.Encode())
 
 		// 转发请求
-		var proxyUrl *url.URL
-		if replaceR.needChangeLookBackDelta {
+		proxyUrl := rowProxyUrl
+		if p.targetBackend(replaceR) == p.downsampleProxyPath {
 			proxyUrl = downsampleProxyUrl
-		} else {
-			proxyUrl = rowProxyUrl
 		}
-		httputil.NewSingleHostReverseProxy(proxyUrl).ServeHTTP(c.Writer, c.Request)
+		rp := httputil.NewSingleHostReverseProxy(proxyUrl)
+		if p.restoreMetricName && replaceR.replaced {
+			// 由 transport 协商压缩并解压, 改写后的响应不再压缩
+			c.Request.Header.Del("Accept-Encoding")
+			rp.ModifyResponse = p.restoreResponse
+		}
+		rp.ServeHTTP(c.Writer, c.Request)
 	})
 }
 
+// bindQuery 解析 query/query_range 的参数, 未指定 downsample 参数时使用 X-Downsample 请求头
+func (p *Proxy) bindQuery(c *gin.Context) (*QueryParams, error) {
+	q := &QueryParams{}
+	if err := c.ShouldBind(q); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path": c.Request.URL.Path,
+			"err":  err,
+		}).Errorf("bind query params error: %v", err)
+		return nil, err
+	}
+	if len(q.Downsample) == 0 {
+		q.Downsample = c.GetHeader(pb.DownsampleHeader)
+	}
+	return q, nil
+}
+
+// lookBackDeltaParam 返回 range query 转发时的 lookback_delta 参数, 不需要修改时返回空
+func (p *Proxy) lookBackDeltaParam(replaceR *replaceResult) string {
+	// 如果 在queryReplace中判定需要调整回溯窗口 且 当前p8s版本支持动态LookBackDelta功能 -> 则设置lookbackDelta参数
+	if !replaceR.needChangeLookBackDelta || !p.prometheusSupportLookBackDelta {
+		return ""
+	}
+	return replaceR.autoExpandLookBackDelta()
+}
+
+// targetBackend 返回转发的数据源, 使用降采样数据时转发到 downsample 数据源
+func (p *Proxy) targetBackend(replaceR *replaceResult) string {
+	if replaceR.needChangeLookBackDelta {
+		return p.downsampleProxyPath
+	}
+	return p.rowProxyPath
+}
+
 func (p *Proxy) changeTime(t float64) string {
 	return time.Unix(int64(t), 0).UTC().Format("2006-01-02T15:04:05Z")
 }
@@ -242,6 +358,10 @@ func (p *Proxy) Reload() error {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	p.mps = p.flushProxy()
+	// 代理规则变化后缓存的改写结果不再有效
+	if p.cache != nil {
+		p.cache.reset()
+	}
 	logrus.Warnln("reload proxy success", p.mps)
 	return nil
 }
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+	p8s "prom-stream-downsample/pkg/prometheus"
+)
+
+const (
+	remoteReadPath = "/api/v1/read"
+
+	// 与 prometheus 默认的 remote read 单个 frame 大小一致
+	remoteReadMaxBytesInFrame = 1024 * 1024
+)
+
+var remoteReadMarshalPool = &sync.Pool{}
+
+// remoteReadHandler 代替 /api/v1/read, 每个 query 按时间范围和 hints 选择降采样 resolution 和聚合,
+// 可以使用降采样数据时从 downsample 数据源读取, 指标名还原为原始指标名后返回, 否则从原始数据源读取
+// 请求头 X-Downsample: off 时全部读取原始数据
+func (p *Proxy) remoteReadHandler(c *gin.Context) {
+	req, err := remote.DecodeReadRequest(c.Request)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	responseType, err := remote.NegotiateResponseType(req.AcceptedResponseTypes)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return
+	}
+	off := strings.EqualFold(c.GetHeader(pb.DownsampleHeader), pb.DownsampleOff)
+
+	// 按顺序读取每个 query, streamed 响应边读边写出, 不在内存中缓存所有 query 的结果
+	if responseType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+		c.Header("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+		flusher, _ := c.Writer.(http.Flusher)
+		for i, query := range req.Queries {
+			if err := p.streamQuery(c, flusher, int64(i), query, off); err != nil {
+				logrus.WithField("error", err).Errorln("proxy remote read stream response failed")
+				// 响应开始写出之后只能中断
+				if !c.Writer.Written() {
+					c.String(http.StatusInternalServerError, err.Error())
+				}
+				return
+			}
+		}
+		return
+	}
+
+	resp := &prompb.ReadResponse{Results: make([]*prompb.QueryResult, len(req.Queries))}
+	for i, query := range req.Queries {
+		result, err := p.sampleQuery(c.Request.Context(), query, off)
+		if err != nil {
+			logrus.WithField("error", err).Errorln("proxy remote read failed")
+			c.String(http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Results[i] = result
+	}
+	c.Header("Content-Type", "application/x-protobuf")
+	c.Header("Content-Encoding", "snappy")
+	if err := remote.EncodeReadResponse(resp, c.Writer); err != nil {
+		logrus.WithField("error", err).Errorln("proxy remote read write response failed")
+	}
+}
+
+// streamQuery 读取一个 query 并以 streamed chunk 写出, 返回后该 query 的响应已经释放
+func (p *Proxy) streamQuery(c *gin.Context, flusher http.Flusher, index int64, query *prompb.Query, off bool) error {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	set, err := p.readQuery(ctx, query, off)
+	if err != nil {
+		return err
+	}
+	_, err = remote.StreamChunkedReadResponses(
+		remote.NewChunkedWriter(c.Writer, flusher),
+		index,
+		set,
+		nil,
+		remoteReadMaxBytesInFrame,
+		remoteReadMarshalPool,
+	)
+	return err
+}
+
+func (p *Proxy) sampleQuery(ctx context.Context, query *prompb.Query, off bool) (*prompb.QueryResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	set, err := p.readQuery(ctx, query, off)
+	if err != nil {
+		return nil, err
+	}
+	result, _, err := remote.ToQueryResult(storage.NewSeriesSetFromChunkSeriesSet(set), 0)
+	return result, err
+}
+
+func (p *Proxy) readQuery(ctx context.Context, query *prompb.Query, off bool) (storage.ChunkSeriesSet, error) {
+	addr, restore := p.rowProxyPath, false
+	if !off {
+		if rewritten, ok := p.rewriteReadQuery(query); ok {
+			addr, query, restore = p.downsampleProxyPath, rewritten, true
+		}
+	}
+
+	reader, err := p.remoteReader(addr)
+	if err != nil {
+		return nil, err
+	}
+	set, err := reader.ReadQuery(ctx, query)
+	if err != nil || !restore {
+		return set, err
+	}
+	return restoredChunkSeriesSet{set}, nil
+}
+
+// remoteReader 返回数据源的 remote read 客户端, 第一次使用时创建并协商响应类型
+func (p *Proxy) remoteReader(addr string) (*p8s.Prometheus, error) {
+	p.readersLock.Lock()
+	defer p.readersLock.Unlock()
+
+	if reader, ok := p.readers[addr]; ok {
+		return reader, nil
+	}
+	reader, err := p8s.NewPrometheus([]string{strings.TrimSuffix(addr, "/") + remoteReadPath}, pb.StreamModeAuto)
+	if err != nil {
+		return nil, err
+	}
+	if p.readers == nil {
+		p.readers = make(map[string]*p8s.Prometheus)
+	}
+	p.readers[addr] = reader
+	return reader, nil
+}
+
+// rewriteReadQuery 将 query 的 __name__ 替换为降采样指标, 只支持 __name__ 为 = 的 query, 保证还原指标名后序列仍然有序
+func (p *Proxy) rewriteReadQuery(query *prompb.Query) (*prompb.Query, bool) {
+	var name *prompb.LabelMatcher
+	for _, m := range query.Matchers {
+		if m.Name != pb.MetricLabelName {
+			continue
+		}
+		if m.Type != prompb.LabelMatcher_EQ {
+			return nil, false
+		}
+		name = m
+	}
+	if name == nil {
+		return nil, false
+	}
+
+	mp, metricName, ok := p.mps.Contains(name.Value)
+	if !ok {
+		return nil, false
+	}
+	rs := p.selectReadResolution(query)
+	if rs == nil {
+		return nil, false
+	}
+	agg := readAggregation(query.Hints, mp)
+	if len(agg) == 0 {
+		return nil, false
+	}
+
+	downsampleMetric := fmt.Sprintf(pb.DownSampleMetricExtendFormat, metricName, rs.StringInterval, agg)
+	if !p.index.covered(downsampleMetric, time.UnixMilli(query.StartTimestampMs), time.UnixMilli(query.EndTimestampMs), time.Duration(rs.SampleInterval)) {
+		return nil, false
+	}
+
+	rewritten := *query
+	rewritten.Matchers = make([]*prompb.LabelMatcher, 0, len(query.Matchers))
+	for _, m := range query.Matchers {
+		if m == name {
+			m = &prompb.LabelMatcher{Type: m.Type, Name: m.Name, Value: downsampleMetric}
+		}
+		rewritten.Matchers = append(rewritten.Matchers, m)
+	}
+	return &rewritten, true
+}
+
+// selectReadResolution 选择 remote read query 使用的 resolution
+// 有 step hint 时与 query_range 一样按 step 选择, 否则按时间范围选择; 客户端按自己的窗口计算, proxy 无法扩大窗口,
+// 所以 range vector 的窗口需要覆盖 ExtrapolatedMultiple 个降采样点, 其它选择器的 lookback_delta 需要覆盖两个降采样点
+func (p *Proxy) selectReadResolution(query *prompb.Query) *pb.ResolutionSet {
+	rge := time.Duration(query.EndTimestampMs-query.StartTimestampMs) * time.Millisecond
+
+	var best *pb.ResolutionSet
+	for i := range p.resolutions {
+		rs := &p.resolutions[i]
+		interval := time.Duration(rs.SampleInterval)
+
+		if hints := query.Hints; hints != nil {
+			step := time.Duration(hints.StepMs) * time.Millisecond
+			window := time.Duration(hints.RangeMs) * time.Millisecond
+			switch {
+			case step > 0 && (interval > step || interval > rge):
+				continue
+			case step <= 0 && rge <= time.Duration(rs.TimeRange):
+				continue
+			case window > 0 && interval*pb.ExtrapolatedMultiple > window:
+				continue
+			case window <= 0 && interval*2 > p.prometheusInfo.QueryLookBackDelta:
+				continue
+			}
+		} else if rge <= time.Duration(rs.TimeRange) {
+			continue
+		}
+
+		if best == nil || interval > time.Duration(best.SampleInterval) {
+			best = rs
+		}
+	}
+	return best
+}
+
+// readAggregation 按 hints 中包裹选择器的函数选择降采样聚合, 与 query 中的改写一致; 需要替换函数的改写客户端无法执行, 返回空
+// 没有 hints 或不在 range vector 中的选择器使用默认聚合
+func readAggregation(hints *prompb.ReadHints, mp pb.MetricProxy) string {
+	if hints == nil || hints.RangeMs == 0 {
+		return mp.Agg
+	}
+	// avg_over_time 只能改写为 sum/count, 同样需要替换函数
+	if hints.Func == "avg_over_time" {
+		return ""
+	}
+	tier, ok := rangeFuncTiers[hints.Func]
+	if !ok || len(tier.fn) > 0 || !mp.Has(tier.agg) {
+		return ""
+	}
+	return tier.agg
+}
+
+// restoredChunkSeriesSet 将降采样指标名还原为原始指标名
+type restoredChunkSeriesSet struct {
+	storage.ChunkSeriesSet
+}
+
+func (s restoredChunkSeriesSet) At() storage.ChunkSeries {
+	series := s.ChunkSeriesSet.At()
+	lset := series.Labels()
+	if metric, _, _, ok := pb.ParseDownSampleMetric(lset.Get(pb.MetricLabelName)); ok {
+		lset = labels.NewBuilder(lset).Set(pb.MetricLabelName, metric).Labels()
+	}
+	return restoredChunkSeries{ChunkSeries: series, lset: lset}
+}
+
+type restoredChunkSeries struct {
+	storage.ChunkSeries
+	lset labels.Labels
+}
+
+func (s restoredChunkSeries) Labels() labels.Labels {
+	return s.lset
+}
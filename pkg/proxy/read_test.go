@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// remoteReadServer 返回 sample 响应, 每个 query 返回一个以 __name__ matcher 为指标名、值为 value 的序列
+func remoteReadServer(value float64, lock *sync.Mutex, names *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != remoteReadPath {
+			http.NotFound(w, r)
+			return
+		}
+		req, err := remote.DecodeReadRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := &prompb.ReadResponse{}
+		for _, q := range req.Queries {
+			var name string
+			for _, m := range q.Matchers {
+				if m.Name == pb.MetricLabelName {
+					name = m.Value
+				}
+			}
+			lock.Lock()
+			*names = append(*names, name)
+			lock.Unlock()
+
+			resp.Results = append(resp.Results, &prompb.QueryResult{Timeseries: []*prompb.TimeSeries{{
+				Labels:  []prompb.Label{{Name: pb.MetricLabelName, Value: name}, {Name: "job", Value: "a"}},
+				Samples: []prompb.Sample{{Timestamp: q.StartTimestampMs, Value: value}},
+			}}})
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		remote.EncodeReadResponse(resp, w)
+	}))
+}
+
+func TestRemoteReadHandler(t *testing.T) {
+	var (
+		lock              sync.Mutex
+		rowNames, dsNames []string
+	)
+	row := remoteReadServer(1, &lock, &rowNames)
+	defer row.Close()
+	ds := remoteReadServer(2, &lock, &dsNames)
+	defer ds.Close()
+
+	p := newTestProxy("x", "avg", "max")
+	p.rowProxyPath, p.downsampleProxyPath = row.URL, ds.URL
+
+	end := time.Now()
+	start := end.Add(-7 * 24 * time.Hour)
+	matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: pb.MetricLabelName, Value: "x"}}
+	req := &prompb.ReadRequest{
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS},
+		Queries: []*prompb.Query{
+			// max_over_time(x[1h]) 使用 max 聚合
+			{
+				StartTimestampMs: start.UnixMilli(),
+				EndTimestampMs:   end.UnixMilli(),
+				Matchers:         matchers,
+				Hints:            &prompb.ReadHints{Func: "max_over_time", RangeMs: time.Hour.Milliseconds(), StepMs: time.Hour.Milliseconds()},
+			},
+			// rate(x[5m]) 的窗口内降采样点不足, 读取原始数据
+			{
+				StartTimestampMs: start.UnixMilli(),
+				EndTimestampMs:   end.UnixMilli(),
+				Matchers:         matchers,
+				Hints:            &prompb.ReadHints{Func: "rate", RangeMs: (5 * time.Minute).Milliseconds(), StepMs: time.Hour.Milliseconds()},
+			},
+			// avg_over_time 在 avg 降采样数据上没有正确的结果, 读取原始数据
+			{
+				StartTimestampMs: start.UnixMilli(),
+				EndTimestampMs:   end.UnixMilli(),
+				Matchers:         matchers,
+				Hints:            &prompb.ReadHints{Func: "avg_over_time", RangeMs: time.Hour.Milliseconds(), StepMs: time.Hour.Milliseconds()},
+			},
+		},
+	}
+	data, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, remoteReadPath, bytes.NewReader(snappy.Encode(nil, data)))
+	p.remoteReadHandler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+	}
+
+	values := make(map[int64]float64)
+	stream := remote.NewChunkedReader(w.Body, remote.DefaultChunkedReadLimit, nil)
+	for {
+		frame := &prompb.ChunkedReadResponse{}
+		err := stream.NextProto(frame)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, series := range frame.ChunkedSeries {
+			// 降采样指标名还原为原始指标名
+			if name := series.Labels[0]; name.Name != pb.MetricLabelName || name.Value != "x" {
+				t.Fatalf("query %d: unexpected labels %v", frame.QueryIndex, series.Labels)
+			}
+			chunk, err := chunkenc.FromData(chunkenc.EncXOR, series.Chunks[0].Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			it := chunk.Iterator(nil)
+			it.Next()
+			_, values[frame.QueryIndex] = it.At()
+		}
+	}
+	// 第一个 query 读取降采样数据源, 其余 query 读取原始数据源
+	if len(values) != 3 || values[0] != 2 || values[1] != 1 || values[2] != 1 {
+		t.Fatalf("got values %v", values)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	// 最后一个请求之前是协商响应类型的探测请求
+	if last := dsNames[len(dsNames)-1]; last != "x:downsample_5m_max" {
+		t.Fatalf("got downsample queries %v", dsNames)
+	}
+	if last := rowNames[len(rowNames)-1]; last != "x" {
+		t.Fatalf("got row queries %v", rowNames)
+	}
+}
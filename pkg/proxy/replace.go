@@ -15,116 +15,108 @@ func (p *Proxy) rangeQueryReplace(
 	query string,
 	start float64,
 	end float64,
+	step int64,
 ) *replaceResult {
 	startTime, endTime := time.Unix(int64(start), 0), time.Unix(int64(end), 0)
 
-	var replaced bool
-	// 1. 判断当前的 start和end 跨度是否满足某个resolution的时间范围
-	rset, resolutionFind := p.checkResolution(endTime.Sub(startTime), rangeQ)
-	if !resolutionFind {
-		return p.newDefaultReplaceResult(query)
-	}
+	var (
+		replaced      bool
+		lookBackDelta time.Duration
+		selectors     []selectorExplain
+	)
+	// 1. 根据 step 和 start/end 跨度选择 resolution, 没有合适的 resolution 时只改写子查询
+	rset, _ := p.selectRangeResolution(endTime.Sub(startTime), time.Duration(step)*time.Second)
 
 	expr, err := parser.ParseExpr(query)
 	if err != nil {
 		return p.newDefaultReplaceResult(query)
 	}
+	controls := extractControls(expr)
+	if len(controls) > 0 {
+		query = expr.String()
+	}
+
+	// 2. 按照包裹选择器的函数选择降采样聚合, 任意一个选择器没有正确的降采样聚合,
+	// 或者降采样指标还不存在/没有覆盖查询范围时, 整个查询使用原始数据
+	rewrites, raw, fallback := p.planRewrites(expr, rset, false, startTime, endTime, controls)
+	if fallback {
+		logrus.Warnln("range query has no matching downsample aggregation, fallback to raw data:", query)
+		rr := p.newDefaultReplaceResult(query)
+		rr.fallback = true
+		return rr
+	}
+	// 改写后的查询转发到 downsample 数据源, 其中仍然查询原始指标的选择器 (如只改写了子查询时外层的选择器) 没有数据,
+	// 原始指标和降采样指标混合时整个查询使用原始数据
+	if raw > 0 && len(rewrites) > 0 {
+		logrus.Warnln("range query mixes raw and downsample selectors, fallback to raw data:", query)
+		rr := p.newDefaultReplaceResult(query)
+		rr.fallback = true
+		return rr
+	}
 
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
-		switch n := node.(type) {
-		case *parser.MatrixSelector:
-			vector := n.VectorSelector.(*parser.VectorSelector)
-			_, _, metricFind := p.checkMetricName(vector)
-			if !metricFind {
-				return nil
-			}
-
-			replaced = true
-			/*
-				在 MatrixSelector 这一步不要替换metric
-				ast 解析由外到内,即 MatrixSelector->VectorSelector
-				如果在 MatrixSelector 阶段就进行替换，会导致后续的 VectorSelector 重复替换，导致指标出错
-				会出现类似: net_ecs_cpuutilization:downsample_5m_avg:downsample_5m_avg 指标
-			*/
-			//p.injectReplacedMetric(vector, mp.Metric, mp.Agg, rset.StringInterval)
-
-			// 替换 [range vector]
-			// 判断当前range是否 > resolution * 4, 如果是，则不需要替换
-			// 否则，要替换为 resolution * 4 的range vector
-			if n.Range < time.Duration(rset.SampleInterval)*pb.ExtrapolatedMultiple {
-				n.Range = time.Duration(rset.SampleInterval) * pb.ExtrapolatedMultiple
-			}
-		case *parser.VectorSelector:
-			//  判断query中是否需要替换metric
-			mp, metricName, metricFind := p.checkMetricName(n)
-			if !metricFind {
-				return nil
-			}
-
-			replaced = true
-			// 替换metric
-			p.injectReplacedMetric(n, metricName, mp.Agg, rset.StringInterval)
-		case *parser.SubqueryExpr:
-		case *parser.Call:
-		default:
+	for _, rw := range rewrites {
+		replaced = true
+		se := rw.explain()
+		// 替换 [range vector]
+		rw.expandRange()
+		expr = p.apply(expr, rw)
+		selectors = append(selectors, se.rewritten(rw))
+		// 子查询可能使用更粗的 resolution, lookback_delta 需要覆盖所有使用的 resolution
+		if interval := time.Duration(rw.rset.SampleInterval); interval > lookBackDelta {
+			lookBackDelta = interval
 		}
-		return nil
-	})
+	}
 
 	rr := p.newDefaultReplaceResult(expr.String())
+	rr.selectors = selectors
 	if replaced {
+		rr.replaced = true
 		rr.needChangeLookBackDelta = true
-		rr.lookBackDelta = time.Duration(rset.SampleInterval)
-
-		// 打点
-		p.proxyDownsampleTotalCounter.WithLabelValues(rangeQ).Inc()
-		logrus.Warnln("before range query replace:", query)
-		logrus.Warnln("after range query replace:", expr.String())
+		rr.lookBackDelta = lookBackDelta
+		rr.resolution = rset
+		rr.query = query
 	}
 	return rr
 }
 
-func (p *Proxy) instantQueryReplace(query string) string {
+// instantQueryReplace 返回的结果不需要修改 lookback_delta
+func (p *Proxy) instantQueryReplace(query string, ts float64) *replaceResult {
 	// query := `up[1m] + uuuuuupuup[2m] + up{}[5m] + up[10m]`
-	var replaced bool
+	var (
+		replaced  bool
+		selectors []selectorExplain
+	)
 
 	expr, err := parser.ParseExpr(query)
 	if err != nil {
-		return query
+		return p.newDefaultReplaceResult(query)
 	}
+	controls := extractControls(expr)
 
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
-		// 每个 node 都是一个子的promQL表达式，需要对每个node做相同判断逻辑
-		switch n := node.(type) {
-		case *parser.MatrixSelector:
-			vector := n.VectorSelector.(*parser.VectorSelector)
-			// 例如: up[1m] 获取 sum(rate(up[1m])) 中的 up[1m]，需要对up进行替换
-			// 1. 首先要判断当前的 __name__ 是否需要替换
-			mp, metricName, metricFind := p.checkMetricName(vector)
-
-			// 2. 判断当前range vector 的窗口是否符合替换规则
-			rset, resolutionFind := p.checkResolution(n.Range, instantQ)
-
-			if !metricFind || !resolutionFind {
-				return nil
-			}
-
-			replaced = true
-			// 3. 进行指标替换
-			p.injectReplacedMetric(vector, metricName, mp.Agg, rset.StringInterval)
-		case *parser.SubqueryExpr:
-		case *parser.Call:
-		default:
+	// instant query 按照 range vector 的窗口选择 resolution, 没有正确降采样聚合的选择器保持原始指标
+	evalTime := time.Now()
+	if ts > 0 {
+		evalTime = time.Unix(int64(ts), 0)
+	}
+	rewrites, _, _ := p.planRewrites(expr, nil, true, evalTime, evalTime, controls)
+	for _, rw := range rewrites {
+		replaced = true
+		se := rw.explain()
+		// 子查询中的 range vector 按照子查询的 resolution 选择, 窗口需要覆盖足够的降采样点
+		if rw.subquery != nil {
+			rw.expandRange()
 		}
-		return nil
-	})
+		expr = p.apply(expr, rw)
+		selectors = append(selectors, se.rewritten(rw))
+	}
 
+	rr := p.newDefaultReplaceResult(expr.String())
+	rr.replaced = replaced
+	rr.selectors = selectors
 	if replaced {
-		p.proxyDownsampleTotalCounter.WithLabelValues(instantQ).Inc()
-		logrus.Warnln("before instant query replace:", query)
-		logrus.Warnln("after instant query replace:", expr.String())
+		rr.query = query
 	}
-	return expr.String()
+	return rr
 }
 
 func (p *Proxy) checkMetricName(vector *parser.VectorSelector) (pb.MetricProxy, string, bool) {
@@ -138,6 +130,28 @@ func (p *Proxy) checkMetricName(vector *parser.VectorSelector) (pb.MetricProxy,
 	return pb.MetricProxy{}, "", false
 }
 
+// selectRangeResolution 选择 range query 使用的 resolution
+// 指定 step 时选择 sample interval 不超过 step 的最粗 resolution, 且查询跨度至少覆盖一个窗口, step 比所有 resolution 都小时查询原始数据;
+// 未指定 step 时按查询跨度选择
+func (p *Proxy) selectRangeResolution(rge, step time.Duration) (*pb.ResolutionSet, bool) {
+	if step <= 0 {
+		return p.checkResolution(rge, rangeQ)
+	}
+
+	var best *pb.ResolutionSet
+	for i := range p.resolutions {
+		rs := &p.resolutions[i]
+		interval := time.Duration(rs.SampleInterval)
+		if interval > step || interval > rge {
+			continue
+		}
+		if best == nil || interval > time.Duration(best.SampleInterval) {
+			best = rs
+		}
+	}
+	return best, best != nil
+}
+
 func (p *Proxy) checkResolution(rge time.Duration, tp string) (*pb.ResolutionSet, bool) {
 	for _, resolution := range p.resolutions {
 		compare := time.Duration(resolution.TimeRange)
@@ -217,37 +231,102 @@ func (p *Proxy) newDefaultReplaceResult(query string) *replaceResult {
 	}
 }
 
-func (p *Proxy) queryReplace(
-	query string,
-	start float64,
-	end float64,
-	queryType string,
-) *replaceResult {
-	if len(p.mps) == 0 {
-		return p.newDefaultReplaceResult(query)
+func (p *Proxy) queryReplace(q *QueryParams, queryType string) *replaceResult {
+	// 伪 label matcher 只用于控制改写, q.Query 中总是去除, 拆分查询等使用原始查询时不会发送到 prometheus
+	query := q.Query
+	q.Query = stripControls(query)
+	if len(p.mps) == 0 || q.downsampleOff() {
+		return p.newDefaultReplaceResult(q.Query)
 	}
 
 	switch queryType {
 	case rangeQueryPath:
 		// 只针对 range_query 的case下，才返回 replaceResult 对象
-		return p.rangeQueryReplace(query, start, end)
+		return p.rangeQueryReplace(query, q.Start, q.End, q.Step)
 	case instantQueryPath:
 		// instant_query 不需要修改lookbackDelta
-		// 只需要根据 query 构建 replaceResult 对象
-		q := p.instantQueryReplace(query)
-		return p.newDefaultReplaceResult(q)
+		return p.instantQueryReplace(query, q.Time)
 	default:
-		return p.newDefaultReplaceResult(query)
+		return p.newDefaultReplaceResult(q.Query)
 	}
 }
 
 type replaceResult struct {
 	finalQuery string
+	// 改写前的查询, 只在 replaced 时设置, 用于日志
+	query string
+	// 查询中存在被替换为降采样指标的选择器
+	replaced bool
+	// 存在无法改写的选择器, 整个查询使用原始数据
+	fallback bool
+	// 每个被替换的选择器的改写方式, 用于 explain
+	selectors []selectorExplain
 
 	lookBackDelta        time.Duration
 	defaultLookBackDelta time.Duration
 
 	needChangeLookBackDelta bool
+
+	// 替换后外层查询使用的 resolution, 未替换或只替换了子查询时为 nil
+	resolution *pb.ResolutionSet
+	// align 之前的 step, 拆分查询时原始数据部分使用
+	step int64
+}
+
+// observe 记录改写的打点和日志, 只在转发查询时调用, explain 等只计算改写结果的调用不计入
+func (p *Proxy) observe(queryPath string, r *replaceResult) {
+	if !r.replaced {
+		return
+	}
+
+	queryType := instantQ
+	if queryPath == rangeQueryPath {
+		queryType = rangeQ
+	}
+	p.proxyDownsampleTotalCounter.WithLabelValues(queryType).Inc()
+	logrus.Warnf("before %s query replace: %s", queryType, r.query)
+	logrus.Warnf("after %s query replace: %s", queryType, r.finalQuery)
+}
+
+// interval 返回外层查询使用的降采样 resolution 的采样间隔, 使用原始数据时为 0
+func (r *replaceResult) interval() time.Duration {
+	if r.resolution == nil {
+		return 0
+	}
+	return time.Duration(r.resolution.SampleInterval)
+}
+
+// tier 返回结果缓存 key 中的 resolution
+func (r *replaceResult) tier() string {
+	if r.resolution == nil {
+		return rawTier
+	}
+	return r.resolution.StringInterval
+}
+
+// rawStep 返回 align 之前客户端请求的 step, 未对齐时为 q.Step
+func (r *replaceResult) rawStep(q *QueryParams) int64 {
+	if r.step > 0 {
+		return r.step
+	}
+	return q.Step
+}
+
+// align 将 step 向上对齐为 resolution 的整数倍, 并将 start 向前对齐到 resolution,
+// 使每个计算时间点都落在降采样点上, 避免面板上出现空洞; 对齐前的 step 记录在 r.step
+func (r *replaceResult) align(q *QueryParams) {
+	r.step = q.Step
+	if r.resolution == nil || q.Step <= 0 {
+		return
+	}
+
+	interval := int64(time.Duration(r.resolution.SampleInterval) / time.Second)
+	if interval <= 0 {
+		return
+	}
+	// step 向上取整, 不能小于原 step, 否则点数增加, 可能超过 prometheus 的点数限制
+	q.Step = (q.Step + interval - 1) / interval * interval
+	q.Start = float64(int64(q.Start) / interval * interval)
 }
 
 func (r *replaceResult) autoExpandLookBackDelta() string {
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"prom-stream-downsample/pkg/pb"
+	p8s "prom-stream-downsample/pkg/prometheus"
+)
+
+// newTestProxy 返回只有一个 5m resolution (查询跨度超过 1d 时使用) 的 proxy
+func newTestProxy(metric, agg string, aggs ...string) *Proxy {
+	re := regexp.MustCompile("^" + metric + "$")
+	return &Proxy{
+		resolutions: []pb.ResolutionSet{{
+			SampleInterval: model.Duration(5 * time.Minute),
+			StringInterval: "5m",
+			TimeRange:      model.Duration(24 * time.Hour),
+		}},
+		mps:            pb.MetricProxySet{re: {MetricRe: re, Agg: agg, Aggs: aggs}},
+		prometheusInfo: &p8s.PrometheusMetaInfo{QueryLookBackDelta: 5 * time.Minute},
+		proxyDownsampleTotalCounter: *prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "psd_proxy_downsample_total",
+		}, []string{"query_type"}),
+	}
+}
+
+func mustFormat(t *testing.T, query string) string {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expr.String()
+}
+
+func TestRangeQueryReplaceFunctionAware(t *testing.T) {
+	p := newTestProxy("x", "avg", "max", "min", "sum", "count", "last")
+	end := float64(30 * 24 * 3600)
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{`x`, `{__name__="x:downsample_5m_avg"}`},
+		{`max_over_time(x[1d])`, `max_over_time({__name__="x:downsample_5m_max"}[1d])`},
+		{`min_over_time(x{job="a"}[1d])`, `min_over_time({__name__="x:downsample_5m_min",job="a"}[1d])`},
+		{`count_over_time(x[30d])`, `sum_over_time({__name__="x:downsample_5m_count"}[30d])`},
+		// 累加的函数不扩大 range, range 小于 resolution 时使用原始数据
+		{`max_over_time(x[10m])`, `max_over_time({__name__="x:downsample_5m_max"}[20m])`},
+		{`sum_over_time(x[10m])`, `sum_over_time({__name__="x:downsample_5m_sum"}[10m])`},
+		{`count_over_time(x[1m])`, `count_over_time(x[1m])`},
+		{
+			`2 * avg_over_time(x[1d])`,
+			`2 * (sum_over_time({__name__="x:downsample_5m_sum"}[1d]) / sum_over_time({__name__="x:downsample_5m_count"}[1d]))`,
+		},
+		{`avg_over_time(x[1d])`, `(sum_over_time({__name__="x:downsample_5m_sum"}[1d]) / sum_over_time({__name__="x:downsample_5m_count"}[1d]))`},
+		// 没有正确的降采样聚合, 整个查询使用原始数据
+		{`quantile_over_time(0.9, x[1d])`, `quantile_over_time(0.9, x[1d])`},
+		{`max_over_time(x[1d]) - stddev_over_time(x[1d])`, `max_over_time(x[1d]) - stddev_over_time(x[1d])`},
+		// 降采样数据上无法处理窗口内的 counter 重置
+		{`rate(x[1h])`, `rate(x[1h])`},
+		{`sum(increase(x[5m]))`, `sum(increase(x[5m]))`},
+	} {
+		rr := p.rangeQueryReplace(tc.query, 0, end, 3600)
+		if want := mustFormat(t, tc.want); rr.finalQuery != want {
+			t.Errorf("%s: got %s, want %s", tc.query, rr.finalQuery, want)
+		}
+	}
+
+	// 只有 avg 时 avg_over_time/max_over_time 都只能查询原始数据
+	p = newTestProxy("x", "avg")
+	if rr := p.rangeQueryReplace(`avg_over_time(x[1d])`, 0, end, 3600); rr.needChangeLookBackDelta || rr.finalQuery != `avg_over_time(x[1d])` {
+		t.Errorf("got %s", rr.finalQuery)
+	}
+	if rr := p.rangeQueryReplace(`max_over_time(x[1d])`, 0, end, 3600); rr.needChangeLookBackDelta || rr.finalQuery != `max_over_time(x[1d])` {
+		t.Errorf("got %s", rr.finalQuery)
+	}
+}
+
+func TestInstantQueryReplaceFunctionAware(t *testing.T) {
+	p := newTestProxy("x", "avg", "max")
+
+	got := p.instantQueryReplace(`max_over_time(x[1h]) / quantile_over_time(0.5, x[1h]) + x`, 0).finalQuery
+	want := mustFormat(t, `max_over_time({__name__="x:downsample_5m_max"}[1h]) / quantile_over_time(0.5, x[1h]) + x`)
+	if got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestSelectRangeResolution(t *testing.T) {
+	p := &Proxy{resolutions: []pb.ResolutionSet{
+		{SampleInterval: model.Duration(time.Hour), StringInterval: "1h", TimeRange: model.Duration(30 * 24 * time.Hour)},
+		{SampleInterval: model.Duration(5 * time.Minute), StringInterval: "5m", TimeRange: model.Duration(24 * time.Hour)},
+	}}
+
+	for _, tc := range []struct {
+		rge, step time.Duration
+		want      string
+	}{
+		// step 比所有 resolution 都小, 查询原始数据
+		{7 * 24 * time.Hour, 30 * time.Second, ""},
+		{7 * 24 * time.Hour, 10 * time.Minute, "5m"},
+		// 查询跨度小于 TimeRange, 但 step 足够大
+		{6 * time.Hour, time.Hour, "1h"},
+		{30 * time.Minute, time.Hour, "5m"},
+		// 未指定 step 时按查询跨度选择
+		{7 * 24 * time.Hour, 0, "5m"},
+	} {
+		rs, ok := p.selectRangeResolution(tc.rge, tc.step)
+		var got string
+		if ok {
+			got = rs.StringInterval
+		}
+		if got != tc.want {
+			t.Errorf("range %s step %s: got %q, want %q", tc.rge, tc.step, got, tc.want)
+		}
+	}
+
+	rr := &replaceResult{resolution: &p.resolutions[1]}
+	q := &QueryParams{Start: 1000, Step: 700}
+	rr.align(q)
+	if q.Step != 900 || q.Start != 900 {
+		t.Fatalf("got step %d start %v, want 900 900", q.Step, q.Start)
+	}
+	// 已经是整数倍的 step 不变
+	q = &QueryParams{Start: 900, Step: 600}
+	rr.align(q)
+	if q.Step != 600 || q.Start != 900 {
+		t.Fatalf("got step %d start %v, want 600 900", q.Step, q.Start)
+	}
+}
+
+func TestSubqueryReplace(t *testing.T) {
+	p := newTestProxy("x", "avg", "last", "max")
+	end := float64(60 * 24 * 3600)
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		// 外层 step 比 resolution 小, 只改写子查询, 子查询中的 range 扩大到 resolution * 4
+		{`max_over_time(max_over_time(x[5m])[30d:1h])`, `max_over_time(max_over_time({__name__="x:downsample_5m_max"}[20m])[30d:1h])`},
+		// 外层的选择器仍然查询原始指标, 与降采样指标混合时整个查询使用原始数据
+		{`max_over_time(x[1d:10m]) - x`, `max_over_time(x[1d:10m]) - x`},
+		// 子查询的 step 比 resolution 小, 查询原始数据
+		{`max_over_time(x[1d:1m])`, `max_over_time(x[1d:1m])`},
+		// 子查询中没有正确的降采样聚合, 整个查询使用原始数据
+		{`max_over_time(irate(x[5m])[30d:1h])`, `max_over_time(irate(x[5m])[30d:1h])`},
+	} {
+		rr := p.rangeQueryReplace(tc.query, end-3600, end, 60)
+		if want := mustFormat(t, tc.want); rr.finalQuery != want {
+			t.Errorf("%s: got %s, want %s", tc.query, rr.finalQuery, want)
+		}
+		if rr.resolution != nil {
+			t.Errorf("%s: unexpected outer resolution %s", tc.query, rr.resolution.StringInterval)
+		}
+	}
+
+	rr := p.rangeQueryReplace(`max_over_time(x[1d:10m])`, end-3600, end, 60)
+	if !rr.needChangeLookBackDelta || rr.autoExpandLookBackDelta() != "10m0s" {
+		t.Fatalf("got lookback delta %s", rr.autoExpandLookBackDelta())
+	}
+
+	// instant query 只改写子查询中的 range vector
+	got := p.instantQueryReplace(`max_over_time(last_over_time(x[5m])[30d:1h]) + max_over_time(x[1d:10m])`, end).finalQuery
+	want := mustFormat(t, `max_over_time(last_over_time({__name__="x:downsample_5m_last"}[20m])[30d:1h]) + max_over_time(x[1d:10m])`)
+	if got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestQueryReplaceControls(t *testing.T) {
+	p := newTestProxy("x", "avg", "max", "count")
+	p.resolutions = append(p.resolutions, pb.ResolutionSet{
+		SampleInterval: model.Duration(time.Hour),
+		StringInterval: "1h",
+		TimeRange:      model.Duration(30 * 24 * time.Hour),
+	})
+	end := float64(60 * 24 * 3600)
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		// 指定 resolution 和聚合, 优先于按 step 和函数的自动选择
+		{`x{__resolution__="1h", __agg__="max", job="a"}`, `{__name__="x:downsample_1h_max",job="a"}`},
+		{`count_over_time(x{__agg__="count"}[1d])`, `sum_over_time({__name__="x:downsample_5m_count"}[1d])`},
+		{`max_over_time(x{__agg__="avg"}[1d])`, `max_over_time({__name__="x:downsample_5m_avg"}[1d])`},
+		// 指定 raw 的选择器与其它改写的选择器无法在同一个数据源中查询, 整个查询使用原始数据
+		{`x{__resolution__="raw"} - x`, `x - x`},
+		{`x{__resolution__="2h"} - x`, `x - x`},
+		// 不需要代理的指标也去除伪 label matcher
+		{`y{__resolution__="1h"}`, `y`},
+	} {
+		q := &QueryParams{Query: tc.query, Start: end - 7*24*3600, End: end, Step: 600}
+		rr := p.queryReplace(q, rangeQueryPath)
+		if want := mustFormat(t, tc.want); rr.finalQuery != want {
+			t.Errorf("%s: got %s, want %s", tc.query, rr.finalQuery, want)
+		}
+	}
+
+	// 关闭降采样时只去除伪 label matcher
+	q := &QueryParams{Query: `max_over_time(x{__agg__="max"}[1d])`, Start: end - 7*24*3600, End: end, Step: 600, Downsample: "off"}
+	rr := p.queryReplace(q, rangeQueryPath)
+	if rr.needChangeLookBackDelta || rr.finalQuery != `max_over_time(x[1d])` || q.Query != rr.finalQuery {
+		t.Fatalf("got %s", rr.finalQuery)
+	}
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/sirupsen/logrus"
+
+	"prom-stream-downsample/pkg/pb"
+)
+
+// restoreMetric 将降采样指标名还原为原始指标名, withLabels 时添加 resolution/agg label (已存在时不覆盖)
+// 不是降采样指标时返回 false
+func restoreMetric(m model.Metric, withLabels bool) (model.Metric, bool) {
+	metric, interval, agg, ok := pb.ParseDownSampleMetric(string(m[model.MetricNameLabel]))
+	if !ok {
+		return m, false
+	}
+
+	m = m.Clone()
+	m[model.MetricNameLabel] = model.LabelValue(metric)
+	if withLabels {
+		if _, exist := m[pb.ResolutionLabel]; !exist {
+			m[pb.ResolutionLabel] = model.LabelValue(interval)
+		}
+		if _, exist := m[pb.AggLabel]; !exist {
+			m[pb.AggLabel] = model.LabelValue(agg)
+		}
+	}
+	return m, true
+}
+
+// restoreMatrix 还原已解码的 range query 结果中的降采样指标名
+func restoreMatrix(resp *apiResponse, withLabels bool) {
+	if resp.Data == nil {
+		return
+	}
+	for _, ss := range resp.Data.Result {
+		ss.Metric, _ = restoreMetric(ss.Metric, withLabels)
+	}
+}
+
+// restoreResponse 返回 reverse proxy 的 ModifyResponse, 流式还原 query/query_range 响应中的降采样指标名
+func (p *Proxy) restoreResponse(resp *http.Response) error {
+	// 转发时去除了 Accept-Encoding, 响应由 transport 解压; 无法识别的响应原样返回
+	if len(resp.Header.Get("Content-Encoding")) > 0 ||
+		!strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		err := rewriteResponse(body, pw, p.downsampleLabels)
+		if err != nil {
+			logrus.WithField("error", err).Errorln("restore downsample metric name in response failed")
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// rewriteResponse 逐个解码 data.result 中的序列并还原指标名, 其它部分原样写出, 不需要将整个响应读入内存
+func rewriteResponse(r io.Reader, w io.Writer, withLabels bool) error {
+	bw := bufio.NewWriter(w)
+	rw := &responseRewriter{dec: json.NewDecoder(r), w: bw, withLabels: withLabels}
+	if err := rw.object(func(key string) error {
+		if key == "data" {
+			return rw.object(func(key string) error {
+				if key == "result" {
+					return rw.result()
+				}
+				return rw.raw()
+			})
+		}
+		return rw.raw()
+	}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+type responseRewriter struct {
+	dec        *json.Decoder
+	w          *bufio.Writer
+	withLabels bool
+}
+
+// object 写出一个 json object, 每个字段的值由 field 写出; 值不是 object 时原样写出
+func (rw *responseRewriter) object(field func(key string) error) error {
+	tok, err := rw.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return rw.token(tok)
+	}
+
+	rw.w.WriteByte('{')
+	for i := 0; rw.dec.More(); i++ {
+		tok, err := rw.dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected object key %v", tok)
+		}
+
+		if i > 0 {
+			rw.w.WriteByte(',')
+		}
+		if err := rw.token(key); err != nil {
+			return err
+		}
+		rw.w.WriteByte(':')
+		if err := field(key); err != nil {
+			return err
+		}
+	}
+	if _, err := rw.dec.Token(); err != nil {
+		return err
+	}
+	return rw.w.WriteByte('}')
+}
+
+// result 写出 data.result, vector/matrix 中的每个序列还原指标名后写出
+func (rw *responseRewriter) result() error {
+	tok, err := rw.dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('[') {
+		return rw.token(tok)
+	}
+
+	rw.w.WriteByte('[')
+	for i := 0; rw.dec.More(); i++ {
+		var elem json.RawMessage
+		if err := rw.dec.Decode(&elem); err != nil {
+			return err
+		}
+		if i > 0 {
+			rw.w.WriteByte(',')
+		}
+		// scalar/string 的结果是 [时间, 值], 不是序列
+		if len(elem) > 0 && elem[0] == '{' {
+			if elem, err = rw.series(elem); err != nil {
+				return err
+			}
+		}
+		rw.w.Write(elem)
+	}
+	if _, err := rw.dec.Token(); err != nil {
+		return err
+	}
+	return rw.w.WriteByte(']')
+}
+
+func (rw *responseRewriter) series(elem json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(elem, &fields); err != nil {
+		return nil, err
+	}
+
+	if _, ok := fields["metric"]; !ok {
+		return elem, nil
+	}
+	var metric model.Metric
+	if err := json.Unmarshal(fields["metric"], &metric); err != nil {
+		return nil, err
+	}
+	metric, ok := restoreMetric(metric, rw.withLabels)
+	if !ok {
+		return elem, nil
+	}
+
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return nil, err
+	}
+	fields["metric"] = data
+	return json.Marshal(fields)
+}
+
+func (rw *responseRewriter) raw() error {
+	var value json.RawMessage
+	if err := rw.dec.Decode(&value); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(value)
+	return err
+}
+
+// token 写出一个非 object/array 的值
+func (rw *responseRewriter) token(tok json.Token) error {
+	if delim, ok := tok.(json.Delim); ok {
+		return fmt.Errorf("unexpected json delimiter %s", delim)
+	}
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	_, err = rw.w.Write(data)
+	return err
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestRewriteResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		body       string
+		withLabels bool
+		want       string
+	}{
+		{
+			name: "matrix",
+			body: `{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"x:downsample_5m_avg","job":"a"},"values":[[1,"1"]]},` +
+				`{"metric":{"__name__":"y"},"values":[[1,"2"]]}]},"warnings":["w"]}`,
+			want: `{"status":"success","data":{"resultType":"matrix","result":[` +
+				`{"metric":{"__name__":"x","job":"a"},"values":[[1,"1"]]},` +
+				`{"metric":{"__name__":"y"},"values":[[1,"2"]]}]},"warnings":["w"]}`,
+		},
+		{
+			name:       "vector with labels",
+			body:       `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"x:downsample_1h_max","agg":"keep"},"value":[1,"1"]}]}}`,
+			withLabels: true,
+			want:       `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"x","agg":"keep","resolution":"1h"},"value":[1,"1"]}]}}`,
+		},
+		{
+			name: "scalar",
+			body: `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+			want: `{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+		},
+		{
+			name: "error",
+			body: `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+			want: `{"status":"error","errorType":"bad_data","error":"parse error"}`,
+		},
+	} {
+		var buf bytes.Buffer
+		if err := rewriteResponse(strings.NewReader(tc.body), &buf, tc.withLabels); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !json.Valid(buf.Bytes()) || buf.String() != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestRestoreMatrix(t *testing.T) {
+	resp := &apiResponse{Data: &matrixData{Result: model.Matrix{
+		{Metric: model.Metric{"__name__": "x:downsample_5m_avg"}},
+	}}}
+	restoreMatrix(resp, true)
+	want := model.Metric{"__name__": "x", "resolution": "5m", "agg": "avg"}
+	if got := resp.Data.Result[0].Metric; !got.Equal(want) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
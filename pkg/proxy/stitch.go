@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/sirupsen/logrus"
+)
+
+// apiResponse 是 prometheus http api 的响应
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      *matrixData `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+	code      int
+}
+
+type matrixData struct {
+	ResultType string       `json:"resultType"`
+	Result     model.Matrix `json:"result"`
+}
+
+// stitchSplit 返回原始数据保留边界对齐到 step 之后的拆分点, [start, split) 查询降采样数据, [split, end] 查询原始数据
+// 拆分点位于 step 网格上, 两部分的计算时间点与整体查询完全一致;
+// 原始数据部分每个计算时间点需要回溯 lookback 的数据, 边界向后移动 lookback, 保证回溯的数据都在保留时长内
+func stitchSplit(start, end float64, step int64, retention, lookback time.Duration, now time.Time) float64 {
+	boundary := float64(now.Add(-retention + lookback).Unix())
+	if boundary <= start {
+		return start
+	}
+	split := start + math.Ceil((boundary-start)/float64(step))*float64(step)
+	return math.Min(split, end+float64(step))
+}
+
+// stitchPoint 返回 range query 在原始数据保留边界的拆分点, 不需要拆分时返回 false
+func (p *Proxy) stitchPoint(q *QueryParams, replaceR *replaceResult, now time.Time) (float64, bool) {
+	if p.rawRetention <= 0 || q.Step <= 0 || !replaceR.needChangeLookBackDelta {
+		return 0, false
+	}
+
+	// 整个查询范围都超出了原始数据的保留时长时不需要拆分
+	lookback := queryLookback(q.Query, replaceR.defaultLookBackDelta)
+	split := stitchSplit(q.Start, q.End, q.Step, p.rawRetention, lookback, now)
+	return split, split <= q.End
+}
+
+// queryLookback 返回查询在一个计算时间点最多回溯的时长: 选择器的 range (不在 range vector 中时为 lookback_delta) 与 offset 之和,
+// 加上外层所有子查询的窗口和 offset
+func queryLookback(query string, lookBackDelta time.Duration) time.Duration {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return lookBackDelta
+	}
+
+	var max time.Duration
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vector, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		d := vector.OriginalOffset + lookBackDelta
+		if len(path) > 0 {
+			if matrix, ok := path[len(path)-1].(*parser.MatrixSelector); ok {
+				d = vector.OriginalOffset + matrix.Range
+			}
+		}
+		for _, n := range path {
+			if sq, ok := n.(*parser.SubqueryExpr); ok {
+				d += sq.Range + sq.OriginalOffset
+			}
+		}
+		if d > max {
+			max = d
+		}
+		return nil
+	})
+	return max
+}
+
+// stitchQuery 将 range query 在原始数据保留边界拆分后分别查询并合并, 不需要拆分时返回 false
+func (p *Proxy) stitchQuery(c *gin.Context, q *QueryParams, replaceR *replaceResult) bool {
+	split, ok := p.stitchPoint(q, replaceR, time.Now())
+	if !ok {
+		return false
+	}
+
+	// 原始数据部分使用对齐前的 step, 不损失近期数据的精度
+	parts := []rangePart{{
+		url:   p.rowProxyPath,
+		query: q.Query,
+		tier:  rawTier,
+		step:  replaceR.rawStep(q),
+		start: split,
+		end:   q.End,
+	}}
+	if split > q.Start {
+		cold := rangePart{
+			url:      p.downsampleProxyPath,
+			query:    replaceR.finalQuery,
+			tier:     replaceR.tier(),
+			interval: replaceR.interval(),
+			step:     q.Step,
+			start:    q.Start,
+			end:      split - float64(q.Step),
+		}
+		cold.lookBackDelta = p.lookBackDeltaParam(replaceR)
+		parts = append([]rangePart{cold}, parts...)
+	}
+
+	var wg sync.WaitGroup
+	resps := make([]*apiResponse, len(parts))
+	for i := range parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i] = p.queryRange(c.Request.Context(), c.Request.Header, parts[i], q)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, resp := range resps {
+		if resp.Status != "success" {
+			c.JSON(resp.code, resp)
+			return true
+		}
+	}
+
+	// 降采样部分还原为原始指标名后才能与原始数据的序列合并, 未开启 restore_metric_name 时两部分分别返回
+	if p.restoreMetricName && replaceR.replaced {
+		for _, resp := range resps {
+			restoreMatrix(resp, p.downsampleLabels)
+		}
+	}
+
+	logrus.Warnf("stitch range query [%s] at [%s]\n", q.Query, p.changeTime(split))
+	c.JSON(http.StatusOK, mergeMatrix(resps))
+	return true
+}
+
+// rawTier 是查询原始数据时缓存 key 中的 resolution
+const rawTier = "raw"
+
+// rangePart 是发往一个数据源的 range query
+type rangePart struct {
+	url   string
+	query string
+	tier  string
+	// tier 的采样间隔, 原始数据为 0
+	interval time.Duration
+	// 查询的 step, 单位秒
+	step          int64
+	start, end    float64
+	lookBackDelta string
+}
+
+// rangeQuery 将未拆分的 range query 通过结果缓存执行
+func (p *Proxy) rangeQuery(c *gin.Context, q *QueryParams, replaceR *replaceResult) {
+	part := rangePart{
+		url:   p.rowProxyPath,
+		query: replaceR.finalQuery,
+		tier:  rawTier,
+		step:  q.Step,
+		start: q.Start,
+		end:   q.End,
+	}
+	if replaceR.needChangeLookBackDelta {
+		part.url = p.downsampleProxyPath
+		part.tier = replaceR.tier()
+		part.interval = replaceR.interval()
+		part.lookBackDelta = p.lookBackDeltaParam(replaceR)
+	}
+
+	resp := p.queryRange(c.Request.Context(), c.Request.Header, part, q)
+	if resp.Status != "success" {
+		c.JSON(resp.code, resp)
+		return
+	}
+	if p.restoreMetricName && replaceR.replaced {
+		restoreMatrix(resp, p.downsampleLabels)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// queryRange 执行一个 range query, 开启结果缓存时拆分为多个子查询并行执行, 已缓存的子查询直接使用缓存结果
+func (p *Proxy) queryRange(ctx context.Context, header http.Header, part rangePart, q *QueryParams) *apiResponse {
+	if p.cache == nil || part.step <= 0 {
+		return p.queryRangeOnce(ctx, header, part, q)
+	}
+
+	var (
+		ranges = splitRange(part.start, part.end, part.step, p.cache.splitInterval)
+		resps  = make([]*apiResponse, len(ranges))
+		sem    = make(chan struct{}, splitConcurrency)
+		wg     sync.WaitGroup
+	)
+	for i, r := range ranges {
+		sub := part
+		sub.start, sub.end = r[0], r[1]
+		key := p.cache.key(sub, header)
+		if resp, ok := p.cache.get(key); ok {
+			resps[i] = resp
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, sub rangePart, key string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			resp := p.queryRangeOnce(ctx, header, sub, q)
+			if resp.Status == "success" && len(resp.Warnings) == 0 && p.cache.cacheable(sub.end, sub.interval, time.Now()) {
+				p.cache.set(key, resp)
+			}
+			resps[i] = resp
+		}(i, sub, key)
+	}
+	wg.Wait()
+
+	for _, resp := range resps {
+		if resp.Status != "success" {
+			return resp
+		}
+	}
+	return mergeMatrix(resps)
+}
+
+func (p *Proxy) queryRangeOnce(ctx context.Context, header http.Header, part rangePart, q *QueryParams) *apiResponse {
+	v := url.Values{}
+	v.Add("query", part.query)
+	v.Add("timeout", q.Timeout)
+	v.Add("start", p.changeTime(part.start))
+	v.Add("end", p.changeTime(part.end))
+	v.Add("step", (time.Duration(part.step) * time.Second).String())
+	if len(part.lookBackDelta) > 0 {
+		v.Add("lookback_delta", part.lookBackDelta)
+	}
+
+	resp, err := p.doQuery(ctx, header, strings.TrimSuffix(part.url, "/")+rangeQueryPath, v)
+	if err != nil {
+		return &apiResponse{Status: "error", ErrorType: "execution", Error: err.Error(), code: http.StatusBadGateway}
+	}
+	return resp
+}
+
+func (p *Proxy) doQuery(ctx context.Context, header http.Header, addr string, v url.Values) (*apiResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	// 透传认证等请求头, 压缩由 http client 处理
+	for k, vs := range header {
+		switch http.CanonicalHeaderKey(k) {
+		case "Content-Length", "Content-Type", "Accept-Encoding":
+			continue
+		}
+		req.Header[k] = vs
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &apiResponse{code: resp.StatusCode}
+	if err := json.Unmarshal(body, r); err != nil {
+		return nil, fmt.Errorf("decode %s response status code %d: %w", addr, resp.StatusCode, err)
+	}
+	if r.Status == "success" && (r.Data == nil || r.Data.ResultType != model.ValMatrix.String()) {
+		return nil, fmt.Errorf("unexpected %s response result type", addr)
+	}
+	return r, nil
+}
+
+// mergeMatrix 按时间顺序合并多个部分的结果, 指标和标签相同的序列合并为一个
+func mergeMatrix(resps []*apiResponse) *apiResponse {
+	var (
+		merged   = make(map[model.Fingerprint]*model.SampleStream)
+		warnings []string
+	)
+	for _, resp := range resps {
+		warnings = append(warnings, resp.Warnings...)
+
+		for _, ss := range resp.Data.Result {
+			fp := ss.Metric.Fingerprint()
+			if exist, ok := merged[fp]; ok {
+				exist.Values = append(exist.Values, ss.Values...)
+				exist.Histograms = append(exist.Histograms, ss.Histograms...)
+				continue
+			}
+			merged[fp] = ss
+		}
+	}
+
+	result := make(model.Matrix, 0, len(merged))
+	for _, ss := range merged {
+		result = append(result, ss)
+	}
+	sort.Sort(result)
+
+	return &apiResponse{
+		Status:   "success",
+		Data:     &matrixData{ResultType: model.ValMatrix.String(), Result: result},
+		Warnings: warnings,
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/common/model"
+)
+
+func TestStitchSplit(t *testing.T) {
+	now := time.Unix(10000, 0)
+	// 边界 10000-3600=6400, 对齐到 start=1000 起 step=60 的网格为 6400
+	if split := stitchSplit(1000, 10000, 60, time.Hour, 0, now); split != 6400 {
+		t.Fatalf("got split %v, want 6400", split)
+	}
+	// 边界不在网格上时向后对齐
+	if split := stitchSplit(1030, 10000, 60, time.Hour, 0, now); split != 6430 {
+		t.Fatalf("got split %v, want 6430", split)
+	}
+	// 整个范围都在保留时长内
+	if split := stitchSplit(7000, 10000, 60, time.Hour, 0, now); split != 7000 {
+		t.Fatalf("got split %v, want 7000", split)
+	}
+	// 边界向后移动查询回溯的时长 6400+600=7000
+	if split := stitchSplit(1000, 10000, 60, time.Hour, 10*time.Minute, now); split != 7000 {
+		t.Fatalf("got split %v, want 7000", split)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  time.Duration
+	}{
+		{`x`, 5 * time.Minute},
+		{`rate(x[1h] offset 1d) + y`, 25 * time.Hour},
+		{`max_over_time(rate(x[5m])[1d:1h] offset 1h)`, 25*time.Hour + 5*time.Minute},
+	} {
+		if got := queryLookback(tc.query, 5*time.Minute); got != tc.want {
+			t.Errorf("%s: got lookback %s, want %s", tc.query, got, tc.want)
+		}
+	}
+}
+
+// matrixServer 返回每个 step 一个点的 matrix, 值为 value
+func matrixServer(name string, value int, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		*queries = append(*queries, r.Form.Get("query"))
+
+		start, _ := time.Parse(time.RFC3339, r.Form.Get("start"))
+		end, _ := time.Parse(time.RFC3339, r.Form.Get("end"))
+		step, _ := time.ParseDuration(r.Form.Get("step"))
+
+		var values []string
+		for ts := start; !ts.After(end); ts = ts.Add(step) {
+			values = append(values, fmt.Sprintf(`[%d,"%d"]`, ts.Unix(), value))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"%s","job":"a"},"values":[%s]}]}}`,
+			name, joinValues(values))
+	}))
+}
+
+func joinValues(values []string) string {
+	var s string
+	for i, v := range values {
+		if i > 0 {
+			s += ","
+		}
+		s += v
+	}
+	return s
+}
+
+func TestStitchQuery(t *testing.T) {
+	var rowQueries, dsQueries []string
+	row := matrixServer("x", 1, &rowQueries)
+	defer row.Close()
+	ds := matrixServer("x:downsample_5m_avg", 2, &dsQueries)
+	defer ds.Close()
+
+	p := newTestProxy("x", "avg")
+	p.rowProxyPath, p.downsampleProxyPath = row.URL+"/", ds.URL
+	p.rawRetention = 24 * time.Hour
+	p.restoreMetricName = true
+
+	now := time.Now()
+	end := float64(now.Unix() - now.Unix()%3600)
+	q := &QueryParams{Query: "x", Start: end - 3*24*3600, End: end, Step: 3600}
+
+	replaceR := p.rangeQueryReplace(q.Query, q.Start, q.End, q.Step)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, rangeQueryPath, nil)
+	if !p.stitchQuery(c, q, replaceR) {
+		t.Fatal("expected stitched query")
+	}
+
+	if len(rowQueries) != 1 || rowQueries[0] != "x" || len(dsQueries) != 1 || dsQueries[0] != replaceR.finalQuery {
+		t.Fatalf("unexpected queries row %v downsample %v", rowQueries, dsQueries)
+	}
+
+	var resp apiResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data.Result) != 1 {
+		t.Fatalf("got %d series, want 1: %s", len(resp.Data.Result), w.Body.String())
+	}
+
+	ss := resp.Data.Result[0]
+	if ss.Metric[model.MetricNameLabel] != "x" {
+		t.Fatalf("unexpected metric %s", ss.Metric)
+	}
+	// 3 天每小时一个点, 最近 24 小时来自原始数据
+	if len(ss.Values) != 3*24+1 {
+		t.Fatalf("got %d points, want %d", len(ss.Values), 3*24+1)
+	}
+	for i, v := range ss.Values {
+		if i > 0 && v.Timestamp <= ss.Values[i-1].Timestamp {
+			t.Fatalf("points out of order at %d", i)
+		}
+		want := model.SampleValue(2)
+		// 原始数据部分需要回溯 lookback_delta
+		if v.Timestamp.Unix() >= now.Add(-24*time.Hour+5*time.Minute).Unix() {
+			want = 1
+		}
+		if v.Value != want {
+			t.Fatalf("point %d at %d: got %v, want %v", i, v.Timestamp.Unix(), v.Value, want)
+		}
+	}
+}
+
+func TestStitchQueryRawStep(t *testing.T) {
+	var rowQueries, dsQueries []string
+	var steps []string
+	row := matrixServer("x", 1, &rowQueries)
+	defer row.Close()
+	rowSteps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		steps = append(steps, r.Form.Get("step"))
+		row.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer rowSteps.Close()
+	ds := matrixServer("x:downsample_5m_avg", 2, &dsQueries)
+	defer ds.Close()
+
+	p := newTestProxy("x", "avg")
+	p.rowProxyPath, p.downsampleProxyPath = rowSteps.URL, ds.URL
+	p.rawRetention = 24 * time.Hour
+
+	now := time.Now()
+	end := float64(now.Unix() - now.Unix()%3600)
+	q := &QueryParams{Query: "x", Start: end - 3*24*3600, End: end, Step: 400}
+
+	replaceR := p.rangeQueryReplace(q.Query, q.Start, q.End, q.Step)
+	replaceR.align(q)
+	if q.Step != 600 {
+		t.Fatalf("got aligned step %d, want 600", q.Step)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, rangeQueryPath, nil)
+	if !p.stitchQuery(c, q, replaceR) {
+		t.Fatal("expected stitched query")
+	}
+	// 原始数据部分使用客户端请求的 step
+	if len(steps) != 1 || steps[0] != (400*time.Second).String() {
+		t.Fatalf("got raw steps %v, want [6m40s]", steps)
+	}
+
+	// 未开启 restore_metric_name 时降采样序列保留降采样指标名, 不与原始序列合并
+	var resp apiResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data.Result) != 2 {
+		t.Fatalf("got %d series, want 2: %s", len(resp.Data.Result), w.Body.String())
+	}
+}
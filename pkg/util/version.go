@@ -0,0 +1,27 @@
+package util
+
+import (
+	"strings"
+
+	"golang.org/x/mod/semver"
+)
+
+// CompareVersion 按 semver 规则比较两个版本号, 返回值语义同 semver.Compare
+// prometheus 的 buildinfo 返回的版本号不带 v 前缀 (如 2.45.0), 这里统一补齐
+// 不能直接使用 strings.Compare, 否则 2.9.0 会被认为大于 2.13.0
+func CompareVersion(a, b string) int {
+	return semver.Compare(canonicalVersion(a), canonicalVersion(b))
+}
+
+// ValidVersion 判断版本号是否是合法的 semver
+func ValidVersion(v string) bool {
+	return semver.IsValid(canonicalVersion(v))
+}
+
+func canonicalVersion(v string) string {
+	v = strings.TrimSpace(v)
+	if !strings.HasPrefix(v, "v") {
+		v = "v" + v
+	}
+	return v
+}
@@ -0,0 +1,21 @@
+package util
+
+import "testing"
+
+func TestCompareVersion(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"2.9.0", "2.13.0", -1},
+		{"2.13.0", "2.13.0", 0},
+		{"v2.45.0", "2.43.0", 1},
+		{"2.45.0-rc.0", "2.45.0", -1},
+	}
+
+	for _, c := range cases {
+		if got := CompareVersion(c.a, c.b); got != c.want {
+			t.Errorf("CompareVersion(%s, %s) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}